@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"msh/lib/errco"
 	"msh/lib/model"
@@ -92,6 +93,50 @@ func (c *Configuration) IsWhitelist(reqPacket []byte, clientAddress string) *err
 	}
 }
 
+// IsKnock checks if the server address used by the client is one of the secret hostnames in config.
+// Expired secret hostnames are ignored.
+//
+// If no secret hostname is specified in config, the check is disabled and nil is returned.
+func (c *Configuration) IsKnock(serverAddr string) *errco.MshLog {
+	// check if knock is enabled
+	if len(c.Msh.KnockHostnames) == 0 {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "knock hostnames not enabled")
+		return nil
+	}
+
+	// forge clients append "\x00FML\x00" (or similar) to the server address
+	serverAddr, _, _ = strings.Cut(serverAddr, "\x00")
+	serverAddr = strings.TrimSuffix(serverAddr, ".")
+
+	for _, k := range c.Msh.KnockHostnames {
+		// check if secret hostname is expired
+		if k.Expiry != "" {
+			expiry, err := time.Parse(time.RFC3339, k.Expiry)
+			if err != nil {
+				// date format: secret hostname is valid until the end of the day
+				if expiry, err = time.ParseInLocation("2006-01-02", k.Expiry, time.Local); err != nil {
+					errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_KNOCK_CHECK, "knock hostname %s has invalid expiry (%s)", k.Hostname, k.Expiry)
+					continue
+				}
+				expiry = expiry.AddDate(0, 0, 1)
+			}
+
+			if time.Now().After(expiry) {
+				errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "knock hostname %s is expired (%s)", k.Hostname, k.Expiry)
+				continue
+			}
+		}
+
+		// hostnames are case insensitive
+		if strings.EqualFold(strings.TrimSuffix(k.Hostname, "."), serverAddr) {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "knock ok!")
+			return nil
+		}
+	}
+
+	return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_KNOCK_CHECK, "knock hostname check failed (client used: \"%s\")", serverAddr)
+}
+
 // loadIcon tries to load user specified server icon (base-64 encoded and compressed).
 // The default icon is loaded by default
 func (c *Configuration) loadIcon() *errco.MshLog {
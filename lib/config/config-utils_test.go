@@ -0,0 +1,57 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"msh/lib/model"
+)
+
+func Test_IsKnock(t *testing.T) {
+	c := &Configuration{}
+
+	// knock disabled: every hostname is accepted
+	if logMsh := c.IsKnock("mc.example.org"); logMsh != nil {
+		t.Errorf("knock disabled: unexpected error %q", logMsh.Mex)
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1)
+	yesterday := time.Now().AddDate(0, 0, -1)
+
+	c.Msh.KnockHostnames = []model.KnockHostname{
+		{Hostname: "wake-7f3a.example.org"},
+		{Hostname: "Date.Example.org.", Expiry: tomorrow.Format("2006-01-02")},
+		{Hostname: "today.example.org", Expiry: time.Now().Format("2006-01-02")},
+		{Hostname: "rfc.example.org", Expiry: tomorrow.Format(time.RFC3339)},
+		{Hostname: "expired-date.example.org", Expiry: yesterday.Format("2006-01-02")},
+		{Hostname: "expired-rfc.example.org", Expiry: time.Now().Add(-time.Minute).Format(time.RFC3339)},
+		{Hostname: "invalid.example.org", Expiry: "next week"},
+	}
+
+	for _, test := range []struct {
+		serverAddr string
+		ok         bool
+	}{
+		{"wake-7f3a.example.org", true},                // exact match
+		{"WAKE-7F3A.Example.ORG", true},                // case insensitive
+		{"wake-7f3a.example.org.", true},               // fully qualified
+		{"wake-7f3a.example.org\x00FML\x00", true},     // forge client
+		{"wake-7f3a.example.org\x00FML2\x00", true},    // forge client (1.13+)
+		{"sub.wake-7f3a.example.org", false},           // subdomain
+		{"example.org", false},                         // parent domain
+		{"mc.example.org", false},                      // other hostname
+		{"", false},                                    // no hostname
+		{"date.example.org", true},                     // date expiry (not expired)
+		{"today.example.org", true},                    // date expiry (valid until the end of the day)
+		{"rfc.example.org", true},                      // rfc3339 expiry (not expired)
+		{"expired-date.example.org", false},            // date expiry (expired)
+		{"expired-rfc.example.org", false},             // rfc3339 expiry (expired)
+		{"invalid.example.org", false},                 // invalid expiry
+		{"expired-date.example.org\x00FML\x00", false}, // forge client (expired)
+	} {
+		logMsh := c.IsKnock(test.serverAddr)
+		if (logMsh == nil) != test.ok {
+			t.Errorf("%q: knock accepted %t, expected %t", test.serverAddr, logMsh == nil, test.ok)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,6 +19,15 @@ import (
 	"github.com/google/shlex"
 )
 
+// backend types
+const (
+	BACKEND_TERMINAL string = "terminal" // msh starts ms as child process and uses its terminal
+	BACKEND_EXTERNAL string = "external" // ms is started/stopped by external commands (systemd, screen, panels)
+	BACKEND_DOCKER   string = "docker"   // ms runs in a docker container managed through docker engine api
+	BACKEND_HTTP     string = "http"     // remote ms is started/stopped by http calls (machine/cloud instance switched on when needed)
+	BACKEND_AGENT    string = "agent"    // ms is controlled by a remote msh agent (msh runs as front proxy)
+)
+
 var (
 	configFileName string = "msh-config.json" // configFileName is the config file name
 
@@ -203,12 +213,43 @@ func (c *Configuration) loadRuntime(confdef *Configuration) *errco.MshLog {
 	flag.IntVar(&c.Msh.SuspendRefresh, "suspendrefresh", c.Msh.SuspendRefresh, "Specify how often the suspended minecraft server process must be refreshed.")
 	flag.StringVar(&c.Msh.InfoHibernation, "infohibe", c.Msh.InfoHibernation, "Specify hibernation info.")
 	flag.StringVar(&c.Msh.InfoStarting, "infostar", c.Msh.InfoStarting, "Specify starting info.")
+	flag.StringVar(&c.Msh.InfoWaking, "infowake", c.Msh.InfoWaking, "Specify waking machine info.")
 	flag.BoolVar(&c.Msh.NotifyUpdate, "notifyupd", c.Msh.NotifyUpdate, "Enables update notifications.")
 	flag.BoolVar(&c.Msh.NotifyMessage, "notifymes", c.Msh.NotifyMessage, "Enables message notifications.")
 	// c.Msh.Whitelist (type []string, not worth to make it a flag)
 	flag.BoolVar(&c.Msh.WhitelistImport, "wlimport", c.Msh.WhitelistImport, "Enables minecraft server whitelist import.")
 	flag.BoolVar(&c.Msh.ShowResourceUsage, "showres", c.Msh.ShowResourceUsage, "Enables logging of msh resource usage (cpu / mem percentage).")
 	flag.BoolVar(&c.Msh.ShowInternetUsage, "showint", c.Msh.ShowInternetUsage, "Enables logging of msh interent usage (->clients / ->server).")
+	flag.BoolVar(&c.Msh.ProtocolCheck, "protcheck", c.Msh.ProtocolCheck, "Enables refusal of clients with incompatible protocol.")
+	// c.Msh.ProtocolExtra (type []int, not worth to make it a flag)
+	// c.Msh.KnockHostnames (type []model.KnockHostname, not worth to make it a flag)
+	flag.IntVar(&c.Msh.StartQuorum.Players, "quorum", c.Msh.StartQuorum.Players, "Specify how many distinct players must try to join to warm minecraft server.")
+	flag.IntVar(&c.Msh.StartQuorum.Window, "quorumwindow", c.Msh.StartQuorum.Window, "Specify the time window (seconds) in which join attempts are counted for quorum.")
+	// c.Msh.StartQuorum.Bypass (type []string, not worth to make it a flag)
+	flag.BoolVar(&c.Msh.PreWarm.Enabled, "prewarm", c.Msh.PreWarm.Enabled, "Enables minecraft server pre-warm when a known client refreshes the server list.")
+	flag.BoolVar(&c.Msh.ConnectionLog.Enabled, "connlog", c.Msh.ConnectionLog.Enabled, "Enables recording of connection attempts in msh-connections.log.")
+	flag.BoolVar(&c.Msh.AfkKick.Enabled, "afkkick", c.Msh.AfkKick.Enabled, "Enables kick of idle players.")
+	flag.IntVar(&c.Msh.AfkKick.IdleTime, "afkidle", c.Msh.AfkKick.IdleTime, "Specify after how many seconds of idle traffic a player is kicked.")
+	flag.IntVar(&c.Msh.Throttle.ConnToClients, "limconnclients", c.Msh.Throttle.ConnToClients, "Specify the bandwidth limit (KB/s) to each client.")
+	flag.IntVar(&c.Msh.Throttle.ConnToServer, "limconnserver", c.Msh.Throttle.ConnToServer, "Specify the bandwidth limit (KB/s) to server from each client.")
+	flag.IntVar(&c.Msh.Throttle.GlobalToClients, "limclients", c.Msh.Throttle.GlobalToClients, "Specify the bandwidth limit (KB/s) to all clients.")
+	flag.IntVar(&c.Msh.Throttle.GlobalToServer, "limserver", c.Msh.Throttle.GlobalToServer, "Specify the bandwidth limit (KB/s) to server from all clients.")
+	flag.IntVar(&c.Msh.DataCap.Cap, "datacap", c.Msh.DataCap.Cap, "Specify the traffic (MB) allowed in a billing cycle.")
+	flag.StringVar(&c.Msh.QueryAdvertise.HostIP, "queryhostip", c.Msh.QueryAdvertise.HostIP, "Specify the host ip reported in query responses.")
+	flag.IntVar(&c.Msh.QueryAdvertise.HostPort, "queryhostport", c.Msh.QueryAdvertise.HostPort, "Specify the host port reported in query responses.")
+	flag.BoolVar(&c.Msh.LanAnnounce.Enabled, "lan", c.Msh.LanAnnounce.Enabled, "Enables msh announcement on the lan.")
+	flag.StringVar(&c.Msh.LanAnnounce.Interface, "laniface", c.Msh.LanAnnounce.Interface, "Specify the network interface used for lan announcements.")
+	flag.StringVar(&c.Msh.Capture.File, "capture", c.Msh.Capture.File, "Specify the file in which connections traffic is recorded.")
+	flag.StringVar(&c.Msh.LogProfile, "logprofile", c.Msh.LogProfile, "Specify the log pattern profile of minecraft server (auto - vanilla - paper - fabric - forge - neoforge - velocity - bungeecord - bds).")
+	// c.Msh.LogProfiles (type []model.LogProfile, not worth to make it a flag)
+	flag.StringVar(&c.Msh.Backend.Type, "backend", c.Msh.Backend.Type, "Specify how msh manages minecraft server (terminal - external - docker - http - agent).")
+	flag.BoolVar(&c.Msh.WakeOnLan.Enabled, "wol", c.Msh.WakeOnLan.Enabled, "Enables wake-on-lan of the machine hosting minecraft server.")
+	flag.StringVar(&c.Msh.WakeOnLan.MAC, "wolmac", c.Msh.WakeOnLan.MAC, "Specify the mac address of the machine hosting minecraft server.")
+	flag.BoolVar(&c.Msh.Agent.Enabled, "agent", c.Msh.Agent.Enabled, "Runs msh as agent (controls minecraft server on behalf of a remote msh).")
+	flag.IntVar(&c.Msh.Agent.Port, "agentport", c.Msh.Agent.Port, "Specify msh agent port.")
+	flag.StringVar(&c.Msh.Backend.AgentAddress, "agentaddr", c.Msh.Backend.AgentAddress, "Specify the address of msh agent (agent backend).")
+	flag.BoolVar(&c.Msh.RconEndpoint.Enabled, "rcon", c.Msh.RconEndpoint.Enabled, "Enables msh rcon endpoint.")
+	flag.IntVar(&c.Msh.RconEndpoint.Port, "rconport", c.Msh.RconEndpoint.Port, "Specify msh rcon endpoint port.")
 
 	// backward compatibility
 	flag.IntVar(&c.Commands.StopServerAllowKill, "allowKill", c.Commands.StopServerAllowKill, "Specify after how many seconds the server should be killed (if stop command fails).") // msh pterodactyl egg
@@ -229,6 +270,11 @@ func (c *Configuration) loadRuntime(confdef *Configuration) *errco.MshLog {
 	if err != nil {
 		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_PARSE, err.Error())
 	}
+	// "msh agent" runs msh as agent
+	if len(args) > 0 && args[0] == "agent" {
+		c.Msh.Agent.Enabled = true
+		args = args[1:]
+	}
 	flag.CommandLine.Parse(args)
 
 	// after config variables are set, set debug level
@@ -237,9 +283,115 @@ func (c *Configuration) loadRuntime(confdef *Configuration) *errco.MshLog {
 
 	// ---------------- setup check ---------------- //
 
+	// check backend
+	switch c.Msh.Backend.Type {
+	case "":
+		c.Msh.Backend.Type = BACKEND_TERMINAL
+	case BACKEND_TERMINAL:
+	case BACKEND_EXTERNAL:
+		if c.Msh.Backend.StartCommand == "" {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "external backend: start command not set")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+		if c.Msh.Backend.StatusCommand == "" && !c.Msh.Backend.PollStatusPort && c.Msh.Backend.LogFile == "" {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "external backend: set at least one of status command, status port polling or log file")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+		if c.Msh.SuspendAllow {
+			// msh is not the parent process of ms: ms process is not known
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "external backend: ms process suspension is not supported (disabling SuspendAllow)")
+			c.Msh.SuspendAllow = false
+		}
+	case BACKEND_DOCKER:
+		if c.Msh.Backend.DockerContainer == "" {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "docker backend: container not set")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+		if c.Msh.Backend.DockerSocket == "" {
+			c.Msh.Backend.DockerSocket = "/var/run/docker.sock"
+		}
+	case BACKEND_HTTP:
+		if c.Msh.Backend.Http.Start.URL == "" {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "http backend: start call url not set")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+		if c.Msh.Backend.Http.Host == "" {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "http backend: remote minecraft server host not set")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+		if c.Msh.Backend.Http.Timeout <= 0 {
+			c.Msh.Backend.Http.Timeout = 10
+		}
+		if c.Msh.Backend.Http.ReadyTimeout <= 0 {
+			c.Msh.Backend.Http.ReadyTimeout = 600
+		}
+		if c.Msh.SuspendAllow {
+			// ms runs on a remote machine: ms process is not known
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "http backend: ms process suspension is not supported (disabling SuspendAllow)")
+			c.Msh.SuspendAllow = false
+		}
+	case BACKEND_AGENT:
+		if c.Msh.Backend.AgentAddress == "" {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "agent backend: agent address not set")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+		if c.Msh.Agent.Enabled {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "agent backend can't be used in agent mode")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+	default:
+		logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "unknown backend type: %s", c.Msh.Backend.Type)
+		servstats.Stats.SetMajorError(logMsh)
+	}
+
+	// check agent authentication (agent mode and agent backend)
+	if c.Msh.Agent.Enabled || c.Msh.Backend.Type == BACKEND_AGENT {
+		switch {
+		case c.Msh.Agent.PSK == "" && c.Msh.Agent.CertFile == "":
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "agent: set a pre-shared key or tls certificates")
+			servstats.Stats.SetMajorError(logMsh)
+		case c.Msh.Agent.CertFile != "" && (c.Msh.Agent.KeyFile == "" || c.Msh.Agent.CAFile == ""):
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "agent: mutual tls requires certificate, key and ca files")
+			servstats.Stats.SetMajorError(logMsh)
+		}
+	}
+
+	// check watchdog
+	if c.Msh.Watchdog.Enabled {
+		if c.Msh.Watchdog.PingInterval <= 0 {
+			c.Msh.Watchdog.PingInterval = 30
+		}
+		if c.Msh.Watchdog.FailThreshold <= 0 {
+			c.Msh.Watchdog.FailThreshold = 3
+		}
+		if c.Msh.Watchdog.KillAfter <= 0 {
+			c.Msh.Watchdog.KillAfter = 30
+		}
+	}
+
+	// check wake-on-lan
+	if c.Msh.WakeOnLan.Enabled {
+		if _, err := net.ParseMAC(c.Msh.WakeOnLan.MAC); err != nil {
+			logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "wake-on-lan: invalid mac address: %s", c.Msh.WakeOnLan.MAC)
+			servstats.Stats.SetMajorError(logMsh)
+		}
+		if c.Msh.WakeOnLan.Broadcast == "" {
+			c.Msh.WakeOnLan.Broadcast = "255.255.255.255"
+		}
+		if c.Msh.WakeOnLan.Port == 0 {
+			c.Msh.WakeOnLan.Port = 9
+		}
+		if c.Msh.WakeOnLan.Timeout <= 0 {
+			c.Msh.WakeOnLan.Timeout = 180
+		}
+	}
+
 	// check if server folder/executeble exist
 	serverFileFolderPath := filepath.Join(c.Server.Folder, c.Server.FileName)
-	if _, err := os.Stat(serverFileFolderPath); os.IsNotExist(err) {
+	if c.Msh.Backend.Type != BACKEND_TERMINAL {
+		// ms is not started by msh: server file, eula and java are not managed by msh
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "%s backend: skipping server file and eula checks", c.Msh.Backend.Type)
+	} else if _, err := os.Stat(serverFileFolderPath); os.IsNotExist(err) {
 		// server folder/executeble does not exist
 
 		logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_MINECRAFT_SERVER, "specified minecraft server folder/file does not exist: %s", serverFileFolderPath)
@@ -290,7 +442,10 @@ func (c *Configuration) loadRuntime(confdef *Configuration) *errco.MshLog {
 
 	// check if java is installed and get java version
 	_, err = exec.LookPath("java")
-	if err != nil {
+	if c.Msh.Backend.Type != BACKEND_TERMINAL {
+		// java might be installed in a different environment (container, panel)
+		JavaV = "unknown"
+	} else if err != nil {
 		logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_MINECRAFT_SERVER, "java not installed")
 		servstats.Stats.SetMajorError(logMsh)
 	} else if out, err := exec.Command("java", "--version").Output(); err != nil {
@@ -310,10 +465,28 @@ func (c *Configuration) loadRuntime(confdef *Configuration) *errco.MshLog {
 	MshPortQuery = c.Msh.MshPortQuery
 
 	// ServHost	defined in global definition
+	if c.Msh.Backend.Type == BACKEND_HTTP && !flagSet("servhost") {
+		// msh proxies clients to the remote ms
+		ServHost = c.Msh.Backend.Http.Host
+	}
+	if c.Msh.Backend.Type == BACKEND_AGENT && !flagSet("servhost") {
+		// msh proxies clients to the ms controlled by msh agent
+		if host, _, err := net.SplitHostPort(c.Msh.Backend.AgentAddress); err == nil {
+			ServHost = host
+		}
+	}
 	if ServPort != 0 {
 		// ServPort defined in msh start arguments
+	} else if c.Msh.Backend.Type == BACKEND_HTTP {
+		// remote ms server.properties is not available
+		ServPort = c.Msh.Backend.Http.Port
 	} else if ServPort, logMsh = c.ParsePropertiesInt("server-port"); logMsh != nil {
 		logMsh.Log(true)
+		if c.Msh.Backend.Type == BACKEND_AGENT {
+			// server.properties is on msh agent machine
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CONFIG_LOAD, "agent backend: using default minecraft server port 25565 (use -servport to change it)")
+			ServPort = 25565
+		}
 	} else if ServPort == c.Msh.MshPort {
 		logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_LOAD, "ServPort and MshPort appear to be the same, please change one of them")
 		servstats.Stats.SetMajorError(logMsh)
@@ -369,3 +542,15 @@ func (c *Configuration) loadRuntime(confdef *Configuration) *errco.MshLog {
 
 	return nil
 }
+
+// flagSet returns true if the flag with the specified name was set by msh start arguments
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
@@ -0,0 +1,169 @@
+package conn
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/servctrl"
+)
+
+// afkSampleTime is the time interval in which client -> server traffic rate is calculated
+const afkSampleTime time.Duration = 10 * time.Second
+
+// playerNameRegexp matches valid minecraft player names
+// (player names are used in ms commands: they must not contain spaces or special characters)
+var playerNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]{1,16}$`)
+
+// afkTracker represents the client -> server traffic of a player connection.
+//
+// An idle client only answers keep-alives and sends few position packets:
+// its traffic rate is distinctly lower than the one of an active player.
+type afkTracker struct {
+	player string       // name of the player
+	bytes  atomic.Int64 // client -> server bytes in current sample time
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newAfkTracker starts tracking the traffic of a player connection.
+//
+// Returns nil if AfkKick is disabled or the player name is not valid.
+// (afkTracker methods can be called on nil)
+func newAfkTracker(player string) *afkTracker {
+	if !config.ConfigRuntime.Msh.AfkKick.Enabled {
+		return nil
+	}
+
+	if !playerNameRegexp.MatchString(player) {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_AFK_KICK, "can't track idle status of player with invalid name (%q)", player)
+		return nil
+	}
+
+	a := &afkTracker{
+		player: player,
+		done:   make(chan struct{}),
+	}
+
+	go a.monitor()
+
+	return a
+}
+
+// add adds bytes to the client -> server traffic of the player
+func (a *afkTracker) add(n int) {
+	if a == nil {
+		return
+	}
+
+	a.bytes.Add(int64(n))
+}
+
+// stop stops tracking the player connection (can be called multiple times)
+func (a *afkTracker) stop() {
+	if a == nil {
+		return
+	}
+
+	a.once.Do(func() { close(a.done) })
+}
+
+// monitor checks every afkSampleTime the client -> server traffic rate of the player.
+// If the player is idle for longer than AfkKick.IdleTime, the player is warned and then kicked.
+// If the kick fails, it's retried at the next sample.
+// [goroutine]
+func (a *afkTracker) monitor() {
+	ticker := time.NewTicker(afkSampleTime)
+	defer ticker.Stop()
+
+	var s afkState
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		rate := float64(a.bytes.Swap(0)) / afkSampleTime.Seconds()
+		idleTime := time.Duration(config.ConfigRuntime.Msh.AfkKick.IdleTime) * time.Second
+		warnTime := time.Duration(config.ConfigRuntime.Msh.AfkKick.WarnTime) * time.Second
+
+		switch s.step(rate, float64(config.ConfigRuntime.Msh.AfkKick.ByteRate), idleTime, warnTime) {
+		case AFK_BACK:
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_2, errco.ERROR_NIL, "player %s is no longer idle", a.player)
+
+		case AFK_IDLE:
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "player %s is idle since %s (%.1f B/s)", a.player, s.idle, rate)
+
+		case AFK_WARN:
+			logMsh := servctrl.TellRawPlayer(a.player, "AFK", fmt.Sprintf("you will be kicked in %d seconds if you remain idle", int((idleTime-s.idle).Seconds())), "afk")
+			if logMsh != nil {
+				logMsh.Log(true)
+			}
+
+		case AFK_KICK:
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "player %s has been idle for %s: kicking player...", a.player, s.idle)
+
+			_, logMsh := servctrl.Execute(strings.ReplaceAll(config.ConfigRuntime.Msh.AfkKick.Command, "<player>", a.player))
+			if logMsh != nil {
+				// keep tracking the player: the kick is retried at the next sample
+				logMsh.Log(true)
+				continue
+			}
+
+			return
+		}
+	}
+}
+
+// afk actions returned by afkState.step
+const (
+	AFK_ACTIVE string = "active" // player is active
+	AFK_BACK   string = "back"   // player is active again after being warned
+	AFK_IDLE   string = "idle"   // player is idle
+	AFK_WARN   string = "warn"   // player should be warned of the kick
+	AFK_KICK   string = "kick"   // player should be kicked
+)
+
+// afkState represents the idle status of a player
+type afkState struct {
+	idle   time.Duration // time since which the player is idle
+	warned bool          // the player was warned of the kick
+}
+
+// step updates the idle status of the player with the traffic rate of the last sample
+// and returns the action to take.
+//
+// minRate is the traffic rate (bytes/s) under which the player is idle,
+// idleTime is the idle time after which the player is kicked,
+// warnTime is the time before the kick at which the player is warned.
+func (s *afkState) step(rate, minRate float64, idleTime, warnTime time.Duration) string {
+	if rate >= minRate {
+		warned := s.warned
+		s.idle, s.warned = 0, false
+		if warned {
+			return AFK_BACK
+		}
+		return AFK_ACTIVE
+	}
+
+	s.idle += afkSampleTime
+
+	switch {
+	case s.idle >= idleTime:
+		return AFK_KICK
+
+	case !s.warned && s.idle >= idleTime-warnTime:
+		s.warned = true
+		return AFK_WARN
+
+	default:
+		return AFK_IDLE
+	}
+}
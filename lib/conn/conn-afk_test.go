@@ -0,0 +1,83 @@
+package conn
+
+import (
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+func Test_newAfkTracker(t *testing.T) {
+	// AfkKick disabled: player is not tracked
+	config.ConfigRuntime.Msh.AfkKick.Enabled = false
+	if a := newAfkTracker("gekigek99"); a != nil {
+		t.Errorf("AfkKick disabled: tracker should be nil")
+	}
+
+	// AfkKick enabled: only valid player names are tracked
+	config.ConfigRuntime.Msh.AfkKick.Enabled = true
+	defer func() { config.ConfigRuntime.Msh.AfkKick.Enabled = false }()
+
+	tests := []struct {
+		player  string
+		tracked bool
+	}{
+		{"gekigek99", true},
+		{"Player_1", true},
+		{"", false},
+		{"a_very_long_player_name", false},
+		{"p @a; stop", false},
+	}
+
+	for _, test := range tests {
+		a := newAfkTracker(test.player)
+		if (a != nil) != test.tracked {
+			t.Errorf("player %q: tracked %t, expected %t", test.player, a != nil, test.tracked)
+		}
+
+		// methods must be safe on nil tracker and stop must be callable multiple times
+		a.add(10)
+		a.stop()
+		a.stop()
+	}
+}
+
+func Test_afkStateStep(t *testing.T) {
+	// kicked after 60s of idle traffic, warned 20s before the kick
+	idleTime, warnTime := 60*time.Second, 20*time.Second
+
+	var s afkState
+	for i, test := range []struct {
+		rate   float64
+		action string
+		idle   time.Duration
+	}{
+		{500, AFK_ACTIVE, 0},
+		{10, AFK_IDLE, 10 * time.Second},
+		{10, AFK_IDLE, 20 * time.Second},
+		{10, AFK_IDLE, 30 * time.Second},
+		{10, AFK_WARN, 40 * time.Second},
+		{10, AFK_IDLE, 50 * time.Second}, // warned only once
+		{10, AFK_KICK, 60 * time.Second},
+		{10, AFK_KICK, 70 * time.Second}, // kick failed: retried
+		{100, AFK_BACK, 0},               // rate threshold is inclusive
+		{500, AFK_ACTIVE, 0},
+		{10, AFK_IDLE, 10 * time.Second},
+		{500, AFK_ACTIVE, 0}, // not warned: no longer idle is not reported
+		{0, AFK_IDLE, 10 * time.Second},
+		{0, AFK_IDLE, 20 * time.Second},
+		{0, AFK_IDLE, 30 * time.Second},
+		{0, AFK_WARN, 40 * time.Second}, // warned again after being active
+	} {
+		action := s.step(test.rate, 100, idleTime, warnTime)
+		if action != test.action || s.idle != test.idle {
+			t.Errorf("sample %d (%.0f B/s): received (%s, %s), expected (%s, %s)", i, test.rate, action, s.idle, test.action, test.idle)
+		}
+	}
+
+	// warn time longer than idle time: player is warned at the first idle sample
+	s = afkState{}
+	if action := s.step(0, 100, 30*time.Second, 60*time.Second); action != AFK_WARN {
+		t.Errorf("long warn time: received %s, expected %s", action, AFK_WARN)
+	}
+}
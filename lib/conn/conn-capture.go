@@ -0,0 +1,368 @@
+package conn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+)
+
+// capture file format (all integers are big endian):
+//
+//	header: [ magic "MSHCAP01" (8 bytes) ]
+//	record: [ conn id (uint32) | direction (1 byte) | timestamp (int64, unix nanoseconds) | data length (uint32) | data ]
+//
+// direction: 0 = client --> msh, 1 = msh --> client
+const (
+	captureMagic    string = "MSHCAP01"
+	captureToMsh    byte   = 0 // data sent by client to msh
+	captureToClient byte   = 1 // data sent by msh to client
+)
+
+// capture is the capture file in which the traffic of accepted connections is recorded
+var capture *captureFile = &captureFile{m: &sync.Mutex{}}
+
+// captureFile represents the capture file
+type captureFile struct {
+	m      *sync.Mutex
+	w      io.Writer // capture file writer (nil if not open)
+	f      *os.File
+	size   int64  // bytes written to capture file
+	conns  uint32 // connections captured (also used as connection id)
+	open   int    // captured connections not yet closed
+	full   bool   // connections limit reached (new connections are not captured)
+	closed bool   // capture stopped (error, size limit reached or last captured connection closed)
+}
+
+// captureRecord represents a record of the capture file
+type captureRecord struct {
+	connID    uint32
+	direction byte
+	t         time.Time
+	data      []byte
+}
+
+// captureConn is a net.Conn that records the data read and written in the capture file
+type captureConn struct {
+	net.Conn
+	id   uint32
+	once *sync.Once
+}
+
+// newCaptureConn returns a net.Conn that records its traffic in the capture file.
+// If capture is disabled or capture limits are reached, the connection is returned unchanged.
+func newCaptureConn(c net.Conn) net.Conn {
+	if config.ConfigRuntime.Msh.Capture.File == "" || isReplay(c) {
+		return c
+	}
+
+	capture.m.Lock()
+	defer capture.m.Unlock()
+
+	if capture.closed || capture.full {
+		return c
+	}
+
+	// open capture file (only the first time)
+	if capture.f == nil {
+		f, err := os.Create(config.ConfigRuntime.Msh.Capture.File)
+		if err != nil {
+			errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CAPTURE, "can't create capture file: %s", err.Error())
+			capture.closed = true
+			return c
+		}
+		capture.f, capture.w = f, f
+
+		n, _ := capture.w.Write([]byte(captureMagic))
+		capture.size += int64(n)
+
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "recording connections traffic to capture file %s", config.ConfigRuntime.Msh.Capture.File)
+	}
+
+	capture.conns++
+	capture.open++
+
+	// connections limit reached: the capture file is closed when the last captured connection is closed
+	if config.ConfigRuntime.Msh.Capture.MaxConns > 0 && int(capture.conns) >= config.ConfigRuntime.Msh.Capture.MaxConns {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CAPTURE, "capture connections limit reached (%d): new connections are not captured", capture.conns)
+		capture.full = true
+	}
+
+	return &captureConn{Conn: c, id: capture.conns, once: &sync.Once{}}
+}
+
+// Read reads data from the connection and records it
+func (cc *captureConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	if n > 0 {
+		capture.record(cc.id, captureToMsh, b[:n])
+	}
+	return n, err
+}
+
+// Write writes data to the connection and records it
+func (cc *captureConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	if n > 0 {
+		capture.record(cc.id, captureToClient, b[:n])
+	}
+	return n, err
+}
+
+// Close closes the connection.
+// When the connections limit is reached, the capture is stopped after the last captured connection is closed.
+func (cc *captureConn) Close() error {
+	cc.once.Do(func() {
+		capture.m.Lock()
+		defer capture.m.Unlock()
+
+		capture.open--
+		if capture.full && capture.open == 0 && !capture.closed {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "last captured connection closed: stopping capture")
+			capture.stop()
+		}
+	})
+
+	return cc.Conn.Close()
+}
+
+// record writes a record to the capture file.
+// If the capture size limit is reached, capture is stopped.
+func (cf *captureFile) record(connID uint32, direction byte, data []byte) {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+
+	if cf.closed || cf.w == nil {
+		return
+	}
+
+	rec := bytes.NewBuffer(nil)
+	binary.Write(rec, binary.BigEndian, connID)
+	rec.WriteByte(direction)
+	binary.Write(rec, binary.BigEndian, time.Now().UnixNano())
+	binary.Write(rec, binary.BigEndian, uint32(len(data)))
+	rec.Write(data)
+
+	if maxSize := int64(config.ConfigRuntime.Msh.Capture.MaxSize) * 1024 * 1024; maxSize > 0 && cf.size+int64(rec.Len()) > maxSize {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CAPTURE, "capture size limit reached (%d bytes): stopping capture", cf.size)
+		cf.stop()
+		return
+	}
+
+	n, err := cf.w.Write(rec.Bytes())
+	cf.size += int64(n)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CAPTURE, "can't write capture file: %s", err.Error())
+		cf.stop()
+	}
+}
+
+// stop closes the capture file.
+// (captureFile mutex should be locked by caller function)
+func (cf *captureFile) stop() {
+	cf.closed = true
+	if cf.f != nil {
+		cf.f.Close()
+	}
+	cf.w = nil
+}
+
+// readCapture reads the records of a capture file
+func readCapture(r io.Reader) ([]*captureRecord, *errco.MshLog) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CAPTURE, "not a msh capture file")
+	}
+
+	records := []*captureRecord{}
+	for {
+		var head struct {
+			ConnID    uint32
+			Direction byte
+			Time      int64
+			Len       uint32
+		}
+		err := binary.Read(br, binary.BigEndian, &head)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			// truncated capture file (msh was terminated while recording): return records read so far
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CAPTURE, "capture file is truncated: %s", err.Error())
+			return records, nil
+		}
+
+		data := make([]byte, head.Len)
+		if _, err := io.ReadFull(br, data); err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CAPTURE, "capture file is truncated: %s", err.Error())
+			return records, nil
+		}
+
+		records = append(records, &captureRecord{
+			connID:    head.ConnID,
+			direction: head.Direction,
+			t:         time.Unix(0, head.Time),
+			data:      data,
+		})
+	}
+}
+
+// replayConn is a net.Conn that returns recorded client data when read.
+// Data written by msh is collected (to client and to stub server).
+//
+// HandlerClientConn doesn't warm ms for a replayConn and proxies it to a stub server.
+type replayConn struct {
+	id       uint32
+	reads    [][]byte // recorded client data (in order)
+	m        *sync.Mutex
+	toClient int // bytes written by msh to client
+	toServer int // bytes forwarded by msh to stub server
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Read returns the next recorded client data chunk (io.EOF when all chunks were read)
+func (rc *replayConn) Read(b []byte) (int, error) {
+	if len(rc.reads) == 0 {
+		rc.Close()
+		return 0, io.EOF
+	}
+
+	n := copy(b, rc.reads[0])
+	if n < len(rc.reads[0]) {
+		rc.reads[0] = rc.reads[0][n:]
+	} else {
+		rc.reads = rc.reads[1:]
+	}
+
+	return n, nil
+}
+
+// Write collects the data written by msh to client
+func (rc *replayConn) Write(b []byte) (int, error) {
+	rc.m.Lock()
+	rc.toClient += len(b)
+	rc.m.Unlock()
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "replay conn %d: msh --> client %d bytes: %q", rc.id, len(b), b)
+
+	return len(b), nil
+}
+
+// Close marks the replayed connection as closed
+func (rc *replayConn) Close() error {
+	rc.once.Do(func() { close(rc.done) })
+	return nil
+}
+
+// LocalAddr returns the msh address
+func (rc *replayConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: config.MshPort}
+}
+
+// RemoteAddr returns a fake client address (port is the replayed connection id)
+func (rc *replayConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: int(rc.id)}
+}
+
+// deadlines are not needed since recorded data is always available
+func (rc *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (rc *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rc *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dialStub returns a connection to a stub server that collects the data forwarded by msh
+func (rc *replayConn) dialStub() net.Conn {
+	mshSide, stubSide := net.Pipe()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := stubSide.Read(buf)
+			if err != nil {
+				return
+			}
+			rc.m.Lock()
+			rc.toServer += n
+			rc.m.Unlock()
+
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "replay conn %d: msh --> server %d bytes: %q", rc.id, n, buf[:n])
+		}
+	}()
+
+	// close the stub server when the replayed connection is closed
+	go func() {
+		<-rc.done
+		stubSide.Close()
+	}()
+
+	return mshSide
+}
+
+// isReplay returns true if the connection is a replayed connection
+func isReplay(c net.Conn) bool {
+	_, ok := c.(*replayConn)
+	return ok
+}
+
+// Replay feeds the client data recorded in a capture file to HandlerClientConn.
+// Minecraft server is not warmed and proxied connections are forwarded to a stub server.
+func Replay(fileName string) *errco.MshLog {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CAPTURE, err.Error())
+	}
+	defer f.Close()
+
+	records, logMsh := readCapture(f)
+	if logMsh != nil {
+		return logMsh.AddTrace()
+	}
+
+	// group client data by connection
+	conns := map[uint32]*replayConn{}
+	for _, rec := range records {
+		if rec.direction != captureToMsh {
+			continue
+		}
+		if _, ok := conns[rec.connID]; !ok {
+			conns[rec.connID] = &replayConn{id: rec.connID, m: &sync.Mutex{}, done: make(chan struct{})}
+		}
+		conns[rec.connID].reads = append(conns[rec.connID].reads, rec.data)
+	}
+
+	ids := []uint32{}
+	for id := range conns {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "replaying %d connections from %s", len(ids), fileName)
+
+	for _, id := range ids {
+		rc := conns[id]
+
+		HandlerClientConn(rc)
+
+		// wait for proxied connection to end
+		select {
+		case <-rc.done:
+		case <-time.After(5 * time.Second):
+			rc.Close()
+		}
+
+		rc.m.Lock()
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "replay conn %d: %d bytes to client, %d bytes to server", id, rc.toClient, rc.toServer)
+		rc.m.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package conn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"msh/lib/config"
+)
+
+func Test_capture(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "msh-capture.bin")
+
+	config.ConfigRuntime.Msh.Capture.File = fileName
+	config.ConfigRuntime.Msh.Capture.MaxSize = 1
+	config.ConfigRuntime.Msh.Capture.MaxConns = 1
+	defer func() {
+		config.ConfigRuntime.Msh.Capture.File = ""
+		capture = &captureFile{m: &sync.Mutex{}}
+	}()
+
+	client, msh := net.Pipe()
+	mshCap := newCaptureConn(msh)
+	if _, ok := mshCap.(*captureConn); !ok {
+		t.Fatalf("connection is not captured")
+	}
+
+	go func() {
+		client.Write([]byte("hello"))
+		io.ReadFull(client, make([]byte, 5))
+		client.Close()
+	}()
+
+	// connections limit reached: new connection is not captured, open captured connection is still recorded
+	if _, ok := newCaptureConn(msh).(*captureConn); ok {
+		t.Errorf("connection captured after connections limit was reached")
+	}
+
+	io.ReadFull(mshCap, make([]byte, 5))
+	mshCap.Write([]byte("world"))
+
+	if capture.closed {
+		t.Errorf("capture stopped before last captured connection was closed")
+	}
+
+	// last captured connection closed: capture is stopped
+	mshCap.Close()
+	mshCap.Close()
+	if !capture.closed || capture.open != 0 {
+		t.Errorf("capture not stopped after last captured connection was closed (open: %d)", capture.open)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("can't read capture file: %s", err.Error())
+	}
+
+	records, logMsh := readCapture(bytes.NewReader(data))
+	if logMsh != nil {
+		t.Fatalf("readCapture: %s", logMsh.Mex)
+	}
+
+	exp := []struct {
+		direction byte
+		data      string
+	}{
+		{captureToMsh, "hello"},
+		{captureToClient, "world"},
+	}
+	if len(records) != len(exp) {
+		t.Fatalf("received %d records, expected %d", len(records), len(exp))
+	}
+	for i, e := range exp {
+		r := records[i]
+		if r.connID != 1 || r.direction != e.direction || string(r.data) != e.data {
+			t.Errorf("record %d: received (%d, %d, %q), expected (1, %d, %q)", i, r.connID, r.direction, r.data, e.direction, e.data)
+		}
+	}
+
+	// truncated capture file: records read so far are returned
+	records, logMsh = readCapture(bytes.NewReader(data[:len(data)-3]))
+	if logMsh != nil || len(records) != 1 {
+		t.Errorf("truncated capture: received %d records, expected 1", len(records))
+	}
+
+	// not a capture file
+	if _, logMsh = readCapture(bytes.NewReader([]byte("garbage"))); logMsh == nil {
+		t.Errorf("not a capture file: expected error")
+	}
+}
+
+func Test_replayConn(t *testing.T) {
+	rc := &replayConn{id: 1, reads: [][]byte{[]byte("abcdef"), []byte("gh")}, m: &sync.Mutex{}, done: make(chan struct{})}
+
+	// chunks larger than the read buffer are split
+	buf := make([]byte, 4)
+	for _, exp := range []string{"abcd", "ef", "gh"} {
+		n, err := rc.Read(buf)
+		if err != nil || string(buf[:n]) != exp {
+			t.Errorf("received (%q, %v), expected (%q, nil)", buf[:n], err, exp)
+		}
+	}
+
+	// all chunks read: connection is closed
+	if _, err := rc.Read(buf); err != io.EOF {
+		t.Errorf("received %v, expected io.EOF", err)
+	}
+	select {
+	case <-rc.done:
+	default:
+		t.Errorf("replayed connection not closed")
+	}
+}
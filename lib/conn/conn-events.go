@@ -0,0 +1,367 @@
+package conn
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+)
+
+const connLogFileName string = "msh-connections.log" // connLogFileName is the connection log file name
+
+// connection attempt types
+const (
+	EVENT_INFO   string = "info"    // server list ping
+	EVENT_JOIN   string = "join"    // join attempt
+	EVENT_LEGACY string = "legacy"  // legacy server list ping (before 1.7)
+	EVENT_QUERY  string = "query"   // query request
+	EVENT_UNKN   string = "unknown" // request unknown
+)
+
+// decisions taken by msh on a connection attempt
+const (
+	DECISION_PROXIED          string = "proxied"           // connection proxied to ms
+	DECISION_WARMED           string = "warmed"            // ms warmed for the client
+	DECISION_ANSWERED         string = "answered"          // msh answered in place of ms
+	DECISION_REFUSED_WL       string = "refused-whitelist" // client not in whitelist
+	DECISION_REFUSED_KNOCK    string = "refused-knock"     // client did not use a secret hostname
+	DECISION_REFUSED_PROTOCOL string = "refused-protocol"  // client protocol not compatible with ms
+	DECISION_REFUSED_QUERY    string = "refused-challenge" // query with unknown challenge
+	DECISION_QUORUM_WAIT      string = "quorum-wait"       // start quorum not reached
+	DECISION_PREWARMED        string = "prewarmed"         // ms pre-warmed for the client
+	DECISION_MAJOR_ERROR      string = "major-error"       // ms has encountered major problems
+	DECISION_WARM_ERROR       string = "warm-error"        // error while warming ms
+	DECISION_DATA_CAP         string = "refused-datacap"   // data cap reached
+	DECISION_MALFORMED        string = "malformed"         // request could not be understood
+)
+
+const (
+	connLogQueueSize  int           = 1024            // max number of connection log lines waiting to be written
+	connLogFlushEvery time.Duration = 1 * time.Second // time interval between connection log flushes
+)
+
+var (
+	// connLog is the connection log mutex (protects rotation and reading of the connection log files)
+	connLog *sync.Mutex = &sync.Mutex{}
+
+	// connLogQueue is the queue of lines to be written to the connection log file by connLogWriter
+	connLogQueue chan []byte = make(chan []byte, connLogQueueSize)
+	// connLogSync is used to request connLogWriter to flush and close the connection log file
+	// (the channel sent is closed when done)
+	connLogSync chan chan struct{} = make(chan chan struct{})
+	// connLogStart starts connLogWriter when the first connection attempt is recorded
+	connLogStart *sync.Once = &sync.Once{}
+	// connLogDropped is the number of lines dropped because the queue was full
+	connLogDropped int64 = 0
+)
+
+// recordEvent records a connection attempt in the connection log file.
+// hs can be nil if handshake data is not available.
+//
+// The connection attempt is queued and written by connLogWriter:
+// if the queue is full (connection flood) the connection attempt is dropped.
+func recordEvent(evType, clientAddress string, hs *clientHandshake, decision string) {
+	if !config.ConfigRuntime.Msh.ConnectionLog.Enabled {
+		return
+	}
+
+	ev := &model.ConnEvent{
+		Time:     time.Now(),
+		Type:     evType,
+		IP:       clientAddress,
+		Decision: decision,
+	}
+	if hs != nil {
+		ev.Hostname = hs.serverAddr
+		ev.Protocol = hs.protocol
+		ev.Version = protocolVersion(hs.protocol)
+		ev.Player = hs.playerName
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_JSON_MARSHAL, err.Error())
+		return
+	}
+
+	connLogStart.Do(func() { go connLogWriter() })
+
+	select {
+	case connLogQueue <- append(data, '\n'):
+	default:
+		atomic.AddInt64(&connLogDropped, 1)
+	}
+}
+
+// flushConnLog waits for the queued connection attempts to be written to the connection log file
+func flushConnLog() {
+	if !config.ConfigRuntime.Msh.ConnectionLog.Enabled {
+		return
+	}
+
+	connLogStart.Do(func() { go connLogWriter() })
+
+	done := make(chan struct{})
+	connLogSync <- done
+	<-done
+}
+
+// Flush writes to disk the connection data kept in memory by msh.
+// Should be called before msh exits.
+func Flush() {
+	flushConnLog()
+	saveTraffic()
+}
+
+// connLogWriter writes the queued connection attempts to the connection log file.
+// The file is kept open and written through a buffer that is flushed every connLogFlushEvery.
+// [goroutine]
+func connLogWriter() {
+	var f *os.File
+	var w *bufio.Writer
+	var size int64
+
+	// closeFile flushes and closes the connection log file (if open)
+	closeFile := func() {
+		if f == nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONNLOG_WRITE, err.Error())
+		}
+		f.Close()
+		f, w = nil, nil
+	}
+
+	// openFile opens the connection log file (if not open)
+	openFile := func() bool {
+		if f != nil {
+			return true
+		}
+
+		var err error
+		f, err = os.OpenFile(connLogFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONNLOG_WRITE, err.Error())
+			f = nil
+			return false
+		}
+		w = bufio.NewWriter(f)
+
+		size = 0
+		if info, err := f.Stat(); err == nil {
+			size = info.Size()
+		}
+
+		return true
+	}
+
+	// write writes a line to the connection log file
+	// (the file is rotated before writing if it would exceed MaxSize, MaxSize 0 disables rotation)
+	write := func(line []byte) {
+		if !openFile() {
+			return
+		}
+
+		maxSize := int64(config.ConfigRuntime.Msh.ConnectionLog.MaxSize) * 1024 * 1024
+		if maxSize > 0 && size > 0 && size+int64(len(line)) > maxSize {
+			closeFile()
+			rotateConnLog(size)
+			if !openFile() {
+				return
+			}
+		}
+
+		n, err := w.Write(line)
+		if err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONNLOG_WRITE, err.Error())
+		}
+		size += int64(n)
+	}
+
+	ticker := time.NewTicker(connLogFlushEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line := <-connLogQueue:
+			write(line)
+
+		case <-ticker.C:
+			if dropped := atomic.SwapInt64(&connLogDropped, 0); dropped > 0 {
+				errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONNLOG_WRITE, "connection log queue full: %d connection attempts not recorded", dropped)
+			}
+			if f != nil {
+				if err := w.Flush(); err != nil {
+					errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONNLOG_WRITE, err.Error())
+				}
+			}
+
+		case done := <-connLogSync:
+			// write the lines already queued before closing the file
+		drain:
+			for {
+				select {
+				case line := <-connLogQueue:
+					write(line)
+				default:
+					break drain
+				}
+			}
+			closeFile()
+			close(done)
+		}
+	}
+}
+
+// rotateConnLog rotates the connection log file of the specified size
+// (msh-connections.log -> msh-connections.log.1 -> msh-connections.log.2 ...).
+// The connection log file should be closed by caller function.
+func rotateConnLog(size int64) {
+	connLog.Lock()
+	defer connLog.Unlock()
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "rotating connection log file (%d bytes)", size)
+
+	maxFiles := config.ConfigRuntime.Msh.ConnectionLog.MaxFiles
+	if maxFiles < 1 {
+		os.Remove(connLogFileName)
+		return
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", connLogFileName, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", connLogFileName, i), fmt.Sprintf("%s.%d", connLogFileName, i+1))
+	}
+	err := os.Rename(connLogFileName, connLogFileName+".1")
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONNLOG_WRITE, err.Error())
+	}
+}
+
+// eventType returns the connection attempt type corresponding to the client request type
+func eventType(reqType int) string {
+	switch reqType {
+	case errco.CLIENT_REQ_INFO:
+		return EVENT_INFO
+	case errco.CLIENT_REQ_JOIN:
+		return EVENT_JOIN
+	case errco.CLIENT_REQ_LEGACY:
+		return EVENT_LEGACY
+	default:
+		return EVENT_UNKN
+	}
+}
+
+// readEvents returns the connection attempts recorded after the specified time
+// (rotated connection log files are read too).
+func readEvents(since time.Time) ([]*model.ConnEvent, *errco.MshLog) {
+	flushConnLog()
+
+	connLog.Lock()
+	defer connLog.Unlock()
+
+	files := []string{connLogFileName}
+	for i := 1; i <= config.ConfigRuntime.Msh.ConnectionLog.MaxFiles; i++ {
+		files = append(files, fmt.Sprintf("%s.%d", connLogFileName, i))
+	}
+
+	events := []*model.ConnEvent{}
+	for _, fileName := range files {
+		f, err := os.Open(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_CONNLOG_READ, err.Error())
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			ev := &model.ConnEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), ev); err != nil {
+				// skip corrupted lines
+				continue
+			}
+			if ev.Time.After(since) {
+				events = append(events, ev)
+			}
+		}
+		f.Close()
+	}
+
+	return events, nil
+}
+
+// ConnStats returns a summary of the connection attempts recorded in the specified period
+// (top client addresses, hostnames, client versions and decisions).
+func ConnStats(period time.Duration) (string, *errco.MshLog) {
+	events, logMsh := readEvents(time.Now().Add(-period))
+	if logMsh != nil {
+		return "", logMsh.AddTrace()
+	}
+
+	if len(events) == 0 {
+		return fmt.Sprintf("no connection attempts recorded in the last %s", period), nil
+	}
+
+	ips, hostnames, versions, decisions := map[string]int{}, map[string]int{}, map[string]int{}, map[string]int{}
+	for _, ev := range events {
+		ips[ev.IP]++
+		decisions[ev.Decision]++
+		if ev.Hostname != "" {
+			hostnames[ev.Hostname]++
+		}
+		if ev.Protocol > 0 {
+			versions[fmt.Sprintf("%s (%d)", ev.Version, ev.Protocol)]++
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("connection attempts in the last %s: %d\n", period, len(events)))
+	sb.WriteString("top addresses:  " + topCounts(ips, 5) + "\n")
+	sb.WriteString("top hostnames:  " + topCounts(hostnames, 5) + "\n")
+	sb.WriteString("top versions:   " + topCounts(versions, 5) + "\n")
+	sb.WriteString("decisions:      " + topCounts(decisions, -1))
+
+	return sb.String(), nil
+}
+
+// topCounts returns the n keys with highest count, formatted as "key: count".
+// If n < 0 all keys are returned.
+func topCounts(counts map[string]int, n int) string {
+	keys := []string{}
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] == counts[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return counts[keys[i]] > counts[keys[j]]
+	})
+
+	if n >= 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+
+	top := []string{}
+	for _, k := range keys {
+		top = append(top, fmt.Sprintf("%s: %d", k, counts[k]))
+	}
+
+	if len(top) == 0 {
+		return "-"
+	}
+
+	return strings.Join(top, ", ")
+}
@@ -0,0 +1,82 @@
+package conn
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+func Test_recordEvent(t *testing.T) {
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	config.ConfigRuntime.Msh.ConnectionLog.Enabled = true
+	config.ConfigRuntime.Msh.ConnectionLog.MaxFiles = 2
+	defer func() {
+		flushConnLog()
+		config.ConfigRuntime.Msh.ConnectionLog.Enabled = false
+		config.ConfigRuntime.Msh.ConnectionLog.MaxSize = 0
+		config.ConfigRuntime.Msh.ConnectionLog.MaxFiles = 0
+		os.Chdir(wd)
+	}()
+
+	// MaxSize 0: connection log is not rotated
+	config.ConfigRuntime.Msh.ConnectionLog.MaxSize = 0
+	for i := 0; i < 3; i++ {
+		recordEvent(EVENT_QUERY, fmt.Sprintf("10.0.0.%d", i), nil, DECISION_ANSWERED)
+	}
+
+	events, logMsh := readEvents(time.Time{})
+	if logMsh != nil {
+		t.Fatalf("unexpected error %q", logMsh.Mex)
+	}
+	if len(events) != 3 || events[2].IP != "10.0.0.2" {
+		t.Errorf("unexpected events %+v", events)
+	}
+	if _, err := os.Stat(connLogFileName + ".1"); err == nil {
+		t.Errorf("connection log rotated with MaxSize 0")
+	}
+
+	// connection log bigger than MaxSize: connection log is rotated before writing
+	config.ConfigRuntime.Msh.ConnectionLog.MaxSize = 1
+	os.WriteFile(connLogFileName, make([]byte, 1024*1024), 0644)
+	recordEvent(EVENT_QUERY, "10.0.0.9", nil, DECISION_ANSWERED)
+	flushConnLog()
+
+	if info, err := os.Stat(connLogFileName + ".1"); err != nil || info.Size() != 1024*1024 {
+		t.Errorf("connection log not rotated")
+	}
+	if data, _ := os.ReadFile(connLogFileName); len(data) == 0 || len(data) > 200 {
+		t.Errorf("unexpected connection log %q", data)
+	}
+}
+
+func Test_topCounts(t *testing.T) {
+	counts := map[string]int{
+		"10.0.0.1":  3,
+		"10.0.0.2":  7,
+		"10.0.0.3":  3,
+		"127.0.0.1": 1,
+	}
+
+	tests := []struct {
+		n   int
+		exp string
+	}{
+		{2, "10.0.0.2: 7, 10.0.0.1: 3"},
+		{-1, "10.0.0.2: 7, 10.0.0.1: 3, 10.0.0.3: 3, 127.0.0.1: 1"},
+		{0, "-"},
+	}
+
+	for _, test := range tests {
+		if top := topCounts(counts, test.n); top != test.exp {
+			t.Errorf("n %d: received %q, expected %q", test.n, top, test.exp)
+		}
+	}
+
+	if top := topCounts(map[string]int{}, 5); top != "-" {
+		t.Errorf("empty counts: received %q, expected %q", top, "-")
+	}
+}
@@ -0,0 +1,105 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+)
+
+const (
+	lanGroup    string        = "224.0.2.60:4445"       // multicast address on which minecraft clients listen for lan servers
+	lanInterval time.Duration = 1500 * time.Millisecond // time interval between lan announcements
+)
+
+// LanAnnouncer announces msh on the lan (minecraft clients show it in the multiplayer screen).
+//
+// The announcement contains the ms motd followed by the ms status (hibernating, starting, online, ...).
+//
+// If LanAnnounce.Interface is set, announcements are sent from the specified network interface.
+//
+// [goroutine]
+func LanAnnouncer() {
+	laddr, logMsh := lanLocalAddr(config.ConfigRuntime.Msh.LanAnnounce.Interface)
+	if logMsh != nil {
+		logMsh.Log(true)
+		return
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp4", lanGroup)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_LAN_ANNOUNCE, err.Error())
+		return
+	}
+
+	// binding the local address to the interface ip makes multicast packets go out through that interface
+	conn, err := net.DialUDP("udp4", laddr, raddr)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_LAN_ANNOUNCE, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "%-40s %10s:%5d ...", "announcing msh on lan to", raddr.IP, raddr.Port)
+
+	ticker := time.NewTicker(lanInterval)
+	defer ticker.Stop()
+
+	for {
+		motd, logMsh := config.ConfigRuntime.ParsePropertiesString("motd")
+		if logMsh != nil || motd == "" {
+			motd = "A Minecraft Server"
+		}
+		status, _ := mshStatus()
+
+		mes := lanMessage(motd, status, config.MshPort)
+
+		_, err = conn.Write([]byte(mes))
+		if err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_LAN_ANNOUNCE, err.Error())
+		} else {
+			errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> lan%s: %s", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
+		}
+
+		<-ticker.C
+	}
+}
+
+// lanMessage returns the lan announcement for the specified motd, ms status and port.
+// (example: "[MOTD]A Minecraft Server - hibernating[/MOTD][AD]25555[/AD]")
+func lanMessage(motd, status string, port int) string {
+	// motd is shown on a single line: remove new lines and reserved tags
+	motd = strings.Join(strings.Fields(strings.ReplaceAll(motd, "\\n", " ")), " ")
+	motd = strings.NewReplacer("[MOTD]", "", "[/MOTD]", "", "[AD]", "", "[/AD]", "").Replace(motd)
+
+	return fmt.Sprintf("[MOTD]%s - %s[/MOTD][AD]%d[/AD]", motd, status, port)
+}
+
+// lanLocalAddr returns the local address from which lan announcements should be sent.
+// If iface is "", nil is returned (the system chooses the interface).
+func lanLocalAddr(iface string) (*net.UDPAddr, *errco.MshLog) {
+	if iface == "" {
+		return nil, nil
+	}
+
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_LAN_ANNOUNCE, "lan announce interface %s: %s", iface, err.Error())
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_LAN_ANNOUNCE, "lan announce interface %s: %s", iface, err.Error())
+	}
+
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipNet.IP.To4()}, nil
+		}
+	}
+
+	return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_LAN_ANNOUNCE, "lan announce interface %s has no ipv4 address", iface)
+}
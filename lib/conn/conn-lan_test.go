@@ -0,0 +1,24 @@
+package conn
+
+import (
+	"testing"
+)
+
+func Test_lanMessage(t *testing.T) {
+	tests := []struct {
+		motd   string
+		status string
+		port   int
+		exp    string
+	}{
+		{"A Minecraft Server", "hibernating", 25555, "[MOTD]A Minecraft Server - hibernating[/MOTD][AD]25555[/AD]"},
+		{"line 1\\nline 2", "online", 25565, "[MOTD]line 1 line 2 - online[/MOTD][AD]25565[/AD]"},
+		{"fake [/MOTD][AD]1234[/AD]", "starting", 25555, "[MOTD]fake 1234 - starting[/MOTD][AD]25555[/AD]"},
+	}
+
+	for _, test := range tests {
+		if mes := lanMessage(test.motd, test.status, test.port); mes != test.exp {
+			t.Errorf("received %q, expected %q", mes, test.exp)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package conn
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+	"msh/lib/servctrl"
+	"msh/lib/servstats"
+)
+
+const (
+	historyFileName    string        = "msh-history.json"  // historyFileName is the join history file name
+	historyExpiry      time.Duration = 90 * 24 * time.Hour // clients that did not join for longer are removed from join history
+	preWarmJoinTimeout time.Duration = 5 * time.Minute     // time in which a pre-warm must be followed by a join to be considered a hit
+	preWarmMaxMisses   int           = 10                  // max pre-warm misses recorded for a client (limits the threshold increase)
+)
+
+// prewarm handles the pre-warm of minecraft server based on status pings of known clients
+var prewarm *preWarmer = &preWarmer{
+	m:       &sync.Mutex{},
+	pings:   map[string][]time.Time{},
+	pending: map[string]*time.Timer{},
+	warm:    servctrl.WarmMS,
+}
+
+// preWarmer represents the status pings of clients and the join history
+type preWarmer struct {
+	m       *sync.Mutex
+	loaded  bool                          // join history has been loaded from file
+	history map[string]*model.JoinHistory // client address -> join history
+	pings   map[string][]time.Time        // client address -> time of recent status pings
+	pending map[string]*time.Timer        // client address -> timer to record a pre-warm miss
+	warm    func() *errco.MshLog          // warms minecraft server
+}
+
+// JoinConfirmed registers in the join history the join of a client accepted by minecraft server.
+// Should be set as servstats.OnPlayerConfirmed.
+func JoinConfirmed(clientAddress string) {
+	prewarm.join(clientAddress)
+}
+
+// ping registers a status ping of a client while minecraft server is hibernating
+// and pre-warms minecraft server if the client is known and has pinged enough times.
+//
+// Returns true if minecraft server was pre-warmed.
+func (p *preWarmer) ping(clientAddress string, hs *clientHandshake) bool {
+	if !config.ConfigRuntime.Msh.PreWarm.Enabled {
+		return false
+	}
+
+	// pre-warm would bypass the start quorum
+	if config.ConfigRuntime.Msh.StartQuorum.Players > 1 {
+		return false
+	}
+
+	// ms is not hibernating
+	if servstats.Stats.Status != errco.SERVER_STATUS_OFFLINE && !servstats.Stats.Suspended {
+		return false
+	}
+
+	// ms can't be warmed
+	if traffic.capped() {
+		return false
+	}
+
+	if !p.ready(clientAddress, hs) {
+		return false
+	}
+
+	// preWarmer mutex is not held while warming: the pre-start hook can take a while
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "known client %s is refreshing the server list: pre-warming minecraft server...", clientAddress)
+	logMsh := p.warm()
+	if logMsh != nil {
+		logMsh.Log(true)
+		return false
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	// if the client does not join in time, record a pre-warm miss
+	if t, ok := p.pending[clientAddress]; ok {
+		t.Stop()
+	}
+	p.pending[clientAddress] = time.AfterFunc(preWarmJoinTimeout, func() { p.miss(clientAddress) })
+
+	return true
+}
+
+// ready registers a status ping of a client and returns true if the client
+// is known, has pinged enough times in the time window and used a secret hostname.
+func (p *preWarmer) ready(clientAddress string, hs *clientHandshake) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.load()
+
+	// only clients that joined in the past can pre-warm ms
+	h, ok := p.history[clientAddress]
+	if !ok {
+		return false
+	}
+
+	// register status ping and remove the ones outside of time window
+	window := time.Duration(config.ConfigRuntime.Msh.PreWarm.Window) * time.Second
+	recent := []time.Time{}
+	for _, t := range append(p.pings[clientAddress], time.Now()) {
+		if time.Since(t) <= window {
+			recent = append(recent, t)
+		}
+	}
+	p.pings[clientAddress] = recent
+
+	// threshold increases with each pre-warm that was not followed by a join
+	threshold := config.ConfigRuntime.Msh.PreWarm.Pings + h.Misses
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "pre-warm: %d/%d status pings from known client %s", len(recent), threshold, clientAddress)
+	if len(recent) < threshold {
+		return false
+	}
+
+	// the client must use a secret hostname to warm ms
+	if logMsh := config.ConfigRuntime.IsKnock(hs.serverAddr); logMsh != nil {
+		logMsh.Log(true)
+		return false
+	}
+
+	delete(p.pings, clientAddress)
+
+	return true
+}
+
+// miss records a pre-warm of a client that was not followed by a join in time
+func (p *preWarmer) miss(clientAddress string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	delete(p.pending, clientAddress)
+
+	h, ok := p.history[clientAddress]
+	if !ok {
+		return
+	}
+
+	if h.Misses < preWarmMaxMisses {
+		h.Misses++
+	}
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "pre-warm for %s was not followed by a join (pre-warm threshold: %d pings)", clientAddress, config.ConfigRuntime.Msh.PreWarm.Pings+h.Misses)
+	p.save()
+}
+
+// join registers the join of a client in the join history.
+// If the join follows a pre-warm of the same client, a pre-warm hit is recorded.
+//
+// Only joins of clients that passed the warm checks or that ms accepted should be registered.
+func (p *preWarmer) join(clientAddress string) {
+	if !config.ConfigRuntime.Msh.PreWarm.Enabled {
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.load()
+
+	h, ok := p.history[clientAddress]
+	if !ok {
+		h = &model.JoinHistory{}
+		p.history[clientAddress] = h
+	}
+
+	h.LastJoin = time.Now()
+	h.Joins++
+
+	// pre-warm hit: decrease the threshold
+	if t, ok := p.pending[clientAddress]; ok {
+		t.Stop()
+		delete(p.pending, clientAddress)
+
+		h.Hits++
+		if h.Misses > 0 {
+			h.Misses--
+		}
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "pre-warm for %s was followed by a join", clientAddress)
+	}
+
+	p.save()
+}
+
+// load loads the join history from file (only the first time it's called).
+// Expired entries are removed.
+// (preWarmer mutex should be locked by caller function)
+func (p *preWarmer) load() {
+	if p.loaded {
+		return
+	}
+	p.loaded = true
+	p.history = map[string]*model.JoinHistory{}
+
+	data, err := os.ReadFile(historyFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_HISTORY_LOAD, err.Error())
+		return
+	}
+
+	err = json.Unmarshal(data, &p.history)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_HISTORY_LOAD, "join history file format error: %s", err.Error())
+		p.history = map[string]*model.JoinHistory{}
+		return
+	}
+
+	for addr, h := range p.history {
+		if time.Since(h.LastJoin) > historyExpiry {
+			delete(p.history, addr)
+		}
+	}
+}
+
+// save saves the join history to file.
+// (preWarmer mutex should be locked by caller function)
+func (p *preWarmer) save() {
+	data, err := json.MarshalIndent(p.history, "", "  ")
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_HISTORY_SAVE, err.Error())
+		return
+	}
+
+	err = os.WriteFile(historyFileName, data, 0644)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_HISTORY_SAVE, err.Error())
+	}
+}
@@ -0,0 +1,141 @@
+package conn
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+	"msh/lib/servstats"
+)
+
+func Test_preWarmer(t *testing.T) {
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	status := servstats.Stats.Status
+	defer func() {
+		config.ConfigRuntime.Msh.PreWarm.Enabled = false
+		config.ConfigRuntime.Msh.PreWarm.Pings = 0
+		config.ConfigRuntime.Msh.PreWarm.Window = 0
+		config.ConfigRuntime.Msh.KnockHostnames = nil
+		servstats.Stats.Status = status
+		os.Chdir(wd)
+	}()
+
+	warms := 0
+	newPreWarmer := func() *preWarmer {
+		return &preWarmer{
+			m:       &sync.Mutex{},
+			pings:   map[string][]time.Time{},
+			pending: map[string]*time.Timer{},
+			warm:    func() *errco.MshLog { warms++; return nil },
+		}
+	}
+	p := newPreWarmer()
+	defer func() {
+		p.m.Lock()
+		for _, timer := range p.pending {
+			timer.Stop()
+		}
+		p.m.Unlock()
+	}()
+
+	servstats.Stats.Status = errco.SERVER_STATUS_OFFLINE
+	hs := &clientHandshake{serverAddr: "mc.example.com"}
+
+	// pre-warm disabled: joins are not registered, no history file is created
+	config.ConfigRuntime.Msh.PreWarm.Enabled = false
+	p.join("10.0.0.1")
+	if _, err := os.Stat(historyFileName); !os.IsNotExist(err) {
+		t.Fatalf("pre-warm disabled: history file created (%v)", err)
+	}
+
+	config.ConfigRuntime.Msh.PreWarm.Enabled = true
+	config.ConfigRuntime.Msh.PreWarm.Pings = 3
+	config.ConfigRuntime.Msh.PreWarm.Window = 60
+	p.join("10.0.0.1")
+
+	for _, test := range []struct {
+		name    string
+		client  string
+		age     time.Duration // age of the registered pings before the step
+		miss    int           // pre-warm misses recorded before the step
+		pings   int
+		knock   []model.KnockHostname
+		warmed  bool
+		pending bool
+	}{
+		{"unknown client", "10.0.0.9", 0, 0, 5, nil, false, false},
+		{"below threshold", "10.0.0.1", 0, 0, 2, nil, false, false},
+		{"threshold reached", "10.0.0.1", 0, 0, 1, nil, true, true},
+		{"pings reset after pre-warm", "10.0.0.1", 0, 0, 2, nil, false, true},
+		{"old pings not counted", "10.0.0.1", 61 * time.Second, 0, 2, nil, false, true},
+		{"recent pings counted", "10.0.0.1", 0, 0, 1, nil, true, true},
+		{"miss raises threshold", "10.0.0.1", 0, 1, 3, nil, false, false},
+		{"raised threshold reached", "10.0.0.1", 0, 0, 1, nil, true, true},
+		{"knock required", "10.0.0.1", 0, 0, 6, []model.KnockHostname{{Hostname: "secret.example.com"}}, false, true},
+	} {
+		config.ConfigRuntime.Msh.KnockHostnames = test.knock
+
+		p.m.Lock()
+		for addr, pings := range p.pings {
+			for i := range pings {
+				pings[i] = pings[i].Add(-test.age)
+			}
+			p.pings[addr] = pings
+		}
+		p.m.Unlock()
+
+		for i := 0; i < test.miss; i++ {
+			p.miss(test.client)
+		}
+
+		before := warms
+		var warmed bool
+		for i := 0; i < test.pings; i++ {
+			warmed = p.ping(test.client, hs)
+		}
+
+		p.m.Lock()
+		_, pending := p.pending[test.client]
+		p.m.Unlock()
+
+		if warmed != test.warmed || (warms > before) != test.warmed || pending != test.pending {
+			t.Errorf("%s: received (warmed: %t, warms: %d, pending: %t), expected (warmed: %t, pending: %t)", test.name, warmed, warms-before, pending, test.warmed, test.pending)
+		}
+	}
+
+	// join after pre-warm: hit decreases the threshold
+	p.miss("10.0.0.1")
+	p.ping("10.0.0.1", &clientHandshake{serverAddr: "secret.example.com"})
+	p.ping("10.0.0.1", &clientHandshake{serverAddr: "secret.example.com"})
+	config.ConfigRuntime.Msh.KnockHostnames = nil
+	p.join("10.0.0.1")
+	if h := p.history["10.0.0.1"]; h.Hits != 1 || h.Misses != 1 || len(p.pending) != 0 {
+		t.Errorf("pre-warm hit: unexpected history %+v (pending: %d)", h, len(p.pending))
+	}
+
+	// misses are capped
+	for i := 0; i < 2*preWarmMaxMisses; i++ {
+		p.miss("10.0.0.1")
+	}
+	if h := p.history["10.0.0.1"]; h.Misses != preWarmMaxMisses {
+		t.Errorf("misses not capped: %d", h.Misses)
+	}
+
+	// join history is persisted
+	q := newPreWarmer()
+	q.m.Lock()
+	q.load()
+	q.m.Unlock()
+	h, ok := q.history["10.0.0.1"]
+	if !ok || h.Joins != 2 || h.Hits != 1 || h.Misses != preWarmMaxMisses {
+		t.Errorf("join history not persisted: %+v", h)
+	}
+	if _, ok := q.history["10.0.0.9"]; ok {
+		t.Errorf("unknown client persisted")
+	}
+}
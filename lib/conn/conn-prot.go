@@ -2,6 +2,8 @@ package conn
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"math/big"
 	"net"
@@ -13,8 +15,21 @@ import (
 	"msh/lib/model"
 )
 
-// buildMessage takes the request type and message to write to the client
-func buildMessage(reqType int, message string) []byte {
+// clientHandshake contains the data sent by the client in the handshake packet
+// (and in the login start packet for JOIN requests)
+type clientHandshake struct {
+	protocol   int    // protocol version of the client
+	serverAddr string // server address used by the client to connect (as typed in the client)
+	serverPort int    // server port used by the client to connect
+	nextState  int    // 1: status (INFO), 2: login (JOIN), 3: transfer
+	playerName string // player name contained in the login start packet ("" if not available)
+	playerUUID string // player uuid contained in the login start packet ("" if not available, 1.19+)
+}
+
+// buildMessage takes the request type and message to write to the client.
+//
+// clientProt is the protocol version of the client (used only for INFO responses).
+func buildMessage(reqType int, message string, clientProt int) []byte {
 	// mountHeader mounts the full header to a specified message
 	var mountHeader = func(data []byte) []byte {
 		//                  ┌--------------------full header--------------------┐
@@ -77,8 +92,7 @@ func buildMessage(reqType int, message string) []byte {
 		messageStruct.Description.Text = message
 		messageStruct.Players.Max = 0
 		messageStruct.Players.Online = 0
-		messageStruct.Version.Name = config.ConfigRuntime.Server.Version
-		messageStruct.Version.Protocol = config.ConfigRuntime.Server.Protocol
+		messageStruct.Version.Name, messageStruct.Version.Protocol = versionInfo(clientProt)
 		messageStruct.Favicon = "data:image/png;base64," + config.ServerIcon
 
 		dataInfJSON, err := json.Marshal(messageStruct)
@@ -95,7 +109,7 @@ func buildMessage(reqType int, message string) []byte {
 	}
 }
 
-// getReqType returns the request packet, type (INFO or JOIN).
+// getReqType returns the request packet, type (INFO, JOIN or LEGACY).
 // Not player name as it's too difficult to extract.
 func getReqType(clientConn net.Conn) ([]byte, int, *errco.MshLog) {
 	var dataReqFull []byte
@@ -119,6 +133,12 @@ func getReqType(clientConn net.Conn) ([]byte, int, *errco.MshLog) {
 	}
 
 	switch {
+	case dataReqFull[0] == 0xFE:
+		// client is requesting server info with legacy ping (clients before 1.7)
+		// example: [ 254 1 250 0 11 0 77 0 67 ... ]
+
+		return dataReqFull, errco.CLIENT_REQ_LEGACY, nil
+
 	case reqTypeKeyByte == byte(1) || bytes.Contains(dataReqFull, reqFlagInfo):
 		// client is requesting server info
 		// example: [ 16 0 244 5 9 49 50 55 46 48 46 48 46 49 99 211 1 1 0 ]
@@ -164,6 +184,170 @@ func getReqType(clientConn net.Conn) ([]byte, int, *errco.MshLog) {
 	}
 }
 
+// parseHandshake extracts the handshake data (and the player name for JOIN requests)
+// from the client request packet returned by getReqType.
+//
+// (checkout handshake packet info: https://wiki.vg/Protocol#Handshake)
+func parseHandshake(reqPacket []byte) (*clientHandshake, *errco.MshLog) {
+	hs := &clientHandshake{}
+
+	//                ┌-------------------------------handshake packet--------------------------------┐┌--------login start packet---------┐
+	// scheme:        [ length | packet id | protocol | server address | server port | next state ][ length | packet id | name | ... ]
+	// type:          [ varint | varint    | varint   | varint + utf-8 | uint16      | varint     ][ varint | varint    | string    ]
+	// example:       [ 16     | 0         | 246 5    | 9 49 50 ... 49 | 99 211      | 2          ][ 11     | 0         | 9 103 ... ]
+
+	length, n, logMsh := readVarInt(reqPacket)
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	}
+	if length <= 0 || len(reqPacket) < n+length {
+		return nil, errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_ANALYSIS, "handshake packet is truncated (received: %v)", reqPacket)
+	}
+	packet, rest := reqPacket[n:n+length], reqPacket[n+length:]
+
+	// packet id
+	id, n, logMsh := readVarInt(packet)
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	}
+	if id != 0 {
+		return nil, errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_ANALYSIS, "unexpected handshake packet id (%d)", id)
+	}
+	packet = packet[n:]
+
+	// protocol version
+	hs.protocol, n, logMsh = readVarInt(packet)
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	}
+	packet = packet[n:]
+
+	// server address
+	hs.serverAddr, n, logMsh = readString(packet)
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	}
+	packet = packet[n:]
+
+	// forge clients append "\x00FML\x00" (or similar) to the server address, remove it.
+	// clients might also add a trailing dot if the address is a fully qualified domain name.
+	if i := strings.IndexByte(hs.serverAddr, 0); i != -1 {
+		hs.serverAddr = hs.serverAddr[:i]
+	}
+	hs.serverAddr = strings.TrimSuffix(hs.serverAddr, ".")
+
+	// server port
+	if len(packet) < 2 {
+		return nil, errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_ANALYSIS, "handshake packet does not contain server port")
+	}
+	hs.serverPort = int(binary.BigEndian.Uint16(packet[:2]))
+	packet = packet[2:]
+
+	// next state
+	hs.nextState, _, logMsh = readVarInt(packet)
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	}
+
+	// login start packet (only for JOIN requests)
+	// player name is not vital: in case of error return the handshake without it
+	if hs.nextState != 2 {
+		return hs, nil
+	}
+
+	length, n, logMsh = readVarInt(rest)
+	if logMsh != nil || length <= 0 || len(rest) < n+length {
+		return hs, nil
+	}
+	packet = rest[n : n+length]
+
+	id, n, logMsh = readVarInt(packet)
+	if logMsh != nil || id != 0 {
+		return hs, nil
+	}
+
+	packet = packet[n:]
+
+	hs.playerName, n, logMsh = readString(packet)
+	if logMsh != nil {
+		return hs, nil
+	}
+	packet = packet[n:]
+
+	// player uuid (not vital)
+	hs.playerUUID = readLoginUUID(packet, hs.protocol)
+
+	return hs, nil
+}
+
+// readLoginUUID reads the player uuid that follows the player name in the login start packet.
+// Returns "" if the uuid is not available.
+//
+//	1.20.2+ (764+):   [ uuid ]
+//	1.19.3+ (761+):   [ has uuid (bool) | uuid ]
+//	1.19    (759+):   [ has signature data (bool) | signature data | has uuid (bool) | uuid ] (signature data is not parsed)
+func readLoginUUID(data []byte, protocol int) string {
+	switch {
+	case protocol >= 764:
+	case protocol >= 761:
+		if len(data) < 1 || data[0] != 1 {
+			return ""
+		}
+		data = data[1:]
+	case protocol >= 759:
+		if len(data) < 2 || data[0] != 0 || data[1] != 1 {
+			return ""
+		}
+		data = data[2:]
+	default:
+		return ""
+	}
+
+	if len(data) < 16 {
+		return ""
+	}
+
+	u := hex.EncodeToString(data[:16])
+	return u[:8] + "-" + u[8:12] + "-" + u[12:16] + "-" + u[16:20] + "-" + u[20:]
+}
+
+// readVarInt reads a minecraft protocol varint from the beginning of data.
+// Returns the value and the number of bytes read.
+//
+// (checkout varint info: https://wiki.vg/Protocol#VarInt_and_VarLong)
+func readVarInt(data []byte) (int, int, *errco.MshLog) {
+	var val uint32
+
+	for i := 0; i < 5; i++ {
+		if i >= len(data) {
+			return 0, 0, errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_ANALYSIS, "varint is truncated")
+		}
+
+		val |= uint32(data[i]&0x7f) << (7 * i)
+
+		if data[i]&0x80 == 0 {
+			return int(int32(val)), i + 1, nil
+		}
+	}
+
+	return 0, 0, errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_ANALYSIS, "varint is too big")
+}
+
+// readString reads a minecraft protocol string (varint length + utf-8 bytes) from the beginning of data.
+// Returns the string and the number of bytes read.
+func readString(data []byte) (string, int, *errco.MshLog) {
+	length, n, logMsh := readVarInt(data)
+	if logMsh != nil {
+		return "", 0, logMsh.AddTrace()
+	}
+
+	if length < 0 || len(data) < n+length {
+		return "", 0, errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_ANALYSIS, "string is truncated")
+	}
+
+	return string(data[n : n+length]), n + length, nil
+}
+
 // getPing performs msh PING response to the client PING request
 // (must be performed after msh INFO response)
 func getPing(clientConn net.Conn) *errco.MshLog {
@@ -276,3 +276,65 @@ func Test_getPing(t *testing.T) {
 		serverSocket.Close()
 	}
 }
+
+func Test_parseHandshake(t *testing.T) {
+	type testHs struct {
+		title  string
+		packet []byte
+		expect *clientHandshake
+	}
+
+	tests := []testHs{
+		// positive cases
+		{
+			"client info request (1.18.2 local)",
+			[]byte{16, 0, 246, 5, 9, 49, 50, 55, 46, 48, 46, 48, 46, 49, 99, 211, 1, 1, 0},
+			&clientHandshake{758, "127.0.0.1", 25555, 1, "", ""},
+		},
+		{
+			"client join request (1.18.2 local)",
+			[]byte{33, 0, 246, 5, 26, 107, 117, 98, 101, 114, 110, 101, 116, 101, 115, 46, 100, 111, 99, 107, 101, 114, 46, 105, 110, 116, 101, 114, 110, 97, 108, 99, 211, 2, 11, 0, 9, 103, 101, 107, 105, 103, 101, 107, 57, 57},
+			&clientHandshake{758, "kubernetes.docker.internal", 25555, 2, "gekigek99", ""},
+		},
+		{
+			"client join request (1.19.3 local)",
+			[]byte{33, 0, 249, 5, 26, 107, 117, 98, 101, 114, 110, 101, 116, 101, 115, 46, 100, 111, 99, 107, 101, 114, 46, 105, 110, 116, 101, 114, 110, 97, 108, 99, 211, 2, 28, 0, 9, 103, 101, 107, 105, 103, 101, 107, 57, 57, 1, 196, 93, 252, 169, 146, 189, 69, 1, 169, 208, 156, 201, 205, 197, 2, 113},
+			&clientHandshake{761, "kubernetes.docker.internal", 25555, 2, "gekigek99", "c45dfca9-92bd-4501-a9d0-9cc9cdc50271"},
+		},
+		{
+			"client join request without login start (1.19.3 local)",
+			[]byte{33, 0, 249, 5, 26, 107, 117, 98, 101, 114, 110, 101, 116, 101, 115, 46, 100, 111, 99, 107, 101, 114, 46, 105, 110, 116, 101, 114, 110, 97, 108, 99, 211, 2},
+			&clientHandshake{761, "kubernetes.docker.internal", 25555, 2, "", ""},
+		},
+		{
+			"client info request (forge address)",
+			[]byte{21, 0, 246, 5, 14, 49, 50, 55, 46, 48, 46, 48, 46, 49, 0, 70, 77, 76, 0, 99, 211, 1},
+			&clientHandshake{758, "127.0.0.1", 25555, 1, "", ""},
+		},
+
+		// negative cases
+		{
+			"truncated handshake",
+			[]byte{16, 0, 246, 5, 9, 49, 50, 55},
+			nil,
+		},
+		{
+			"unexpected packet id",
+			[]byte{16, 1, 246, 5, 9, 49, 50, 55, 46, 48, 46, 48, 46, 49, 99, 211, 1},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		hs, logMsh := parseHandshake(test.packet)
+
+		switch {
+		case test.expect == nil && logMsh == nil:
+			t.Errorf("%s: expected error, received %+v", test.title, hs)
+		case test.expect != nil && logMsh != nil:
+			t.Errorf("%s: unexpected error: %s", test.title, logMsh.Mex)
+		case test.expect != nil && *hs != *test.expect:
+			t.Errorf("%s: received %+v, expected %+v", test.title, *hs, *test.expect)
+		}
+	}
+}
@@ -2,12 +2,18 @@ package conn
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"math/big"
-	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"msh/lib/config"
@@ -22,18 +28,65 @@ import (
 // - wiki.vg/Query
 // - github.com/dreamscached/minequery/v2
 
-// clib is a group of query challenges
-var clib *challengeLibrary = &challengeLibrary{}
+const (
+	challengeRotation time.Duration = 30 * time.Second // time after which query challenges are rotated
+	statsCacheTime    time.Duration = 5 * time.Second  // time for which ms stats responses are cached
+	queryRate         float64       = 5                // query packets/s allowed for each source address
+	queryBurst        float64       = 10               // query packets allowed in a burst for each source address
+	queryMaxSources   int           = 4096             // max number of source addresses tracked by the rate limiter
+)
+
+// challengeSecret is the secret used to derive query challenges from the source address
+// (generated at startup: challenges are not valid across msh restarts)
+var challengeSecret []byte = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		// should never happen: use a time based secret
+		binary.BigEndian.PutUint64(secret, uint64(time.Now().UnixNano()))
+	}
+	return secret
+}()
+
+// scache contains the last stats responses of ms
+var scache *statsCache = &statsCache{
+	m:    &sync.Mutex{},
+	data: map[int]statsCacheEntry{},
+}
+
+// statsCache represents the last stats responses of ms (key: request length, base or full)
+type statsCache struct {
+	m    *sync.Mutex
+	data map[int]statsCacheEntry
+}
 
-// challenge represents a query challenge uint32 value and its expiration timer
-type challenge struct {
-	time.Timer
-	val uint32
+// statsCacheEntry represents a stats response of ms and the time at which it was received
+type statsCacheEntry struct {
+	stats []byte // stats (without type and session id)
+	t     time.Time
 }
 
-// challengeLibrary represents a group of query challenges
-type challengeLibrary struct {
-	list []challenge
+// qlimit is the rate limiter of query packets
+var qlimit *queryLimiter = &queryLimiter{
+	m:       &sync.Mutex{},
+	rate:    queryRate,
+	burst:   queryBurst,
+	sources: map[string]*querySource{},
+}
+
+// queryLimiter is a token bucket rate limiter for each source address
+// (used for query packets and rcon authentication failures)
+type queryLimiter struct {
+	m         *sync.Mutex
+	rate      float64 // tokens/s refilled for each source address
+	burst     float64 // max tokens of each source address
+	sources   map[string]*querySource
+	lastPrune time.Time
+}
+
+// querySource represents the token bucket of a source address
+type querySource struct {
+	tokens float64
+	last   time.Time
 }
 
 // HandlerQuery handles query stats requests.
@@ -57,6 +110,13 @@ func HandlerQuery() {
 			continue
 		}
 
+		// drop packets from sources exceeding the rate limit
+		// (log level 4 to avoid log flooding)
+		if !qlimit.allow(addrCli.String(), time.Now()) {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_4, errco.ERROR_QUERY_RATE_LIMIT, "query rate limit exceeded by %s", addrCli.String())
+			continue
+		}
+
 		// if minecraft server is not warm, handle request
 		logMsh := handleRequest(connCli, addrCli, buf[:n])
 		if logMsh != nil {
@@ -67,6 +127,12 @@ func HandlerQuery() {
 
 // handleRequest handles handshake / stats request from client performing handshake / stats response.
 func handleRequest(connCli net.PacketConn, addr net.Addr, reqClient []byte) *errco.MshLog {
+	// handling of ipv6 addresses
+	clientAddress := addr.String()
+	if li := strings.LastIndex(clientAddress, ":"); li != -1 {
+		clientAddress = clientAddress[:li]
+	}
+
 	switch len(reqClient) {
 
 	case 7: // handshake request from client
@@ -75,9 +141,9 @@ func handleRequest(connCli net.PacketConn, addr net.Addr, reqClient []byte) *err
 		sessionID := reqClient[3:7]
 
 		// handshake response composition
-		rsp := bytes.NewBuffer([]byte{9})                       // type: handshake
-		rsp.Write(sessionID)                                    // session id
-		rsp.WriteString(fmt.Sprintf("%d", clib.gen()) + "\x00") // challenge (int32 written as string, null terminated)
+		rsp := bytes.NewBuffer([]byte{9})                                                    // type: handshake
+		rsp.Write(sessionID)                                                                 // session id
+		rsp.WriteString(fmt.Sprintf("%d", challengeGen(addr.String(), time.Now())) + "\x00") // challenge (int32 written as string, null terminated)
 
 		// handshake response send
 		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "send handshake rsp:\t%v", rsp.Bytes())
@@ -85,6 +151,7 @@ func handleRequest(connCli net.PacketConn, addr net.Addr, reqClient []byte) *err
 		if err != nil {
 			return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_CONN_WRITE, err.Error())
 		}
+		recordEvent(EVENT_QUERY, clientAddress, nil, DECISION_ANSWERED)
 
 		return nil
 
@@ -94,14 +161,16 @@ func handleRequest(connCli net.PacketConn, addr net.Addr, reqClient []byte) *err
 		sessionID := reqClient[3:7]
 		challenge := reqClient[7:11]
 
-		// check that received challenge is known and not expired
-		if !clib.inLibrary(binary.BigEndian.Uint32(challenge)) {
+		// check that received challenge was generated for the source address and is not expired
+		if !challengeCheck(addr.String(), binary.BigEndian.Uint32(challenge), time.Now()) {
+			recordEvent(EVENT_QUERY, clientAddress, nil, DECISION_REFUSED_QUERY)
 			return errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_QUERY_CHALLENGE, "challenge failed")
 		}
 
 		// if ms is not warm emulate response
 		logMsh := servctrl.CheckMSWarm()
 		if logMsh != nil {
+			recordEvent(EVENT_QUERY, clientAddress, nil, DECISION_ANSWERED)
 			switch len(reqClient) {
 			case 11: // base stats response
 				statsRespBase(connCli, addr, sessionID)
@@ -122,10 +191,12 @@ func handleRequest(connCli net.PacketConn, addr net.Addr, reqClient []byte) *err
 			return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_CONN_WRITE, err.Error())
 		}
 		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "send stats rsp:\t%v", stats)
+		recordEvent(EVENT_QUERY, clientAddress, nil, DECISION_PROXIED)
 
 		return nil
 
 	default:
+		recordEvent(EVENT_QUERY, clientAddress, nil, DECISION_MALFORMED)
 		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_CONN_READ, "unexpected number of bytes in stats / handshake request")
 	}
 }
@@ -133,6 +204,16 @@ func handleRequest(connCli net.PacketConn, addr net.Addr, reqClient []byte) *err
 // statsGet connects to ms and performs a stats base/full request.
 // Returns the stats data already adapted for the client response.
 func statsGet(reqClient []byte) ([]byte, *errco.MshLog) {
+	// use cached ms response if recent
+	// (avoids opening a connection to ms for each client request)
+	if stats, ok := scache.get(len(reqClient), time.Now()); ok {
+		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, " └ using cached stats rsp:\t%v", stats)
+		data := bytes.NewBuffer(nil)
+		data.Write(reqClient[2:7]) // stats code (0) + session id (from client request)
+		data.Write(stats)          // stats (from cached server response)
+		return data.Bytes(), nil
+	}
+
 	// Dial the server using a UDP connection
 	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", config.ServHost, config.ServPortQuery))
 	if err != nil {
@@ -193,9 +274,18 @@ func statsGet(reqClient []byte) ([]byte, *errco.MshLog) {
 	}
 	errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, " └ recv stats rsp (<- ms):\t%v", buf[:n])
 
+	// store full stats in query cache (used when ms is not warm)
+	if len(reqClient) == 15 {
+		qcache.update(buf[5:n])
+	}
+
+	// store stats in stats cache (used for next client requests)
+	scache.set(len(reqClient), buf[5:n], time.Now())
+
 	// adapt server stats response to client session id
-	data = bytes.NewBuffer(reqClient[2:7]) // stats code (0) + session id (from client request)
-	data.Write(buf[5:n])                   // stats (from server response)
+	data = bytes.NewBuffer(nil)
+	data.Write(reqClient[2:7]) // stats code (0) + session id (from client request)
+	data.Write(buf[5:n])       // stats (from server response)
 
 	return data.Bytes(), nil
 }
@@ -203,9 +293,14 @@ func statsGet(reqClient []byte) ([]byte, *errco.MshLog) {
 // statsRespBase writes a base stats response to client
 func statsRespBase(connCli net.PacketConn, addr net.Addr, sessionID []byte) {
 	levelName, _ := config.ConfigRuntime.ParsePropertiesString("level-name")
-	mshPortSmallEndian := utility.Reverse(big.NewInt(int64(config.MshPort)).Bytes())
+	hostIP, hostPort := queryHost()
+	numPlayers, _ := queryPlayers()
+	hostPortSmallEndian := make([]byte, 2)
+	binary.LittleEndian.PutUint16(hostPortSmallEndian, uint16(hostPort))
 	var motd string
 	switch {
+	case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE && servstats.Stats.Waking:
+		motd = config.ConfigRuntime.Msh.InfoWaking
 	case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE || servstats.Stats.Suspended:
 		motd = config.ConfigRuntime.Msh.InfoHibernation
 	case servstats.Stats.Status == errco.SERVER_STATUS_STARTING:
@@ -217,15 +312,15 @@ func statsRespBase(connCli net.PacketConn, addr net.Addr, sessionID []byte) {
 	}
 
 	buf := bytes.NewBuffer(nil)
-	buf.WriteByte(0)                                                 // type
-	buf.Write(sessionID)                                             // session ID
-	buf.WriteString(fmt.Sprintf("%s\x00", motd))                     // MOTD
-	buf.WriteString("SMP\x00")                                       // gametype hardcoded (default)
-	buf.WriteString(fmt.Sprintf("%s\x00", levelName))                // map
-	buf.WriteString("0\x00")                                         // numplayers hardcoded
-	buf.WriteString("0\x00")                                         // maxplayers hardcoded
-	buf.Write(append(mshPortSmallEndian, byte(0)))                   // hostport
-	buf.WriteString(fmt.Sprintf("%s\x00", utility.GetOutboundIP4())) // hostip
+	buf.WriteByte(0)                                          // type
+	buf.Write(sessionID)                                      // session ID
+	buf.WriteString(fmt.Sprintf("%s\x00", motd))              // MOTD
+	buf.WriteString("SMP\x00")                                // gametype hardcoded (default)
+	buf.WriteString(fmt.Sprintf("%s\x00", levelName))         // map
+	buf.WriteString(fmt.Sprintf("%d\x00", numPlayers))        // numplayers
+	buf.WriteString(fmt.Sprintf("%d\x00", queryMaxPlayers())) // maxplayers
+	buf.Write(append(hostPortSmallEndian, byte(0)))           // hostport
+	buf.WriteString(fmt.Sprintf("%s\x00", hostIP))            // hostip
 
 	errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "send stats base rsp:\t%v", buf.Bytes())
 	_, err := connCli.WriteTo(buf.Bytes(), addr)
@@ -237,8 +332,13 @@ func statsRespBase(connCli net.PacketConn, addr net.Addr, sessionID []byte) {
 // statsRespFull writes a full stats response to client
 func statsRespFull(connCli net.PacketConn, addr net.Addr, sessionID []byte) {
 	levelName, _ := config.ConfigRuntime.ParsePropertiesString("level-name")
+	hostIP, hostPort := queryHost()
+	numPlayers, players := queryPlayers()
+	status, eta := mshStatus()
 	var motd string
 	switch {
+	case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE && servstats.Stats.Waking:
+		motd = config.ConfigRuntime.Msh.InfoWaking
 	case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE || servstats.Stats.Suspended:
 		motd = config.ConfigRuntime.Msh.InfoHibernation
 	case servstats.Stats.Status == errco.SERVER_STATUS_STARTING:
@@ -259,17 +359,22 @@ func statsRespFull(connCli net.PacketConn, addr net.Addr, sessionID []byte) {
 	buf.WriteString(fmt.Sprintf("gametype\x00%s\x00", "SMP"))      // hardcoded (default)
 	buf.WriteString(fmt.Sprintf("game_id\x00%s\x00", "MINECRAFT")) // hardcoded (default)
 	buf.WriteString(fmt.Sprintf("version\x00%s\x00", config.ConfigRuntime.Server.Version))
-	buf.WriteString(fmt.Sprintf("plugins\x00msh/%s: msh %s\x00", config.ConfigRuntime.Server.Version, progmgr.MshVersion)) // example: "plugins\x00{ServerVersion}: {Name} {Version}; {Name} {Version}\x00"
+	buf.WriteString(fmt.Sprintf("plugins\x00%s\x00", queryPlugins())) // example: "plugins\x00{ServerVersion}: {Name} {Version}; {Name} {Version}\x00"
 	buf.WriteString(fmt.Sprintf("map\x00%s\x00", levelName))
-	buf.WriteString("numplayers\x000\x00") // hardcoded
-	buf.WriteString("maxplayers\x000\x00") // hardcoded
-	buf.WriteString(fmt.Sprintf("hostport\x00%d\x00", config.MshPort))
-	buf.WriteString(fmt.Sprintf("hostip\x00%s\x00", utility.GetOutboundIP4()))
+	buf.WriteString(fmt.Sprintf("numplayers\x00%d\x00", numPlayers))
+	buf.WriteString(fmt.Sprintf("maxplayers\x00%d\x00", queryMaxPlayers()))
+	buf.WriteString(fmt.Sprintf("hostport\x00%d\x00", hostPort))
+	buf.WriteString(fmt.Sprintf("hostip\x00%s\x00", hostIP))
+	buf.WriteString(fmt.Sprintf("msh_status\x00%s\x00", status))
+	buf.WriteString(fmt.Sprintf("msh_eta\x00%d\x00", eta))
 	buf.WriteByte(0) // termination of section (?)
 
 	// Players
 	buf.WriteString("\x01player_\x00\x00") // padding (default)
-	buf.WriteString("\x00")                // example: "aaa\x00bbb\x00\x00"
+	for _, p := range players {
+		buf.WriteString(p + "\x00")
+	}
+	buf.WriteString("\x00") // example: "aaa\x00bbb\x00\x00"
 
 	errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "send stats full rsp:\t%v", buf.Bytes())
 	_, err := connCli.WriteTo(buf.Bytes(), addr)
@@ -278,39 +383,315 @@ func statsRespFull(connCli net.PacketConn, addr net.Addr, sessionID []byte) {
 	}
 }
 
-// Gen generates a int32 challenge and adds it to the challenge library
-func (cl *challengeLibrary) gen() uint32 {
-	rand.Seed(time.Now().UnixNano())
-	cval := uint32(rand.Int31n(9_999_999-1_000_000+1) + 1_000_000)
+// qcache contains the data of the last full stats response of ms
+var qcache *queryCache = &queryCache{m: &sync.Mutex{}}
+
+// queryCache represents the data of the last full stats response of ms
+type queryCache struct {
+	m          *sync.Mutex
+	plugins    string   // plugins value (example: "Paper on 1.19.2: ViaVersion 5.0.3; LuckPerms 5.4")
+	maxPlayers int      // maxplayers value
+	numPlayers int      // numplayers value
+	players    []string // player list
+	playersSet bool     // numplayers and player list have been received
+}
+
+// update stores in query cache the full stats received from ms
+// (stats must start from the K, V section)
+func (qc *queryCache) update(stats []byte) {
+	kv, players := parseFullStats(stats)
+
+	qc.m.Lock()
+	defer qc.m.Unlock()
+
+	if p, ok := kv["plugins"]; ok {
+		qc.plugins = p
+	}
+	if mp, err := strconv.Atoi(kv["maxplayers"]); err == nil {
+		qc.maxPlayers = mp
+	}
+	if np, err := strconv.Atoi(kv["numplayers"]); err == nil {
+		qc.numPlayers, qc.players, qc.playersSet = np, players, true
+	}
+}
+
+// parseFullStats parses a full stats response (starting from the K, V section)
+// and returns the K, V pairs and the player list.
+func parseFullStats(stats []byte) (map[string]string, []string) {
+	kv := map[string]string{}
+	players := []string{}
+
+	// remove padding: "splitnum\x00\x80\x00"
+	stats = bytes.TrimPrefix(stats, []byte("splitnum\x00\x80\x00"))
+
+	// K, V section (terminated by an empty key)
+	sections := bytes.SplitN(stats, []byte("\x00\x00\x01player_\x00\x00"), 2)
+	fields := bytes.Split(sections[0], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		kv[string(fields[i])] = string(fields[i+1])
+	}
+
+	// players section (terminated by an empty name)
+	if len(sections) == 2 {
+		for _, p := range bytes.Split(sections[1], []byte{0}) {
+			if len(p) == 0 {
+				break
+			}
+			players = append(players, string(p))
+		}
+	}
+
+	return kv, players
+}
+
+// queryMaxPlayers returns the max players reported in query responses when ms is not warm
+// (max-players from server.properties, max players of last ms query response otherwise).
+func queryMaxPlayers() int {
+	if mp, logMsh := config.ConfigRuntime.ParsePropertiesInt("max-players"); logMsh == nil {
+		return mp
+	}
+
+	qcache.m.Lock()
+	defer qcache.m.Unlock()
+
+	return qcache.maxPlayers
+}
+
+// queryPlayers returns the player count and list reported in query responses when ms is not warm
+// (last-known players of last ms query response, players in player registry otherwise).
+func queryPlayers() (int, []string) {
+	qcache.m.Lock()
+	if qcache.playersSet {
+		defer qcache.m.Unlock()
+		return qcache.numPlayers, append([]string{}, qcache.players...)
+	}
+	qcache.m.Unlock()
+
+	players := []string{}
+	for _, p := range servstats.Players.List() {
+		players = append(players, p.Name)
+	}
+
+	return servstats.Players.Count(), players
+}
+
+// pluginJarRegexp matches plugin jar file names (example: "ViaVersion-5.0.3.jar" -> "ViaVersion", "5.0.3")
+var pluginJarRegexp = regexp.MustCompile(`^(.+?)(?:[-_ ]v?(\d[\w.+-]*))?\.jar$`)
+
+// queryPlugins returns the plugins reported in query responses when ms is not warm
+// (plugins of last ms query response, plugins in ms plugins folder otherwise).
+//
+// Format: "{ServerVersion}: {Name} {Version}; {Name} {Version}"
+func queryPlugins() string {
+	qcache.m.Lock()
+	plugins := qcache.plugins
+	qcache.m.Unlock()
+
+	mshPlugin := "msh " + progmgr.MshVersion
+
+	if plugins != "" {
+		if strings.Contains(plugins, ": ") {
+			return plugins + "; " + mshPlugin
+		}
+		return plugins + ": " + mshPlugin
+	}
 
-	c := challenge{
-		Timer: *time.NewTimer(time.Hour),
-		val:   cval,
+	list := []string{}
+	if entries, err := os.ReadDir(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins")); err == nil {
+		for _, e := range entries {
+			m := pluginJarRegexp.FindStringSubmatch(e.Name())
+			if e.IsDir() || m == nil {
+				continue
+			}
+			list = append(list, strings.TrimSpace(m[1]+" "+m[2]))
+		}
 	}
+	list = append(list, mshPlugin)
 
-	cl.list = append(cl.list, c)
+	return config.ConfigRuntime.Server.Version + ": " + strings.Join(list, "; ")
+}
+
+// queryHost returns the host ip and host port reported in query responses when ms is not warm
+func queryHost() (string, int) {
+	hostIP := config.ConfigRuntime.Msh.QueryAdvertise.HostIP
+	if hostIP == "" {
+		if config.MshHost != "0.0.0.0" && config.MshHost != "" {
+			hostIP = config.MshHost
+		} else {
+			hostIP = utility.GetOutboundIP4()
+		}
+	}
 
-	return cval
+	hostPort := config.ConfigRuntime.Msh.QueryAdvertise.HostPort
+	if hostPort <= 0 {
+		hostPort = config.MshPort
+	}
+
+	return hostIP, hostPort
 }
 
-// InLibrary searches library for non-expired test value
-func (cl *challengeLibrary) inLibrary(t uint32) bool {
-	// remove expired challenges
-	// (reverse list loop to remove elements while iterating on them)
-	for i := len(cl.list) - 1; i >= 0; i-- {
-		select {
-		case <-cl.list[i].C:
-			cl.list = append(cl.list[:i], cl.list[i+1:]...)
-		default:
+// mshStatus returns the ms status reported in query responses (msh_status)
+// and the estimated seconds before ms can be joined (msh_eta, -1 if unknown).
+func mshStatus() (string, int) {
+	switch {
+	case servstats.Stats.MajorError != nil:
+		return "error", -1
+	case traffic.capped() && (servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE || servstats.Stats.Suspended):
+		return "datacap", -1
+	case servstats.Stats.Suspended:
+		return "hibernating", 0
+	case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE && servstats.Stats.Waking:
+		return "waking", -1
+	case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE:
+		if servstats.Stats.StartupTime == 0 {
+			return "hibernating", -1
 		}
+		return "hibernating", utility.RoundSec(servstats.Stats.StartupTime)
+	case servstats.Stats.Status == errco.SERVER_STATUS_STARTING:
+		if servstats.Stats.StartupTime == 0 {
+			return "starting", -1
+		}
+		eta := utility.RoundSec(servstats.Stats.StartupTime) - servctrl.TermUpTime()
+		if eta < 0 {
+			eta = 0
+		}
+		return "starting", eta
+	case servstats.Stats.Status == errco.SERVER_STATUS_STOPPING:
+		return "stopping", -1
+	default:
+		return "online", 0
 	}
+}
+
+// challengeAt returns the query challenge of the source address for the specified rotation epoch.
+//
+// The challenge is derived from the source address (vanilla-style) so that clients with a spoofed
+// source address never receive it and msh doesn't need to store challenges.
+func challengeAt(addr string, epoch int64) uint32 {
+	mac := hmac.New(sha256.New, challengeSecret)
+	binary.Write(mac, binary.BigEndian, epoch)
+	mac.Write([]byte(addr))
+
+	// challenge is an int32 written as string: must be positive
+	return binary.BigEndian.Uint32(mac.Sum(nil)[:4]) & 0x7fffffff
+}
+
+// challengeGen returns the current query challenge of the source address
+func challengeGen(addr string, now time.Time) uint32 {
+	return challengeAt(addr, now.UnixNano()/int64(challengeRotation))
+}
 
-	// search for non-expired test value
-	for i := 0; i < len(cl.list); i++ {
-		if t == cl.list[i].val {
-			return true
+// challengeCheck returns true if the challenge is valid for the source address.
+// Challenges of the current and previous rotation are accepted.
+func challengeCheck(addr string, c uint32, now time.Time) bool {
+	epoch := now.UnixNano() / int64(challengeRotation)
+
+	return hmac.Equal(uint32Bytes(c), uint32Bytes(challengeAt(addr, epoch))) ||
+		hmac.Equal(uint32Bytes(c), uint32Bytes(challengeAt(addr, epoch-1)))
+}
+
+// uint32Bytes returns the big endian bytes of a uint32
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// get returns the cached stats for the request length if not expired
+func (sc *statsCache) get(reqLen int, now time.Time) ([]byte, bool) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	e, ok := sc.data[reqLen]
+	if !ok || now.Sub(e.t) > statsCacheTime {
+		return nil, false
+	}
+
+	return e.stats, true
+}
+
+// set caches the stats for the request length
+func (sc *statsCache) set(reqLen int, stats []byte, now time.Time) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	sc.data[reqLen] = statsCacheEntry{stats: append([]byte{}, stats...), t: now}
+}
+
+// allow returns true if a packet from the source address is within the rate limit.
+//
+// Source addresses with a full token bucket (idle sources) are removed every minute
+// and when a new source address would exceed queryMaxSources.
+// If the limit is still exceeded (spoofed source flood), packets from new source addresses are dropped.
+func (ql *queryLimiter) allow(addr string, now time.Time) bool {
+	ql.m.Lock()
+	defer ql.m.Unlock()
+
+	src := ql.source(addr, now)
+	if src == nil || src.tokens < 1 {
+		return false
+	}
+
+	src.tokens--
+	return true
+}
+
+// limited returns true if a packet from the source address would exceed the rate limit
+// (no token is used).
+func (ql *queryLimiter) limited(addr string, now time.Time) bool {
+	ql.m.Lock()
+	defer ql.m.Unlock()
+
+	src := ql.source(addr, now)
+	return src == nil || src.tokens < 1
+}
+
+// source returns the token bucket of the source address with refilled tokens
+// (nil if the source address can't be tracked).
+// (queryLimiter mutex should be locked by caller function)
+func (ql *queryLimiter) source(addr string, now time.Time) *querySource {
+	// rate limit is applied to the source ip (not port)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	src, ok := ql.sources[addr]
+	if !ok && (len(ql.sources) >= queryMaxSources || now.Sub(ql.lastPrune) > time.Minute) {
+		ql.prune(now)
+	}
+
+	if !ok {
+		if len(ql.sources) >= queryMaxSources {
+			return nil
 		}
+		src = &querySource{tokens: ql.burst, last: now}
+		ql.sources[addr] = src
+	}
+
+	// refill tokens
+	src.tokens += now.Sub(src.last).Seconds() * ql.rate
+	if src.tokens > ql.burst {
+		src.tokens = ql.burst
 	}
+	src.last = now
 
-	return false
+	return src
+}
+
+// prune removes the source addresses with a full token bucket
+// (a source idle for the time needed to refill its bucket is equivalent to a new source).
+// Pruning is done at most once per second.
+// (queryLimiter mutex should be locked by caller function)
+func (ql *queryLimiter) prune(now time.Time) {
+	if now.Sub(ql.lastPrune) < time.Second {
+		return
+	}
+	ql.lastPrune = now
+
+	refill := time.Duration(ql.burst / ql.rate * float64(time.Second))
+	for a, src := range ql.sources {
+		if now.Sub(src.last) >= refill {
+			delete(ql.sources, a)
+		}
+	}
 }
@@ -2,12 +2,17 @@ package conn
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/dreamscached/minequery/v2"
 
 	"msh/lib/config"
+	"msh/lib/progmgr"
+	"msh/lib/servstats"
 )
 
 func Test_QueryFull(t *testing.T) {
@@ -51,3 +56,133 @@ func Test_QueryBasic(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 }
+
+func Test_parseFullStats(t *testing.T) {
+	stats := []byte("splitnum\x00\x80\x00" +
+		"hostname\x00A Minecraft Server\x00gametype\x00SMP\x00plugins\x00Paper on 1.19.2: ViaVersion 5.0.3\x00maxplayers\x0020\x00\x00" +
+		"\x01player_\x00\x00" +
+		"gekigek99\x00notch\x00\x00")
+
+	kv, players := parseFullStats(stats)
+
+	if kv["hostname"] != "A Minecraft Server" || kv["plugins"] != "Paper on 1.19.2: ViaVersion 5.0.3" || kv["maxplayers"] != "20" {
+		t.Errorf("unexpected K, V section: %v", kv)
+	}
+	if len(players) != 2 || players[0] != "gekigek99" || players[1] != "notch" {
+		t.Errorf("unexpected players section: %v", players)
+	}
+}
+
+func Test_queryPlugins(t *testing.T) {
+	config.ConfigRuntime.Server.Folder = t.TempDir()
+	config.ConfigRuntime.Server.Version = "1.19.2"
+
+	// plugins from ms plugins folder
+	os.Mkdir(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins"), 0755)
+	os.WriteFile(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins", "ViaVersion-5.0.3.jar"), nil, 0644)
+	os.WriteFile(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins", "LuckPerms.jar"), nil, 0644)
+	os.WriteFile(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins", "config.yml"), nil, 0644)
+
+	exp := "1.19.2: LuckPerms; ViaVersion 5.0.3; msh " + progmgr.MshVersion
+	if p := queryPlugins(); p != exp {
+		t.Errorf("plugins folder: received %q, expected %q", p, exp)
+	}
+
+	// plugins from last ms query response
+	qcache.update([]byte("splitnum\x00\x80\x00plugins\x00Paper on 1.19.2: ViaVersion 5.0.3\x00\x00\x01player_\x00\x00\x00"))
+	defer func() { qcache.plugins = "" }()
+
+	exp = "Paper on 1.19.2: ViaVersion 5.0.3; msh " + progmgr.MshVersion
+	if p := queryPlugins(); p != exp {
+		t.Errorf("query cache: received %q, expected %q", p, exp)
+	}
+}
+
+func Test_queryPlayers(t *testing.T) {
+	defer func() {
+		qcache.numPlayers, qcache.players, qcache.playersSet = 0, nil, false
+		servstats.Players.Reset()
+	}()
+
+	// players from player registry
+	servstats.Players.Join("gekigek99", "", "10.0.0.1", servstats.PLAYER_SRC_LOG)
+	if n, players := queryPlayers(); n != 1 || len(players) != 1 || players[0] != "gekigek99" {
+		t.Errorf("player registry: received %d %v", n, players)
+	}
+
+	// last-known players from last ms query response
+	qcache.update([]byte("splitnum\x00\x80\x00numplayers\x002\x00maxplayers\x0020\x00\x00\x01player_\x00\x00gekigek99\x00notch\x00\x00"))
+	if n, players := queryPlayers(); n != 2 || len(players) != 2 || players[1] != "notch" {
+		t.Errorf("query cache: received %d %v", n, players)
+	}
+}
+
+func Test_challenge(t *testing.T) {
+	now := time.Now()
+	addrA, addrB := "10.0.0.1:50000", "10.0.0.2:50000"
+
+	c := challengeGen(addrA, now)
+
+	tests := []struct {
+		addr string
+		t    time.Time
+		exp  bool
+	}{
+		{addrA, now, true},                             // same source address
+		{addrB, now, false},                            // different source address
+		{"10.0.0.1:50001", now, false},                 // different source port
+		{addrA, now.Add(challengeRotation), true},      // previous rotation is accepted
+		{addrA, now.Add(2 * challengeRotation), false}, // expired challenge
+	}
+
+	for _, test := range tests {
+		if ok := challengeCheck(test.addr, c, test.t); ok != test.exp {
+			t.Errorf("challenge check (%s, +%s): received %t, expected %t", test.addr, test.t.Sub(now), ok, test.exp)
+		}
+	}
+
+	if c > 0x7fffffff {
+		t.Errorf("challenge %d is not a positive int32", c)
+	}
+}
+
+func Test_queryLimiter(t *testing.T) {
+	ql := &queryLimiter{m: &sync.Mutex{}, rate: queryRate, burst: queryBurst, sources: map[string]*querySource{}}
+	now := time.Now()
+
+	// burst is allowed, then packets are dropped
+	for i := 0; i < int(queryBurst); i++ {
+		if !ql.allow("10.0.0.1:50000", now) {
+			t.Fatalf("packet %d of burst was dropped", i)
+		}
+	}
+	if ql.allow("10.0.0.1:50001", now) {
+		t.Errorf("packet exceeding burst (different port, same ip) was allowed")
+	}
+
+	// other sources are not affected
+	if !ql.allow("10.0.0.2:50000", now) {
+		t.Errorf("packet from other source was dropped")
+	}
+
+	// tokens are refilled over time
+	if !ql.allow("10.0.0.1:50000", now.Add(time.Second)) {
+		t.Errorf("packet after refill was dropped")
+	}
+
+	// sources are capped: new sources are dropped while tracked sources are active
+	for i := len(ql.sources); i < queryMaxSources; i++ {
+		ql.allow(fmt.Sprintf("172.16.%d.%d:50000", i/256, i%256), now.Add(time.Second))
+	}
+	if ql.allow("10.0.0.3:50000", now.Add(time.Second)) || len(ql.sources) != queryMaxSources {
+		t.Errorf("new source exceeding the limit was allowed (%d sources)", len(ql.sources))
+	}
+	if !ql.allow("10.0.0.2:50000", now.Add(time.Second)) {
+		t.Errorf("packet from tracked source was dropped")
+	}
+
+	// idle sources are pruned when a new source exceeds the limit
+	if !ql.allow("10.0.0.3:50000", now.Add(10*time.Second)) || len(ql.sources) != 1 {
+		t.Errorf("idle sources not pruned (%d sources)", len(ql.sources))
+	}
+}
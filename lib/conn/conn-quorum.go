@@ -0,0 +1,122 @@
+package conn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+)
+
+// quorum contains the players that are waiting for the minecraft server to be warmed
+var quorum *startQuorum = &startQuorum{
+	m:       &sync.Mutex{},
+	waiting: map[string]time.Time{},
+}
+
+// startQuorum represents the players that tried to join while minecraft server is hibernating
+type startQuorum struct {
+	m       *sync.Mutex
+	waiting map[string]time.Time // player name -> time of last join attempt
+}
+
+// check registers a join attempt of a player and returns true if the quorum is reached.
+// When the quorum is reached, the waiting list is cleared.
+//
+// If the quorum is not reached, the number of missing players and the waiting players are returned.
+//
+// If quorum is disabled or the player is in bypass list, true is returned.
+func (q *startQuorum) check(player string) (bool, int, []string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	needed := config.ConfigRuntime.Msh.StartQuorum.Players
+	if needed <= 1 {
+		return true, 0, nil
+	}
+
+	for _, b := range config.ConfigRuntime.Msh.StartQuorum.Bypass {
+		if strings.EqualFold(b, player) {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "player %s can bypass start quorum", player)
+			q.waiting = map[string]time.Time{}
+			return true, 0, nil
+		}
+	}
+
+	// remove join attempts outside of time window
+	q.prune()
+
+	// register join attempt
+	q.waiting[player] = time.Now()
+
+	if len(q.waiting) >= needed {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "start quorum reached (%d/%d players)", len(q.waiting), needed)
+		q.waiting = map[string]time.Time{}
+		return true, 0, nil
+	}
+
+	return false, needed - len(q.waiting), q.names()
+}
+
+// reset clears the waiting list
+func (q *startQuorum) reset() {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	q.waiting = map[string]time.Time{}
+}
+
+// prune removes the join attempts outside of the time window.
+// (quorum mutex should be locked by caller function)
+func (q *startQuorum) prune() {
+	window := time.Duration(config.ConfigRuntime.Msh.StartQuorum.Window) * time.Second
+
+	for p, t := range q.waiting {
+		if time.Since(t) > window {
+			delete(q.waiting, p)
+		}
+	}
+}
+
+// names returns the sorted names of waiting players.
+// (quorum mutex should be locked by caller function)
+func (q *startQuorum) names() []string {
+	names := []string{}
+	for p := range q.waiting {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// quorumMessage returns the message shown to a player waiting for the start quorum
+func quorumMessage(missing int, waiting []string) string {
+	return fmt.Sprintf("Waiting for %d more player(s) to start the server\nplayers waiting: %s", missing, strings.Join(waiting, ", "))
+}
+
+// QuorumStatus returns a description of the start quorum status
+func QuorumStatus() string {
+	quorum.m.Lock()
+	defer quorum.m.Unlock()
+
+	if config.ConfigRuntime.Msh.StartQuorum.Players <= 1 {
+		return "start quorum is disabled"
+	}
+
+	quorum.prune()
+
+	return fmt.Sprintf("start quorum: %d/%d players waiting %v (window: %ds)",
+		len(quorum.waiting),
+		config.ConfigRuntime.Msh.StartQuorum.Players,
+		quorum.names(),
+		config.ConfigRuntime.Msh.StartQuorum.Window)
+}
+
+// QuorumReset clears the players waiting for the start quorum
+func QuorumReset() {
+	quorum.reset()
+}
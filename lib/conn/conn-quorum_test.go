@@ -0,0 +1,75 @@
+package conn
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+func Test_startQuorum(t *testing.T) {
+	defer func() {
+		config.ConfigRuntime.Msh.StartQuorum.Players = 0
+		config.ConfigRuntime.Msh.StartQuorum.Window = 0
+		config.ConfigRuntime.Msh.StartQuorum.Bypass = nil
+		QuorumReset()
+	}()
+
+	q := &startQuorum{m: &sync.Mutex{}, waiting: map[string]time.Time{}}
+
+	// quorum disabled
+	config.ConfigRuntime.Msh.StartQuorum.Players = 1
+	if ok, _, _ := q.check("Steve"); !ok {
+		t.Error("quorum disabled: join not accepted")
+	}
+
+	config.ConfigRuntime.Msh.StartQuorum.Players = 3
+	config.ConfigRuntime.Msh.StartQuorum.Window = 60
+	config.ConfigRuntime.Msh.StartQuorum.Bypass = []string{"Admin"}
+
+	for _, test := range []struct {
+		player  string
+		ok      bool
+		missing int
+		waiting []string
+	}{
+		{"Steve", false, 2, []string{"Steve"}},
+		{"Steve", false, 2, []string{"Steve"}}, // repeated join: counted once
+		{"Alex", false, 1, []string{"Alex", "Steve"}},
+		{"Notch", true, 0, nil},                // quorum reached
+		{"Steve", false, 2, []string{"Steve"}}, // waiting list cleared
+		{"admin", true, 0, nil},                // bypass (case insensitive)
+		{"Alex", false, 2, []string{"Alex"}},   // waiting list cleared by bypass
+	} {
+		ok, missing, waiting := q.check(test.player)
+		if ok != test.ok || missing != test.missing || strings.Join(waiting, ",") != strings.Join(test.waiting, ",") {
+			t.Errorf("%s: received (%t, %d, %v), expected (%t, %d, %v)", test.player, ok, missing, waiting, test.ok, test.missing, test.waiting)
+		}
+	}
+
+	// sliding window: join attempts older than the window are not counted
+	q.m.Lock()
+	q.waiting["Alex"] = time.Now().Add(-61 * time.Second)
+	q.waiting["Steve"] = time.Now().Add(-30 * time.Second)
+	q.m.Unlock()
+	if ok, missing, waiting := q.check("Notch"); ok || missing != 1 || strings.Join(waiting, ",") != "Notch,Steve" {
+		t.Errorf("sliding window: received (%t, %d, %v)", ok, missing, waiting)
+	}
+
+	// message lists who is waiting
+	if mes := quorumMessage(1, []string{"Notch", "Steve"}); mes != "Waiting for 1 more player(s) to start the server\nplayers waiting: Notch, Steve" {
+		t.Errorf("unexpected message %q", mes)
+	}
+
+	// QuorumReset clears the waiting list
+	quorum.check("Steve")
+	if s := QuorumStatus(); !strings.HasPrefix(s, "start quorum: 1/3 players waiting [Steve]") {
+		t.Errorf("unexpected status %q", s)
+	}
+	QuorumReset()
+	if s := QuorumStatus(); !strings.HasPrefix(s, "start quorum: 0/3 players waiting []") {
+		t.Errorf("unexpected status after reset %q", s)
+	}
+}
@@ -0,0 +1,278 @@
+package conn
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/servctrl"
+	"msh/lib/servstats"
+	"msh/lib/utility"
+)
+
+// rcon endpoint policies for commands that are not msh commands
+const (
+	RCON_POLICY_WAKE   string = "wake"   // warm ms (if hibernating) and forward the command
+	RCON_POLICY_REFUSE string = "refuse" // forward the command only if ms is online
+)
+
+const (
+	rconIdleTimeout time.Duration = 10 * time.Minute // rcon client connection is closed after this idle time
+	rconWakeTimeout time.Duration = 5 * time.Minute  // max time to wait for ms to be online before forwarding a command
+	rconChunk       int           = 4096             // max body length of a rcon response packet
+	rconAuthDelay   time.Duration = 1 * time.Second  // delay of the response to a failed authentication
+	rconAuthRate    float64       = 1.0 / 60         // failed authentications/s allowed for each client ip
+	rconAuthBurst   float64       = 5                // failed authentications allowed in a burst for each client ip
+)
+
+// rlimit is the rate limiter of rcon authentication failures
+var rlimit *queryLimiter = &queryLimiter{
+	m:       &sync.Mutex{},
+	rate:    rconAuthRate,
+	burst:   rconAuthBurst,
+	sources: map[string]*querySource{},
+}
+
+// HandlerRcon listens for rcon clients (admin tools, bots, panels) on the rcon endpoint port.
+//
+// Clients are authenticated with RconEndpoint.Password.
+// msh commands (msh status, msh start, msh freeze) are handled by msh,
+// other commands are forwarded to ms according to RconEndpoint.Policy.
+//
+// [goroutine]
+func HandlerRcon() {
+	if config.ConfigRuntime.Msh.RconEndpoint.Password == "" {
+		errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_RCON_ENDPOINT, "rcon endpoint password not set: rcon endpoint disabled")
+		return
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.MshHost, config.ConfigRuntime.Msh.RconEndpoint.Port))
+	if err != nil {
+		errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_RCON_ENDPOINT, "rcon endpoint listen: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "%-40s %10s:%5d ...", "listening for rcon clients on", config.MshHost, config.ConfigRuntime.Msh.RconEndpoint.Port)
+
+	for {
+		rconConn, err := listener.Accept()
+		if err != nil {
+			errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON_ENDPOINT, "rcon endpoint accept: %s", err.Error())
+			continue
+		}
+
+		go handleRcon(rconConn)
+	}
+}
+
+// handleRcon handles a rcon client connection
+// [goroutine]
+func handleRcon(rconConn net.Conn) {
+	defer rconConn.Close()
+
+	r := bufio.NewReader(rconConn)
+	authenticated := false
+
+	for {
+		rconConn.SetReadDeadline(time.Now().Add(rconIdleTimeout))
+
+		id, packetType, body, err := servctrl.ReadRconPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case packetType == servctrl.RconTypeAuth:
+			// clients that failed authentication too many times are refused without checking the password
+			if rlimit.limited(rconConn.RemoteAddr().String(), time.Now()) {
+				errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_RCON_ENDPOINT, "rcon client %s: too many failed authentications", rconConn.RemoteAddr())
+				time.Sleep(rconAuthDelay)
+				servctrl.WriteRconPacket(rconConn, -1, servctrl.RconTypeCommand, "")
+				return
+			}
+
+			if subtle.ConstantTimeCompare([]byte(body), []byte(config.ConfigRuntime.Msh.RconEndpoint.Password)) != 1 {
+				errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_RCON_ENDPOINT, "rcon client %s: authentication failed", rconConn.RemoteAddr())
+				rlimit.allow(rconConn.RemoteAddr().String(), time.Now())
+				time.Sleep(rconAuthDelay)
+				servctrl.WriteRconPacket(rconConn, -1, servctrl.RconTypeCommand, "")
+				return
+			}
+
+			authenticated = true
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_2, errco.ERROR_NIL, "rcon client %s: authenticated", rconConn.RemoteAddr())
+			servctrl.WriteRconPacket(rconConn, id, servctrl.RconTypeCommand, "")
+
+		case !authenticated:
+			// commands are not accepted before authentication
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_RCON_ENDPOINT, "rcon client %s: request before authentication", rconConn.RemoteAddr())
+			return
+
+		case packetType == servctrl.RconTypeCommand:
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_2, errco.ERROR_NIL, "rcon client %s: %s%s%s", rconConn.RemoteAddr(), errco.COLOR_CYAN, body, errco.COLOR_RESET)
+
+			out := rconCommand(body)
+
+			// split long responses in multiple packets (same as ms)
+			for {
+				n := len(out)
+				if n > rconChunk {
+					n = rconChunk
+				}
+				if err := servctrl.WriteRconPacket(rconConn, id, servctrl.RconTypeResponse, out[:n]); err != nil {
+					return
+				}
+				out = out[n:]
+				if out == "" {
+					break
+				}
+			}
+
+		default:
+			// answer unknown packet types as ms does
+			// (clients send them to detect the end of multi-packet responses)
+			servctrl.WriteRconPacket(rconConn, id, servctrl.RconTypeResponse, fmt.Sprintf("Unknown request %x", packetType))
+		}
+	}
+}
+
+// rconCommand executes a command received by the rcon endpoint and returns its output
+func rconCommand(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// msh commands
+	if fields[0] == "msh" {
+		if len(fields) < 2 {
+			return "specify msh command (status - players - start - freeze)"
+		}
+
+		switch fields[1] {
+		case "status":
+			return StatusDescription()
+		case "players":
+			return PlayersDescription()
+		case "start":
+			if traffic.capped() {
+				return dataCapMessage()
+			}
+			if logMsh := servctrl.WarmMS(); logMsh != nil && logMsh.Cod != errco.ERROR_SERVER_STARTING {
+				logMsh.Log(true)
+				return "error: " + fmt.Sprintf(logMsh.Mex, logMsh.Arg...)
+			}
+			return "minecraft server is starting"
+		case "freeze":
+			if logMsh := servctrl.FreezeMS(true); logMsh != nil {
+				logMsh.Log(true)
+				return "error: " + fmt.Sprintf(logMsh.Mex, logMsh.Arg...)
+			}
+			return "minecraft server is stopping"
+		default:
+			return "unknown msh command (status - players - start - freeze)"
+		}
+	}
+
+	// ms commands
+	if servctrl.CheckMSWarm() != nil {
+		if config.ConfigRuntime.Msh.RconEndpoint.Policy != RCON_POLICY_WAKE {
+			return "minecraft server is hibernating: command refused (use \"msh start\" to warm it)"
+		}
+
+		logMsh := rconWake()
+		if logMsh != nil {
+			logMsh.Log(true)
+			return "error: " + fmt.Sprintf(logMsh.Mex, logMsh.Arg...)
+		}
+	}
+
+	out, logMsh := servctrl.Execute(command)
+	if logMsh != nil {
+		logMsh.Log(true)
+		return "error: " + fmt.Sprintf(logMsh.Mex, logMsh.Arg...)
+	}
+
+	return out
+}
+
+// rconWake warms ms and waits for it to be online (at most rconWakeTimeout)
+func rconWake() *errco.MshLog {
+	if traffic.capped() {
+		return errco.NewLog(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_DATA_CAP, "data cap reached: minecraft server can't be warmed until %s", nextCycleDate())
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "rcon command received while hibernating: warming minecraft server...")
+
+	// if ms start is already in progress, wait for it
+	logMsh := servctrl.WarmMS()
+	if logMsh != nil && logMsh.Cod != errco.ERROR_SERVER_STARTING {
+		return logMsh.AddTrace()
+	}
+
+	deadline := time.Now().Add(rconWakeTimeout)
+	for servctrl.CheckMSWarm() != nil {
+		if time.Now().After(deadline) {
+			return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_SERVER_NOT_ONLINE, "minecraft server did not reach online status in %s", rconWakeTimeout)
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	return nil
+}
+
+// StatusDescription returns a description of msh and ms status
+func StatusDescription() string {
+	status, eta := mshStatus()
+
+	lines := []string{}
+
+	switch {
+	case status == "starting" && eta >= 0:
+		lines = append(lines, fmt.Sprintf("minecraft server: %s (ready in ~%ds)", status, eta))
+	case status == "hibernating" && eta > 0:
+		lines = append(lines, fmt.Sprintf("minecraft server: %s (startup time ~%ds)", status, eta))
+	default:
+		lines = append(lines, fmt.Sprintf("minecraft server: %s", status))
+	}
+
+	if servstats.Stats.MajorError != nil {
+		lines = append(lines, "major error: "+fmt.Sprintf(servstats.Stats.MajorError.Mex, servstats.Stats.MajorError.Arg...))
+	}
+
+	if servstats.Stats.Watchdog != "" {
+		lines = append(lines, "watchdog: "+servstats.Stats.Watchdog)
+	}
+
+	if uptime := servctrl.WarmUpTime(); uptime >= 0 {
+		lines = append(lines, fmt.Sprintf("warm since: %ds", uptime))
+	}
+
+	lines = append(lines, fmt.Sprintf("proxied connections: %d", servstats.Stats.ConnCount))
+	lines = append(lines, fmt.Sprintf("online players: %d", len(servstats.Players.List())))
+
+	return strings.Join(lines, "\n")
+}
+
+// PlayersDescription returns a description of the players online on ms (player registry)
+func PlayersDescription() string {
+	players := servstats.Players.List()
+	if len(players) == 0 {
+		return "online players: 0"
+	}
+
+	lines := []string{fmt.Sprintf("online players: %d", len(players))}
+	for _, p := range players {
+		lines = append(lines, fmt.Sprintf("%s\n\tuuid: %s\n\tonline for: %s\n\taddress: %s\n\tsource: %s",
+			p.Name, utility.FirstNon("", p.UUID, "-"), time.Since(p.JoinTime).Round(time.Second), utility.FirstNon("", p.Address, "-"), p.Source))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,83 @@
+package conn
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"msh/lib/config"
+	"msh/lib/servctrl"
+)
+
+func Test_handleRcon(t *testing.T) {
+	config.ConfigRuntime.Msh.RconEndpoint.Password = "secret"
+	config.ConfigRuntime.Msh.RconEndpoint.Policy = RCON_POLICY_REFUSE
+	defer func() { config.ConfigRuntime.Msh.RconEndpoint.Password = "" }()
+
+	resetLimit := func() {
+		rlimit.m.Lock()
+		rlimit.sources = map[string]*querySource{}
+		rlimit.m.Unlock()
+	}
+	resetLimit()
+	defer resetLimit()
+
+	// wrong password: auth fails and connection is closed
+	client, endpoint := net.Pipe()
+	go handleRcon(endpoint)
+
+	go servctrl.WriteRconPacket(client, 1, servctrl.RconTypeAuth, "wrong")
+	if id, _, _, err := servctrl.ReadRconPacket(client); err != nil || id != -1 {
+		t.Errorf("wrong password: received (%d, %v), expected -1", id, err)
+	}
+	client.Close()
+
+	// too many failed authentications: correct password is refused
+	rlimit.m.Lock()
+	if src := rlimit.sources[endpoint.RemoteAddr().String()]; src == nil || src.tokens != rconAuthBurst-1 {
+		t.Errorf("wrong password: failed authentication not counted (%+v)", src)
+	}
+	for _, src := range rlimit.sources {
+		src.tokens = 0
+	}
+	rlimit.m.Unlock()
+
+	client, endpoint = net.Pipe()
+	go handleRcon(endpoint)
+
+	go servctrl.WriteRconPacket(client, 1, servctrl.RconTypeAuth, "secret")
+	if id, _, _, err := servctrl.ReadRconPacket(client); err != nil || id != -1 {
+		t.Errorf("too many failed authentications: received (%d, %v), expected -1", id, err)
+	}
+	client.Close()
+	resetLimit()
+
+	// correct password
+	client, endpoint = net.Pipe()
+	defer client.Close()
+	go handleRcon(endpoint)
+
+	go servctrl.WriteRconPacket(client, 1, servctrl.RconTypeAuth, "secret")
+	if id, _, _, err := servctrl.ReadRconPacket(client); err != nil || id != 1 {
+		t.Fatalf("correct password: received (%d, %v), expected 1", id, err)
+	}
+
+	tests := []struct {
+		command string
+		exp     string
+	}{
+		{"msh status", "minecraft server: hibernating"},
+		{"msh unknown", "unknown msh command"},
+		{"say hello", "command refused"},
+	}
+
+	for i, test := range tests {
+		id := int32(i + 2)
+		go servctrl.WriteRconPacket(client, id, servctrl.RconTypeCommand, test.command)
+
+		respID, respType, body, err := servctrl.ReadRconPacket(client)
+		if err != nil || respID != id || respType != servctrl.RconTypeResponse || !strings.Contains(body, test.exp) {
+			t.Errorf("%s: received (%d, %d, %q, %v), expected response containing %q", test.command, respID, respType, body, err, test.exp)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package conn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/utility"
+)
+
+func init() {
+	go printThrottle()
+}
+
+// tokenBucket is a token bucket bandwidth limiter.
+//
+// Tokens (bytes) are refilled at the bucket rate up to the bucket burst.
+// A packet consumes its size in tokens: if there are enough tokens it is not delayed,
+// otherwise it must wait for the missing tokens to be refilled.
+type tokenBucket struct {
+	m         *sync.Mutex
+	rate      float64       // refill rate in bytes/s (<= 0: unlimited)
+	burst     float64       // max tokens in the bucket
+	tokens    float64       // available tokens (negative if there are reserved tokens to be refilled)
+	last      time.Time     // time of the last refill
+	bytes     int64         // total bytes passed through the bucket
+	throttled time.Duration // total time packets were delayed
+}
+
+// newTokenBucket returns a token bucket with the specified rate in KB/s (<= 0: unlimited).
+// The burst is 1 second of traffic (the bucket starts full).
+func newTokenBucket(rateKB int) *tokenBucket {
+	rate := float64(rateKB) * 1024
+	return &tokenBucket{
+		m:      &sync.Mutex{},
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// reserve consumes n tokens and returns the time the caller must wait before sending n bytes.
+// If the bucket has enough tokens, 0 is returned (no latency is added).
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.bytes += int64(n)
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	// refill tokens
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.throttled += wait
+
+	return wait
+}
+
+// stats returns the bucket total bytes and total throttled time
+func (b *tokenBucket) stats() (int64, time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.bytes, b.throttled
+}
+
+// String returns a description of the bucket state
+func (b *tokenBucket) String() string {
+	bytes, throttled := b.stats()
+
+	limit := "unlimited"
+	if b.rate > 0 {
+		limit = fmt.Sprintf("%.0f KB/s", b.rate/1024)
+	}
+
+	return fmt.Sprintf("limit %s, %.1f KB sent, %s throttled", limit, float64(bytes)/1024, throttled.Round(time.Millisecond))
+}
+
+// proxyLimits contains the bandwidth limiters of a proxied connection
+type proxyLimits struct {
+	clientAddress string
+	playerName    string
+	toClients     *tokenBucket // per connection limiter (server -> client)
+	toServer      *tokenBucket // per connection limiter (client -> server)
+}
+
+// throttle contains the global bandwidth limiters and the limiters of proxied connections
+var throttle = struct {
+	m         *sync.Mutex
+	once      sync.Once
+	toClients *tokenBucket // global limiter (server -> clients)
+	toServer  *tokenBucket // global limiter (clients -> server)
+	conns     map[*proxyLimits]bool
+}{
+	m:     &sync.Mutex{},
+	conns: map[*proxyLimits]bool{},
+}
+
+// globalLimits initializes (only the first time it's called) and returns the global limiters.
+// (global limiters can't be initialized at package init since config is not loaded yet)
+func globalLimits() (*tokenBucket, *tokenBucket) {
+	throttle.once.Do(func() {
+		throttle.toClients = newTokenBucket(config.ConfigRuntime.Msh.Throttle.GlobalToClients)
+		throttle.toServer = newTokenBucket(config.ConfigRuntime.Msh.Throttle.GlobalToServer)
+	})
+
+	return throttle.toClients, throttle.toServer
+}
+
+// newProxyLimits returns and registers the limiters of a new proxied connection
+func newProxyLimits(clientAddress, playerName string) *proxyLimits {
+	pl := &proxyLimits{
+		clientAddress: clientAddress,
+		playerName:    playerName,
+		toClients:     newTokenBucket(config.ConfigRuntime.Msh.Throttle.ConnToClients),
+		toServer:      newTokenBucket(config.ConfigRuntime.Msh.Throttle.ConnToServer),
+	}
+
+	throttle.m.Lock()
+	throttle.conns[pl] = true
+	throttle.m.Unlock()
+
+	return pl
+}
+
+// remove unregisters the limiters of a closed proxied connection
+func (pl *proxyLimits) remove() {
+	throttle.m.Lock()
+	delete(throttle.conns, pl)
+	throttle.m.Unlock()
+}
+
+// wait waits the time needed to send n bytes without exceeding per connection and global limits
+func (pl *proxyLimits) wait(n int, isServerToClient bool) {
+	globalToClients, globalToServer := globalLimits()
+
+	var connWait, globalWait time.Duration
+	if isServerToClient {
+		connWait, globalWait = pl.toClients.reserve(n), globalToClients.reserve(n)
+	} else {
+		connWait, globalWait = pl.toServer.reserve(n), globalToServer.reserve(n)
+	}
+
+	wait := connWait
+	if globalWait > wait {
+		wait = globalWait
+	}
+
+	if wait > 0 {
+		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "throttling %s (%d bytes): waiting %s", pl.clientAddress, n, wait)
+		time.Sleep(wait)
+	}
+}
+
+// ThrottleStatus returns a description of the bandwidth limiters state
+func ThrottleStatus() string {
+	globalToClients, globalToServer := globalLimits()
+
+	throttle.m.Lock()
+	defer throttle.m.Unlock()
+
+	lines := []string{
+		"global to clients: " + globalToClients.String(),
+		"global to server:  " + globalToServer.String(),
+	}
+
+	conns := []string{}
+	for pl := range throttle.conns {
+		conns = append(conns, fmt.Sprintf("%s (%s)\n\tto client: %s\n\tto server: %s", pl.clientAddress, utility.FirstNon("", pl.playerName, "-"), pl.toClients, pl.toServer))
+	}
+	sort.Strings(conns)
+
+	lines = append(lines, fmt.Sprintf("proxied connections: %d", len(conns)))
+	lines = append(lines, conns...)
+
+	return strings.Join(lines, "\n")
+}
+
+// printThrottle logs the time packets were delayed by the global limiters every 10 seconds.
+//
+// Logging is skipped if no packet was delayed.
+//
+// [goroutine]
+func printThrottle() {
+	var lastToClients, lastToServer time.Duration
+
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		<-ticker.C
+
+		if config.ConfigRuntime.Msh.Throttle.GlobalToClients <= 0 && config.ConfigRuntime.Msh.Throttle.GlobalToServer <= 0 {
+			continue
+		}
+
+		globalToClients, globalToServer := globalLimits()
+		_, toClients := globalToClients.stats()
+		_, toServer := globalToServer.stats()
+
+		if toClients != lastToClients || toServer != lastToServer {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "bandwidth limit reached: traffic delayed by %s to clients | %s to server (last 10s)", (toClients - lastToClients).Round(time.Millisecond), (toServer - lastToServer).Round(time.Millisecond))
+		}
+
+		lastToClients, lastToServer = toClients, toServer
+	}
+}
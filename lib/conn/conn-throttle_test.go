@@ -0,0 +1,38 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_tokenBucket(t *testing.T) {
+	// unlimited bucket never delays packets
+	b := newTokenBucket(0)
+	for i := 0; i < 100; i++ {
+		if wait := b.reserve(1 << 20); wait != 0 {
+			t.Fatalf("unlimited bucket: received wait %s, expected 0", wait)
+		}
+	}
+
+	// limited bucket (1 KB/s, burst 1 KB)
+	b = newTokenBucket(1)
+
+	// packets within burst are not delayed
+	if wait := b.reserve(512); wait != 0 {
+		t.Errorf("packet within burst: received wait %s, expected 0", wait)
+	}
+	if wait := b.reserve(512); wait != 0 {
+		t.Errorf("packet within burst: received wait %s, expected 0", wait)
+	}
+
+	// packet exceeding burst must wait for missing tokens (512 bytes at 1 KB/s = ~500ms)
+	wait := b.reserve(512)
+	if wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("packet exceeding burst: received wait %s, expected ~500ms", wait)
+	}
+
+	bytes, throttled := b.stats()
+	if bytes != 1536 || throttled != wait {
+		t.Errorf("stats: received (%d, %s), expected (%d, %s)", bytes, throttled, 1536, wait)
+	}
+}
@@ -0,0 +1,324 @@
+package conn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+	"msh/lib/servctrl"
+	"msh/lib/servstats"
+)
+
+const (
+	trafficFileName string        = "msh-traffic.json" // trafficFileName is the traffic totals file name
+	trafficDaysKept int           = 62                 // number of daily totals kept in traffic file
+	trafficCheck    time.Duration = 10 * time.Second   // time interval between data cap checks
+	trafficBatch    int           = 64 * 1024          // bytes of a proxied connection added to traffic totals at once
+)
+
+// data cap actions
+const (
+	DATACAP_REFUSE string = "refuse" // refuse to warm ms when data cap is reached
+	DATACAP_FREEZE string = "freeze" // freeze ms (and refuse to warm it) when data cap is reached
+)
+
+func init() {
+	go checkTraffic()
+}
+
+// traffic contains the daily and billing cycle traffic totals
+var traffic *trafficCounter = &trafficCounter{m: &sync.Mutex{}}
+
+// trafficCounter represents the persistent traffic totals
+type trafficCounter struct {
+	m      *sync.Mutex
+	loaded bool                 // traffic totals have been loaded from file
+	totals *model.TrafficTotals // traffic totals
+	dirty  bool                 // traffic totals have changed since last save
+}
+
+// add adds bytes to the traffic totals (both directions are counted).
+// Traffic is counted even if no data cap is set.
+func (tc *trafficCounter) add(n int) {
+	if n <= 0 {
+		return
+	}
+
+	tc.m.Lock()
+	defer tc.m.Unlock()
+
+	tc.load()
+	tc.rollover(time.Now())
+
+	tc.totals.Cycle += int64(n)
+	tc.totals.Days[time.Now().Format("2006-01-02")] += int64(n)
+	tc.dirty = true
+}
+
+// capped returns true if the billing cycle data cap has been reached
+func (tc *trafficCounter) capped() bool {
+	capBytes := dataCapBytes()
+	if capBytes <= 0 {
+		return false
+	}
+
+	tc.m.Lock()
+	defer tc.m.Unlock()
+
+	tc.load()
+	tc.rollover(time.Now())
+
+	return tc.totals.Cycle >= capBytes
+}
+
+// load loads the traffic totals from file (only the first time it's called).
+// (trafficCounter mutex should be locked by caller function)
+func (tc *trafficCounter) load() {
+	if tc.loaded {
+		return
+	}
+	tc.loaded = true
+	tc.totals = &model.TrafficTotals{Days: map[string]int64{}}
+
+	data, err := os.ReadFile(trafficFileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_TRAFFIC_LOAD, err.Error())
+		return
+	}
+
+	err = json.Unmarshal(data, tc.totals)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_TRAFFIC_LOAD, "traffic file format error: %s", err.Error())
+		tc.totals = &model.TrafficTotals{Days: map[string]int64{}}
+		return
+	}
+
+	if tc.totals.Days == nil {
+		tc.totals.Days = map[string]int64{}
+	}
+}
+
+// rollover resets the billing cycle total if a new billing cycle has started
+// and removes old daily totals.
+// (trafficCounter mutex should be locked by caller function)
+func (tc *trafficCounter) rollover(now time.Time) {
+	start := cycleStart(now, config.ConfigRuntime.Msh.DataCap.CycleDay).Format("2006-01-02")
+	if tc.totals.CycleStart == start {
+		return
+	}
+
+	// totals without a previous cycle are not marked as changed
+	// (traffic file is not created until some traffic is counted)
+	if tc.totals.CycleStart != "" {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "new billing cycle started (previous cycle traffic: %s)", formatBytes(tc.totals.Cycle))
+		tc.dirty = true
+	}
+
+	tc.totals.CycleStart = start
+	tc.totals.Cycle = 0
+	tc.totals.Warned = 0
+
+	for day := range tc.totals.Days {
+		if d, err := time.ParseInLocation("2006-01-02", day, now.Location()); err != nil || now.Sub(d) > time.Duration(trafficDaysKept)*24*time.Hour {
+			delete(tc.totals.Days, day)
+		}
+	}
+}
+
+// save saves the traffic totals to file (only if they changed).
+// (trafficCounter mutex should be locked by caller function)
+func (tc *trafficCounter) save() {
+	if !tc.dirty {
+		return
+	}
+
+	data, err := json.MarshalIndent(tc.totals, "", "  ")
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_TRAFFIC_SAVE, err.Error())
+		return
+	}
+
+	err = os.WriteFile(trafficFileName, data, 0644)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_TRAFFIC_SAVE, err.Error())
+		return
+	}
+
+	tc.dirty = false
+}
+
+// persist rolls over and saves the traffic totals (only if they changed).
+// Returns the billing cycle total and the last data cap threshold warned.
+func (tc *trafficCounter) persist() (int64, int) {
+	tc.m.Lock()
+	defer tc.m.Unlock()
+
+	tc.load()
+	tc.rollover(time.Now())
+	tc.save()
+
+	return tc.totals.Cycle, tc.totals.Warned
+}
+
+// saveTraffic saves the traffic totals to file (only if they changed)
+func saveTraffic() {
+	traffic.m.Lock()
+	defer traffic.m.Unlock()
+
+	if !traffic.loaded {
+		return
+	}
+
+	traffic.save()
+}
+
+// checkTraffic periodically saves the traffic totals and checks the data cap.
+//
+// Players and log are warned at 80% and 95% of the data cap.
+// When the data cap is reached, ms is frozen if DataCap.Action is "freeze".
+//
+// [goroutine]
+func checkTraffic() {
+	ticker := time.NewTicker(trafficCheck)
+	for {
+		<-ticker.C
+
+		cycle, warned := traffic.persist()
+
+		capBytes := dataCapBytes()
+		if capBytes <= 0 {
+			continue
+		}
+
+		percent := int(cycle * 100 / capBytes)
+
+		// warn players and log only once for each threshold
+		var threshold int
+		switch {
+		case percent >= 100:
+			threshold = 100
+		case percent >= 95:
+			threshold = 95
+		case percent >= 80:
+			threshold = 80
+		}
+		if threshold <= warned {
+			continue
+		}
+
+		traffic.m.Lock()
+		traffic.totals.Warned = threshold
+		traffic.dirty = true
+		traffic.m.Unlock()
+
+		if threshold < 100 {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_DATA_CAP, "data cap: %d%% used (%s of %s)", percent, formatBytes(cycle), formatBytes(capBytes))
+			if logMsh := servctrl.TellRaw("data cap", fmt.Sprintf("%d%% of monthly data used", percent), "checkTraffic"); logMsh != nil {
+				logMsh.Log(true)
+			}
+			continue
+		}
+
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_DATA_CAP, "data cap reached (%s of %s): minecraft server can't be warmed until %s", formatBytes(cycle), formatBytes(capBytes), nextCycleDate())
+
+		if config.ConfigRuntime.Msh.DataCap.Action != DATACAP_FREEZE || servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE {
+			continue
+		}
+
+		if logMsh := servctrl.TellRaw("data cap", "monthly data cap reached, the server is stopping", "checkTraffic"); logMsh != nil {
+			logMsh.Log(true)
+		}
+		if logMsh := servctrl.FreezeMS(true); logMsh != nil {
+			logMsh.Log(true)
+		}
+	}
+}
+
+// dataCapMessage returns the message shown to clients when the data cap is reached
+func dataCapMessage() string {
+	return fmt.Sprintf("Monthly data cap reached\nserver available again on %s", nextCycleDate())
+}
+
+// nextCycleDate returns the start date of the next billing cycle
+func nextCycleDate() string {
+	return cycleStart(time.Now(), config.ConfigRuntime.Msh.DataCap.CycleDay).AddDate(0, 1, 0).Format("2006-01-02")
+}
+
+// dataCapBytes returns the data cap in bytes (<= 0: disabled)
+func dataCapBytes() int64 {
+	return int64(config.ConfigRuntime.Msh.DataCap.Cap) * 1024 * 1024
+}
+
+// cycleStart returns the start of the billing cycle containing t.
+// cycleDay is the day of month on which billing cycles start (clamped to 1-28).
+func cycleStart(t time.Time, cycleDay int) time.Time {
+	switch {
+	case cycleDay < 1:
+		cycleDay = 1
+	case cycleDay > 28:
+		cycleDay = 28
+	}
+
+	start := time.Date(t.Year(), t.Month(), cycleDay, 0, 0, 0, 0, t.Location())
+	if t.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+
+	return start
+}
+
+// formatBytes returns a human readable description of bytes (example: 1536 -> "1.5 KB")
+func formatBytes(b int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	v := float64(b)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+// TrafficStats returns a description of the daily and billing cycle traffic totals
+func TrafficStats() string {
+	traffic.m.Lock()
+	defer traffic.m.Unlock()
+
+	traffic.load()
+	traffic.rollover(time.Now())
+
+	lines := []string{}
+
+	capBytes := dataCapBytes()
+	if capBytes > 0 {
+		lines = append(lines, fmt.Sprintf("billing cycle (since %s): %s of %s (%d%%)", traffic.totals.CycleStart, formatBytes(traffic.totals.Cycle), formatBytes(capBytes), traffic.totals.Cycle*100/capBytes))
+	} else {
+		lines = append(lines, fmt.Sprintf("billing cycle (since %s): %s (no data cap)", traffic.totals.CycleStart, formatBytes(traffic.totals.Cycle)))
+	}
+
+	days := []string{}
+	for day := range traffic.totals.Days {
+		days = append(days, day)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(days)))
+	if len(days) > 7 {
+		days = days[:7]
+	}
+	for _, day := range days {
+		lines = append(lines, fmt.Sprintf("%s: %s", day, formatBytes(traffic.totals.Days[day])))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,98 @@
+package conn
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+func Test_trafficAdd(t *testing.T) {
+	// reset traffic totals (loaded again from file)
+	reset := func() {
+		traffic.m.Lock()
+		traffic.loaded, traffic.totals, traffic.dirty = false, nil, false
+		traffic.m.Unlock()
+	}
+
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer func() {
+		config.ConfigRuntime.Msh.DataCap.Cap = 0
+		reset()
+		os.Chdir(wd)
+	}()
+	reset()
+
+	// no traffic: traffic file is not created
+	config.ConfigRuntime.Msh.DataCap.Cap = 0
+	traffic.persist()
+	saveTraffic()
+	if _, err := os.Stat(trafficFileName); !os.IsNotExist(err) {
+		t.Errorf("traffic file created without traffic (%v)", err)
+	}
+
+	// data cap disabled: traffic is counted and saved
+	traffic.add(1024)
+	traffic.add(512)
+	if traffic.totals.Cycle != 1536 || traffic.totals.Days[time.Now().Format("2006-01-02")] != 1536 {
+		t.Errorf("unexpected traffic totals %+v", traffic.totals)
+	}
+
+	traffic.persist()
+	if data, err := os.ReadFile(trafficFileName); err != nil || !strings.Contains(string(data), "1536") {
+		t.Errorf("traffic totals not saved: %q", data)
+	}
+
+	// data cap enabled: traffic totals are loaded from file
+	config.ConfigRuntime.Msh.DataCap.Cap = 1
+	reset()
+	traffic.add(512)
+	if cycle, _ := traffic.persist(); cycle != 2048 || traffic.capped() {
+		t.Errorf("unexpected traffic totals %+v", traffic.totals)
+	}
+}
+
+func Test_cycleStart(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		t        time.Time
+		cycleDay int
+		exp      time.Time
+	}{
+		{date(2026, 3, 15), 1, date(2026, 3, 1)},
+		{date(2026, 3, 15), 15, date(2026, 3, 15)},
+		{date(2026, 3, 14), 15, date(2026, 2, 15)},
+		{date(2026, 1, 5), 10, date(2025, 12, 10)},
+		{date(2026, 3, 31), 31, date(2026, 3, 28)}, // cycle day clamped to 28
+		{date(2026, 3, 31), 0, date(2026, 3, 1)},   // cycle day clamped to 1
+	}
+
+	for _, test := range tests {
+		if start := cycleStart(test.t, test.cycleDay); !start.Equal(test.exp) {
+			t.Errorf("%s (cycle day %d): received %s, expected %s", test.t.Format("2006-01-02"), test.cycleDay, start.Format("2006-01-02"), test.exp.Format("2006-01-02"))
+		}
+	}
+}
+
+func Test_formatBytes(t *testing.T) {
+	tests := []struct {
+		b   int64
+		exp string
+	}{
+		{0, "0.0 B"},
+		{1536, "1.5 KB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GB"},
+	}
+
+	for _, test := range tests {
+		if s := formatBytes(test.b); s != test.exp {
+			t.Errorf("%d: received %q, expected %q", test.b, s, test.exp)
+		}
+	}
+}
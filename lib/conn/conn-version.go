@@ -0,0 +1,254 @@
+package conn
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/utility"
+)
+
+// protVersion represents a minecraft protocol number and the range of releases using it
+type protVersion struct {
+	prot  int    // protocol number
+	first string // first release using the protocol number
+	last  string // last release using the protocol number
+}
+
+// protVersions contains the protocol numbers of minecraft releases (sorted by protocol number).
+//
+// (checkout protocol version numbers: https://wiki.vg/Protocol_version_numbers)
+var protVersions []protVersion = []protVersion{
+	{4, "1.7.2", "1.7.5"},
+	{5, "1.7.6", "1.7.10"},
+	{47, "1.8", "1.8.9"},
+	{107, "1.9", "1.9"},
+	{108, "1.9.1", "1.9.1"},
+	{109, "1.9.2", "1.9.2"},
+	{110, "1.9.3", "1.9.4"},
+	{210, "1.10", "1.10.2"},
+	{315, "1.11", "1.11"},
+	{316, "1.11.1", "1.11.2"},
+	{335, "1.12", "1.12"},
+	{338, "1.12.1", "1.12.1"},
+	{340, "1.12.2", "1.12.2"},
+	{393, "1.13", "1.13"},
+	{401, "1.13.1", "1.13.1"},
+	{404, "1.13.2", "1.13.2"},
+	{477, "1.14", "1.14"},
+	{480, "1.14.1", "1.14.1"},
+	{485, "1.14.2", "1.14.2"},
+	{490, "1.14.3", "1.14.3"},
+	{498, "1.14.4", "1.14.4"},
+	{573, "1.15", "1.15"},
+	{575, "1.15.1", "1.15.1"},
+	{578, "1.15.2", "1.15.2"},
+	{735, "1.16", "1.16"},
+	{736, "1.16.1", "1.16.1"},
+	{751, "1.16.2", "1.16.2"},
+	{753, "1.16.3", "1.16.3"},
+	{754, "1.16.4", "1.16.5"},
+	{755, "1.17", "1.17"},
+	{756, "1.17.1", "1.17.1"},
+	{757, "1.18", "1.18.1"},
+	{758, "1.18.2", "1.18.2"},
+	{759, "1.19", "1.19"},
+	{760, "1.19.1", "1.19.2"},
+	{761, "1.19.3", "1.19.3"},
+	{762, "1.19.4", "1.19.4"},
+	{763, "1.20", "1.20.1"},
+	{764, "1.20.2", "1.20.2"},
+	{765, "1.20.3", "1.20.4"},
+	{766, "1.20.5", "1.20.6"},
+	{767, "1.21", "1.21.1"},
+	{768, "1.21.2", "1.21.3"},
+	{769, "1.21.4", "1.21.4"},
+	{770, "1.21.5", "1.21.5"},
+	{771, "1.21.6", "1.21.6"},
+	{772, "1.21.7", "1.21.8"},
+	{773, "1.21.9", "1.21.10"},
+}
+
+// protocolVersion returns the releases that use the specified protocol number
+// (example: 754 -> "1.16.4-1.16.5").
+//
+// If the protocol number is unknown, "" is returned.
+func protocolVersion(prot int) string {
+	for _, pv := range protVersions {
+		if pv.prot != prot {
+			continue
+		}
+
+		if pv.first == pv.last {
+			return pv.first
+		}
+
+		return pv.first + "-" + pv.last
+	}
+
+	return ""
+}
+
+// viaCacheTTL is the time for which the via plugins detection is cached
+const viaCacheTTL time.Duration = time.Minute
+
+// viaCache caches the result of viaRange (plugins folder is not read on every client request)
+var viaCache = struct {
+	m      *sync.Mutex
+	time   time.Time // time of the last plugins folder scan
+	folder string    // ms folder of the last scan
+	prot   int       // ms protocol of the last scan
+	min    int
+	max    int
+	newer  bool
+	ok     bool
+}{
+	m: &sync.Mutex{},
+}
+
+// viaRange returns the range of protocol numbers that are able to join the minecraft server
+// when ViaVersion-style plugins are installed in the minecraft server plugins folder.
+//
+// - ViaVersion:	allows newer clients to join
+//
+// - ViaBackwards:	allows older clients to join (down to 1.10)
+//
+// - ViaRewind:	allows older clients to join (down to 1.8, requires ViaBackwards)
+//
+// newer is true if clients newer than max can join too (ViaVersion supports protocols newer than msh protocol table).
+//
+// If no plugin is detected or the minecraft server protocol is unknown, ok is false.
+// The result is cached for viaCacheTTL.
+func viaRange() (min, max int, newer, ok bool) {
+	viaCache.m.Lock()
+	defer viaCache.m.Unlock()
+
+	folder, prot := config.ConfigRuntime.Server.Folder, config.ConfigRuntime.Server.Protocol
+
+	if time.Since(viaCache.time) < viaCacheTTL && viaCache.folder == folder && viaCache.prot == prot {
+		return viaCache.min, viaCache.max, viaCache.newer, viaCache.ok
+	}
+
+	min, max, newer, ok = scanViaPlugins(folder, prot)
+
+	// log only when detection changes
+	if ok && (!viaCache.ok || viaCache.min != min || viaCache.max != max) {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "via plugins detected (supported protocols: %d-%d)", min, max)
+	}
+
+	viaCache.time, viaCache.folder, viaCache.prot = time.Now(), folder, prot
+	viaCache.min, viaCache.max, viaCache.newer, viaCache.ok = min, max, newer, ok
+
+	return min, max, newer, ok
+}
+
+// scanViaPlugins reads ms plugins folder and returns the range of protocol numbers supported by via plugins
+func scanViaPlugins(folder string, servProt int) (min, max int, newer, ok bool) {
+	if servProt <= 0 {
+		return 0, 0, false, false
+	}
+
+	entries, err := os.ReadDir(filepath.Join(folder, "plugins"))
+	if err != nil {
+		// plugins folder does not exist (vanilla/modded server)
+		return 0, 0, false, false
+	}
+
+	var viaVersion, viaBackwards, viaRewind bool
+	for _, e := range entries {
+		name := strings.ToLower(e.Name())
+		if e.IsDir() || !strings.HasSuffix(name, ".jar") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(name, "viaversion"):
+			viaVersion = true
+		case strings.HasPrefix(name, "viabackwards"):
+			viaBackwards = true
+		case strings.HasPrefix(name, "viarewind"):
+			viaRewind = true
+		}
+	}
+
+	// via plugins not found
+	if !viaVersion && !viaBackwards && !viaRewind {
+		return 0, 0, false, false
+	}
+
+	min, max = servProt, servProt
+	if viaVersion {
+		max, newer = protVersions[len(protVersions)-1].prot, true
+	}
+	if viaBackwards && min > 210 {
+		min = 210 // 1.10
+	}
+	if viaBackwards && viaRewind && min > 47 {
+		min = 47 // 1.8
+	}
+
+	return min, max, newer, true
+}
+
+// protocolCompatible returns true if a client with the specified protocol number can join the minecraft server.
+//
+// Accepted protocols are: ms protocol, protocols in msh config ProtocolExtra, protocols supported by via plugins.
+//
+// If the minecraft server protocol is unknown, the client is considered compatible.
+func protocolCompatible(clientProt int) bool {
+	servProt := config.ConfigRuntime.Server.Protocol
+
+	switch {
+	case servProt <= 0:
+		return true
+	case clientProt == servProt:
+		return true
+	case utility.SliceContain(clientProt, config.ConfigRuntime.Msh.ProtocolExtra):
+		return true
+	}
+
+	if min, max, newer, ok := viaRange(); ok && min <= clientProt && (clientProt <= max || newer) {
+		return true
+	}
+
+	return false
+}
+
+// versionInfo returns the version name and protocol number that msh should report to a client
+// with the specified protocol number, when minecraft server is not able to answer by itself.
+//
+// If the client is compatible with the minecraft server, the client protocol is echoed
+// so that the client doesn't show the server as "outdated".
+//
+// If ViaVersion-style plugins are detected, the version name shows the supported range (example: "1.10-1.21.10").
+func versionInfo(clientProt int) (string, int) {
+	name := config.ConfigRuntime.Server.Version
+	prot := config.ConfigRuntime.Server.Protocol
+
+	if _, _, _, ok := viaRange(); ok {
+		name = versionRequired()
+	}
+
+	if clientProt > 0 && protocolCompatible(clientProt) {
+		prot = clientProt
+	}
+
+	return name, prot
+}
+
+// versionRequired returns a description of the minecraft versions that are able to join the minecraft server
+// (example: "1.19.1-1.19.2", "1.10-1.21.10").
+func versionRequired() string {
+	if min, max, _, ok := viaRange(); ok {
+		minVer, maxVer := protocolVersion(min), protocolVersion(max)
+		if minVer != "" && maxVer != "" {
+			return strings.Split(minVer, "-")[0] + "-" + maxVer[strings.LastIndex(maxVer, "-")+1:]
+		}
+	}
+
+	return utility.FirstNon("", protocolVersion(config.ConfigRuntime.Server.Protocol), config.ConfigRuntime.Server.Version)
+}
@@ -0,0 +1,72 @@
+package conn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+func Test_versionInfo(t *testing.T) {
+	// no plugins folder: via plugins are not detected
+	config.ConfigRuntime.Server.Folder = t.TempDir()
+	config.ConfigRuntime.Server.Version = "1.19.2"
+	config.ConfigRuntime.Server.Protocol = 760
+
+	tests := []struct {
+		clientProt int
+		expName    string
+		expProt    int
+	}{
+		{760, "1.19.2", 760}, // compatible client
+		{47, "1.19.2", 760},  // outdated client
+		{773, "1.19.2", 760}, // outdated server
+		{0, "1.19.2", 760},   // unknown client protocol
+	}
+
+	for _, test := range tests {
+		name, prot := versionInfo(test.clientProt)
+		if name != test.expName || prot != test.expProt {
+			t.Errorf("client protocol %d: received (%s, %d), expected (%s, %d)", test.clientProt, name, prot, test.expName, test.expProt)
+		}
+	}
+
+	// via plugins detected: supported range is reported
+	os.Mkdir(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins"), 0755)
+	os.WriteFile(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins", "ViaVersion-5.0.3.jar"), nil, 0644)
+	os.WriteFile(filepath.Join(config.ConfigRuntime.Server.Folder, "plugins", "ViaBackwards-5.0.3.jar"), nil, 0644)
+
+	// plugins folder scan is cached
+	if _, _, _, ok := viaRange(); ok {
+		t.Errorf("via plugins detected before cache expiration")
+	}
+	viaCache.time = time.Time{}
+
+	tests = []struct {
+		clientProt int
+		expName    string
+		expProt    int
+	}{
+		{760, "1.10-1.21.10", 760}, // compatible client
+		{340, "1.10-1.21.10", 340}, // compatible client (ViaBackwards)
+		{773, "1.10-1.21.10", 773}, // compatible client (ViaVersion)
+		{900, "1.10-1.21.10", 900}, // client newer than msh protocol table (ViaVersion)
+		{47, "1.10-1.21.10", 760},  // outdated client
+	}
+
+	for _, test := range tests {
+		name, prot := versionInfo(test.clientProt)
+		if name != test.expName || prot != test.expProt {
+			t.Errorf("client protocol %d (via): received (%s, %d), expected (%s, %d)", test.clientProt, name, prot, test.expName, test.expProt)
+		}
+	}
+
+	if v := protocolVersion(754); v != "1.16.4-1.16.5" {
+		t.Errorf("protocol 754: received %s, expected 1.16.4-1.16.5", v)
+	}
+	if v := protocolVersion(1); v != "" {
+		t.Errorf("protocol 1: received %s, expected empty string", v)
+	}
+}
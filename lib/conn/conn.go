@@ -8,8 +8,10 @@ import (
 
 	"msh/lib/config"
 	"msh/lib/errco"
+	"msh/lib/hook"
 	"msh/lib/servctrl"
 	"msh/lib/servstats"
+	"msh/lib/utility"
 )
 
 func init() {
@@ -21,6 +23,9 @@ func init() {
 // If there is a ms major error, it is reported to client then func returns.
 // [goroutine]
 func HandlerClientConn(clientConn net.Conn) {
+	// record connection traffic if capture is enabled
+	clientConn = newCaptureConn(clientConn)
+
 	// handling of ipv6 addresses
 	li := strings.LastIndex(clientConn.RemoteAddr().String(), ":")
 	clientAddress := clientConn.RemoteAddr().String()[:li]
@@ -29,12 +34,33 @@ func HandlerClientConn(clientConn net.Conn) {
 	reqPacket, reqType, logMsh := getReqType(clientConn)
 	if logMsh != nil {
 		logMsh.Log(true)
+		recordConnEvent(clientConn, EVENT_UNKN, clientAddress, nil, DECISION_MALFORMED)
 		return
 	}
 
+	// legacy ping is not supported: just record it
+	if reqType == errco.CLIENT_REQ_LEGACY {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "a client requested server info with legacy ping from %s:%d", clientAddress, config.MshPort)
+		recordConnEvent(clientConn, EVENT_LEGACY, clientAddress, nil, DECISION_MALFORMED)
+
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "closing connection for: %s", clientAddress)
+		clientConn.Close()
+
+		return
+	}
+
+	// get client handshake data (protocol, server address, player name)
+	hs, logMsh := parseHandshake(reqPacket)
+	if logMsh != nil {
+		// just log it since handshake data is not vital to answer the client
+		logMsh.Log(true)
+		hs = &clientHandshake{}
+	}
+
 	// if there is a major error warn the client and return
 	if servstats.Stats.MajorError != nil {
 		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_MINECRAFT_SERVER, "a client connected to msh (%s:%d to %s:%d) but minecraft server has encountered major problems", clientAddress, config.MshPort, config.ServHost, config.ServPort)
+		recordConnEvent(clientConn, eventType(reqType), clientAddress, hs, DECISION_MAJOR_ERROR)
 
 		// close the client connection before returning
 		defer func() {
@@ -43,7 +69,7 @@ func HandlerClientConn(clientConn net.Conn) {
 		}()
 
 		// msh INFO/JOIN response (warn client with error description)
-		mes := buildMessage(reqType, fmt.Sprintf(servstats.Stats.MajorError.Mex, servstats.Stats.MajorError.Arg...))
+		mes := buildMessage(reqType, fmt.Sprintf(servstats.Stats.MajorError.Mex, servstats.Stats.MajorError.Arg...), hs.protocol)
 		clientConn.Write(mes)
 		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 
@@ -74,19 +100,30 @@ func HandlerClientConn(clientConn net.Conn) {
 
 			// msh INFO response
 			var mes []byte
-			switch servstats.Stats.Status {
-			case errco.SERVER_STATUS_OFFLINE:
-				mes = buildMessage(reqType, config.ConfigRuntime.Msh.InfoHibernation)
-			case errco.SERVER_STATUS_STARTING:
-				mes = buildMessage(reqType, config.ConfigRuntime.Msh.InfoStarting)
-			case errco.SERVER_STATUS_ONLINE: // ms suspended
-				mes = buildMessage(reqType, config.ConfigRuntime.Msh.InfoHibernation)
-			case errco.SERVER_STATUS_STOPPING:
-				mes = buildMessage(reqType, "server is stopping...\nrefresh the page")
+			switch {
+			case traffic.capped() && (servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE || servstats.Stats.Suspended):
+				mes = buildMessage(reqType, dataCapMessage(), hs.protocol)
+			case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE && servstats.Stats.Waking:
+				mes = buildMessage(reqType, config.ConfigRuntime.Msh.InfoWaking, hs.protocol)
+			case servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE:
+				mes = buildMessage(reqType, config.ConfigRuntime.Msh.InfoHibernation, hs.protocol)
+			case servstats.Stats.Status == errco.SERVER_STATUS_STARTING:
+				mes = buildMessage(reqType, config.ConfigRuntime.Msh.InfoStarting, hs.protocol)
+			case servstats.Stats.Status == errco.SERVER_STATUS_ONLINE: // ms suspended
+				mes = buildMessage(reqType, config.ConfigRuntime.Msh.InfoHibernation, hs.protocol)
+			case servstats.Stats.Status == errco.SERVER_STATUS_STOPPING:
+				mes = buildMessage(reqType, "server is stopping...\nrefresh the page", hs.protocol)
 			}
 			clientConn.Write(mes)
 			errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 
+			// pre-warm ms if a known client is refreshing the server list
+			if !isReplay(clientConn) && prewarm.ping(clientAddress, hs) {
+				recordConnEvent(clientConn, EVENT_INFO, clientAddress, hs, DECISION_PREWARMED)
+			} else {
+				recordConnEvent(clientConn, EVENT_INFO, clientAddress, hs, DECISION_ANSWERED)
+			}
+
 			// msh PING response
 			logMsh := getPing(clientConn)
 			if logMsh != nil {
@@ -96,9 +133,10 @@ func HandlerClientConn(clientConn net.Conn) {
 
 		} else {
 			// ms online and not suspended
+			recordConnEvent(clientConn, EVENT_INFO, clientAddress, hs, DECISION_PROXIED)
 
 			// open proxy between client and server
-			openProxy(clientConn, reqPacket, errco.CLIENT_REQ_INFO)
+			openProxy(clientConn, reqPacket, errco.CLIENT_REQ_INFO, "", "")
 		}
 
 	case errco.CLIENT_REQ_JOIN:
@@ -113,57 +151,169 @@ func HandlerClientConn(clientConn net.Conn) {
 				clientConn.Close()
 			}()
 
+			// check if the client used a secret hostname to connect
+			// (neutral response: don't reveal that a secret hostname is needed)
+			logMsh := config.ConfigRuntime.IsKnock(hs.serverAddr)
+			if logMsh != nil {
+				logMsh.Log(true)
+				recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_REFUSED_KNOCK)
+
+				// msh JOIN response (warn client with text in the loadscreen)
+				mes := buildMessage(reqType, "Server is not available at the moment", hs.protocol)
+				clientConn.Write(mes)
+				errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
+
+				return
+			}
+
+			// check if the data cap allows to warm ms
+			if traffic.capped() {
+				errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_DATA_CAP, "client %s can't warm minecraft server: data cap reached", clientAddress)
+				recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_DATA_CAP)
+
+				// msh JOIN response (warn client with text in the loadscreen)
+				mes := buildMessage(reqType, dataCapMessage(), hs.protocol)
+				clientConn.Write(mes)
+				errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
+
+				return
+			}
+
 			// check if the request packet contains element of whitelist or the address is in whitelist
-			logMsh := config.ConfigRuntime.IsWhitelist(reqPacket, clientAddress)
+			logMsh = config.ConfigRuntime.IsWhitelist(reqPacket, clientAddress)
 			if logMsh != nil {
 				logMsh.Log(true)
+				recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_REFUSED_WL)
 
 				// msh JOIN response (warn client with text in the loadscreen)
-				mes := buildMessage(reqType, "You don't have permission to warm this server")
+				mes := buildMessage(reqType, "You don't have permission to warm this server", hs.protocol)
 				clientConn.Write(mes)
 				errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 
 				return
 			}
 
+			// refuse clients with incompatible protocol (ms would be warmed for nothing)
+			if refuseProtocol(clientConn, clientAddress, hs) {
+				return
+			}
+
+			// check if enough players are waiting for ms to be warmed
+			// (only if ms is offline: if ms is already starting there is nothing to wait for)
+			if servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE && waitQuorum(clientConn, clientAddress, hs) {
+				return
+			}
+
 			// issue warm
-			logMsh = servctrl.WarmMS()
-			if logMsh != nil {
+			// (if ms start is already in progress, the client is answered as if ms was warmed)
+			logMsh = warmMS(clientConn)
+			if logMsh != nil && logMsh.Cod != errco.ERROR_SERVER_STARTING {
 				// msh JOIN response (warn client with text in the loadscreen)
 				logMsh.Log(true)
-				mes := buildMessage(reqType, "An error occurred while warming the server: check the msh log")
+				recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_WARM_ERROR)
+				mes := buildMessage(reqType, warmErrorMessage(logMsh), hs.protocol)
 				clientConn.Write(mes)
 				errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 
 				return
 			}
 
+			// register client join in join history (client passed the warm checks)
+			if !isReplay(clientConn) {
+				prewarm.join(clientAddress)
+			}
+			recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_WARMED)
+
 			// msh JOIN response (answer client with text in the loadscreen)
-			mes := buildMessage(reqType, "Server start command issued. Please wait... "+servstats.Stats.LoadProgress)
+			mes := buildMessage(reqType, "Server start command issued. Please wait... "+servstats.Stats.LoadProgress, hs.protocol)
+			if servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE && servstats.Stats.Waking {
+				mes = buildMessage(reqType, "Waking the machine hosting the server. Please wait...", hs.protocol)
+			}
 			clientConn.Write(mes)
 			errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 
 		} else {
 			// ms online (un/suspended)
 
+			// if ms is suspended, check if the client used a secret hostname to connect
+			// (a suspended ms is hibernating: it should be warmed only by clients that knock)
+			if servstats.Stats.Suspended {
+				if logMsh := config.ConfigRuntime.IsKnock(hs.serverAddr); logMsh != nil {
+					logMsh.Log(true)
+					recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_REFUSED_KNOCK)
+
+					// msh JOIN response (warn client with text in the loadscreen)
+					mes := buildMessage(reqType, "Server is not available at the moment", hs.protocol)
+					clientConn.Write(mes)
+					errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
+
+					// close the client connection before returning
+					errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "closing connection for: %s", clientAddress)
+					clientConn.Close()
+
+					return
+				}
+
+				// check if the data cap allows to warm ms
+				if traffic.capped() {
+					errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_DATA_CAP, "client %s can't warm minecraft server: data cap reached", clientAddress)
+					recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_DATA_CAP)
+
+					// msh JOIN response (warn client with text in the loadscreen)
+					mes := buildMessage(reqType, dataCapMessage(), hs.protocol)
+					clientConn.Write(mes)
+					errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
+
+					// close the client connection before returning
+					errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "closing connection for: %s", clientAddress)
+					clientConn.Close()
+
+					return
+				}
+
+				// refuse clients with incompatible protocol (ms would be warmed for nothing)
+				if refuseProtocol(clientConn, clientAddress, hs) {
+					// close the client connection before returning
+					errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "closing connection for: %s", clientAddress)
+					clientConn.Close()
+
+					return
+				}
+
+				// check if enough players are waiting for ms to be warmed
+				if waitQuorum(clientConn, clientAddress, hs) {
+					// close the client connection before returning
+					errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "closing connection for: %s", clientAddress)
+					clientConn.Close()
+
+					return
+				}
+			}
+
 			// issue warm
-			logMsh = servctrl.WarmMS()
+			logMsh = warmMS(clientConn)
 			if logMsh != nil {
 				// msh JOIN response (warn client with text in the loadscreen)
 				logMsh.Log(true)
-				mes := buildMessage(reqType, "An error occurred while warming the server: check the msh log")
+				recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_WARM_ERROR)
+				mes := buildMessage(reqType, warmErrorMessage(logMsh), hs.protocol)
 				clientConn.Write(mes)
 				errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 
 				return
 			}
 
+			// client join is registered in join history when ms accepts the player (see JoinConfirmed)
+			recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_PROXIED)
+
 			// open proxy between client and server
-			openProxy(clientConn, reqPacket, errco.CLIENT_REQ_JOIN)
+			openProxy(clientConn, reqPacket, errco.CLIENT_REQ_JOIN, hs.playerName, hs.playerUUID)
 		}
 
 	default:
-		mes := buildMessage(reqType, "Client request unknown")
+		recordConnEvent(clientConn, EVENT_UNKN, clientAddress, hs, DECISION_MALFORMED)
+
+		mes := buildMessage(reqType, "Client request unknown", hs.protocol)
 		clientConn.Write(mes)
 		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 	}
@@ -174,14 +324,19 @@ func HandlerClientConn(clientConn net.Conn) {
 // It sends the request packet for ms to interpret.
 //
 // The req parameter indicates what request type (INFO os JOIN) the proxy will be used for.
-func openProxy(clientConn net.Conn, serverInitPacket []byte, req int) {
+//
+// The playerName and playerUUID parameters are used to track idle players and online players (JOIN only).
+//
+// Replayed connections are proxied to a stub server and don't change msh state
+// (idle players, online players, connection count, traffic totals).
+func openProxy(clientConn net.Conn, serverInitPacket []byte, req int, playerName, playerUUID string) {
 	// open a connection to ms and connect it with the client
-	serverSocket, err := net.Dial("tcp", fmt.Sprintf("%s:%d", config.ServHost, config.ServPort))
+	serverSocket, err := dialMS(clientConn)
 	if err != nil {
 		errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_DIAL, err.Error())
 
 		// msh JOIN response (warn client with text in the loadscreen)
-		mes := buildMessage(errco.CLIENT_REQ_JOIN, "can't connect to server... check if minecraft server is running and set the correct ServPort")
+		mes := buildMessage(errco.CLIENT_REQ_JOIN, "can't connect to server... check if minecraft server is running and set the correct ServPort", 0)
 		clientConn.Write(mes)
 		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
 
@@ -191,11 +346,28 @@ func openProxy(clientConn net.Conn, serverInitPacket []byte, req int) {
 	// sends the request packet
 	serverSocket.Write(serverInitPacket)
 
+	replay := isReplay(clientConn)
+
+	// track the traffic of joining players to detect idle ones
+	var afk *afkTracker
+	if req == errco.CLIENT_REQ_JOIN && !replay {
+		afk = newAfkTracker(playerName)
+	}
+
+	// bandwidth limiters of the connection
+	limits := newProxyLimits(remoteHost(clientConn), playerName)
+
+	// register the joining player in the player registry
+	// (unregistered when the connection is closed, keyed by client address)
+	if req == errco.CLIENT_REQ_JOIN && !replay {
+		servstats.Players.JoinConn(playerName, playerUUID, limits.clientAddress, clientConn.RemoteAddr().String())
+	}
+
 	// launch proxy client -> server
-	go forwardTCP(clientConn, serverSocket, false, req)
+	go forwardTCP(clientConn, serverSocket, false, req, replay, afk, limits)
 
 	// launch proxy server -> client
-	go forwardTCP(serverSocket, clientConn, true, req)
+	go forwardTCP(serverSocket, clientConn, true, req, replay, afk, limits)
 }
 
 // forwardTCP takes a source and a destination net.Conn and forwards them.
@@ -204,8 +376,15 @@ func openProxy(clientConn net.Conn, serverInitPacket []byte, req int) {
 //
 // req is used to decide if connection should be counted in servstats.Stats.ConnCount
 //
+// replay is used to skip the changes to msh state for replayed connections
+// (connection count, player join/leave hooks, freeze schedule, traffic totals)
+//
+// afk is used to track the client -> server traffic of the player (can be nil)
+//
+// limits is used to limit the bandwidth of the connection
+//
 // [goroutine]
-func forwardTCP(source, destination net.Conn, isServerToClient bool, req int) {
+func forwardTCP(source, destination net.Conn, isServerToClient bool, req int, replay bool, afk *afkTracker, limits *proxyLimits) {
 	var data []byte = make([]byte, 1024)
 	var direction string
 
@@ -215,19 +394,35 @@ func forwardTCP(source, destination net.Conn, isServerToClient bool, req int) {
 		direction = "client --> server"
 	}
 
+	// bytes not yet added to traffic totals
+	pending := 0
+	defer func() { traffic.add(pending) }()
+
 	// if client has requested ms join, change connection count
-	if isServerToClient && req == errco.CLIENT_REQ_JOIN { // isServerToClient used to count in only one of the 2 forwardTCP()
+	if isServerToClient && req == errco.CLIENT_REQ_JOIN && !replay { // isServerToClient used to count in only one of the 2 forwardTCP()
 		servstats.Stats.ConnCount++
 		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "A CLIENT CONNECTED TO THE SERVER! (join req) - %d active connections", servstats.Stats.ConnCount)
+		hook.Go(hook.EVENT_PLAYER_JOIN, &hook.Context{Player: limits.playerName, PlayerIP: limits.clientAddress})
 
 		defer func() {
 			servstats.Stats.ConnCount--
 			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "A CLIENT DISCONNECTED FROM THE SERVER! (join req) - %d active connections", servstats.Stats.ConnCount)
+			hook.Go(hook.EVENT_PLAYER_LEAVE, &hook.Context{Player: limits.playerName, PlayerIP: limits.clientAddress})
+			servstats.Players.LeaveConn(limits.playerName, destination.RemoteAddr().String()) // destination is the client connection
 
 			servctrl.FreezeMSSchedule()
 		}()
 	}
 
+	// stop tracking the player when the connection is closed
+	defer afk.stop()
+
+	// unregister bandwidth limiters when the connection is closed
+	// (isServerToClient used to unregister in only one of the 2 forwardTCP())
+	if isServerToClient {
+		defer limits.remove()
+	}
+
 	for {
 		// update read and write timeout
 		source.SetReadDeadline(time.Now().Add(10 * time.Second))
@@ -236,7 +431,7 @@ func forwardTCP(source, destination net.Conn, isServerToClient bool, req int) {
 		// read data from source
 		dataLen, err := source.Read(data)
 		if err != nil {
-			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONN_EOF, "closing %15s --> %15s | %s (cause: %s)", strings.Split(source.RemoteAddr().String(), ":")[0], strings.Split(destination.RemoteAddr().String(), ":")[0], direction, err.Error())
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONN_EOF, "closing %15s --> %15s | %s (cause: %s)", remoteHost(source), remoteHost(destination), direction, err.Error())
 
 			// close the source/destination connections
 			_ = destination.Close()
@@ -244,10 +439,15 @@ func forwardTCP(source, destination net.Conn, isServerToClient bool, req int) {
 			return
 		}
 
+		// wait if bandwidth limits are exceeded
+		// (no delay is added if there is headroom)
+		limits.wait(dataLen, isServerToClient)
+		destination.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
 		// write data to destination
 		_, err = destination.Write(data[:dataLen])
 		if err != nil {
-			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONN_WRITE, "closing %15s --> %15s | %s (cause: %s)", strings.Split(source.RemoteAddr().String(), ":")[0], strings.Split(destination.RemoteAddr().String(), ":")[0], direction, err.Error())
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_CONN_WRITE, "closing %15s --> %15s | %s (cause: %s)", remoteHost(source), remoteHost(destination), direction, err.Error())
 
 			// close the source/destination connections
 			_ = destination.Close()
@@ -255,6 +455,21 @@ func forwardTCP(source, destination net.Conn, isServerToClient bool, req int) {
 			return
 		}
 
+		// register traffic in daily and billing cycle totals
+		// (traffic is added in batches, the remaining bytes are added when the connection is closed)
+		if !replay {
+			pending += dataLen
+		}
+		if pending >= trafficBatch {
+			traffic.add(pending)
+			pending = 0
+		}
+
+		// register client -> server traffic of the player
+		if !isServerToClient {
+			afk.add(dataLen)
+		}
+
 		// calculate bytes/s to client/server
 		if config.ConfigRuntime.Msh.ShowInternetUsage && errco.DebugLvl >= errco.LVL_3 {
 			errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%s%s%s: %v", errco.COLOR_PURPLE, direction, errco.COLOR_RESET, data[:dataLen])
@@ -270,6 +485,101 @@ func forwardTCP(source, destination net.Conn, isServerToClient bool, req int) {
 	}
 }
 
+// recordConnEvent records a connection attempt of a client connection in the connection log file
+// (replayed connections are not recorded).
+func recordConnEvent(clientConn net.Conn, evType, clientAddress string, hs *clientHandshake, decision string) {
+	if isReplay(clientConn) {
+		return
+	}
+
+	recordEvent(evType, clientAddress, hs, decision)
+}
+
+// remoteHost returns the host of the remote address of a connection (ipv6 addresses are supported)
+func remoteHost(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// waitQuorum answers a joining client that must wait for the start quorum to be reached.
+// Returns true if the quorum was not reached (the client connection is not closed).
+// (replayed connections don't wait for the start quorum)
+func waitQuorum(clientConn net.Conn, clientAddress string, hs *clientHandshake) bool {
+	if isReplay(clientConn) {
+		return false
+	}
+
+	ok, missing, waiting := quorum.check(utility.FirstNon("", hs.playerName, clientAddress))
+	if ok {
+		return false
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "start quorum not reached: %d more players needed (waiting: %v)", missing, waiting)
+	recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_QUORUM_WAIT)
+
+	// msh JOIN response (answer client with text in the loadscreen)
+	mes := buildMessage(errco.CLIENT_REQ_JOIN, quorumMessage(missing, waiting), hs.protocol)
+	clientConn.Write(mes)
+	errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
+
+	return true
+}
+
+// refuseProtocol refuses a joining client with a protocol that can't join ms (if ProtocolCheck is enabled).
+// Returns true if the client was refused (the client connection is not closed).
+//
+// It should be called after knock and whitelist checks (the required version is shown to the client).
+func refuseProtocol(clientConn net.Conn, clientAddress string, hs *clientHandshake) bool {
+	if !config.ConfigRuntime.Msh.ProtocolCheck || hs.protocol <= 0 || protocolCompatible(hs.protocol) {
+		return false
+	}
+
+	errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CLIENT_PROTOCOL, "client %s has incompatible protocol (client: %d, server: %d)", clientAddress, hs.protocol, config.ConfigRuntime.Server.Protocol)
+	recordConnEvent(clientConn, EVENT_JOIN, clientAddress, hs, DECISION_REFUSED_PROTOCOL)
+
+	// msh JOIN response (warn client with text in the loadscreen)
+	mes := buildMessage(errco.CLIENT_REQ_JOIN, fmt.Sprintf("Incompatible client version: please use minecraft %s to join this server", versionRequired()), hs.protocol)
+	clientConn.Write(mes)
+	errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%smsh --> client%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, mes)
+
+	return true
+}
+
+// warmMS warms ms for the client.
+// (replayed connections don't warm ms)
+func warmMS(clientConn net.Conn) *errco.MshLog {
+	if isReplay(clientConn) {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "replay: skipping minecraft server warm")
+		return nil
+	}
+
+	return servctrl.WarmMS()
+}
+
+// warmErrorMessage returns the message shown to a client when ms warm fails
+func warmErrorMessage(logMsh *errco.MshLog) string {
+	// show why the pre-start hook aborted ms start
+	if logMsh.Cod == errco.ERROR_HOOK_ABORT {
+		return fmt.Sprintf(logMsh.Mex, logMsh.Arg...)
+	}
+
+	return "An error occurred while warming the server: check the msh log"
+}
+
+// dialMS opens a connection to ms for the client.
+// (replayed connections are connected to a stub server)
+func dialMS(clientConn net.Conn) (net.Conn, error) {
+	if rc, ok := clientConn.(*replayConn); ok {
+		return rc.dialStub(), nil
+	}
+
+	return net.Dial("tcp", fmt.Sprintf("%s:%d", config.ServHost, config.ServPort))
+}
+
 // printDataUsage prints connection data (KB/s) to clients and to minecraft server.
 //
 // Prints data exchanged only when clients are connected to ms.
@@ -0,0 +1,31 @@
+package conn
+
+import (
+	"net"
+	"testing"
+)
+
+// addrConn is a net.Conn with the specified remote address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func Test_remoteHost(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		exp  string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 51234}, "192.168.1.10"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}, "2001:db8::1"},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 51234}, "::1"},
+	}
+
+	for _, test := range tests {
+		if host := remoteHost(&addrConn{remote: test.addr}); host != test.exp {
+			t.Errorf("%s: received %q, expected %q", test.addr, host, test.exp)
+		}
+	}
+}
@@ -58,6 +58,7 @@ const (
 	CLIENT_REQ_UNKN     = 0x020000 // client request unknown
 	CLIENT_REQ_INFO     = 0x020001 // client request server info
 	CLIENT_REQ_JOIN     = 0x020002 // client request server join
+	CLIENT_REQ_LEGACY   = 0x020003 // client request server info (legacy ping, before 1.7)
 	MESSAGE_FORMAT_TXT  = 0x020103 // message to client should be built as TXT
 	MESSAGE_FORMAT_INFO = 0x020104 // message to client should be built as INFO
 )
@@ -87,8 +88,17 @@ const (
 	ERROR_SERVER_OFFLINE_SUSPENDED LogCod = 0x00f20a // minecraft server is offline but not suspended
 	ERROR_SERVER_STOPPING          LogCod = 0x00f20b // minecraft server is stopping
 	ERROR_SERVER_UNRESPONDING      LogCod = 0x00f20c // minecraft server is not responding
+	ERROR_SERVER_STARTING          LogCod = 0x00f20d // minecraft server start is already in progress
 	ERROR_PIPE_INPUT_WRITE         LogCod = 0x00f300 // terminal input writing error
 	ERROR_PIPE_LOAD                LogCod = 0x00f301 // terminal pipe load error
+	ERROR_RCON                     LogCod = 0x00f302 // rcon connection/command error
+	ERROR_RCON_AUTH                LogCod = 0x00f303 // rcon authentication failed
+	ERROR_DOCKER                   LogCod = 0x00f304 // docker engine api error
+	ERROR_HTTP_BACKEND             LogCod = 0x00f305 // http backend call error
+	ERROR_WAKE_ON_LAN              LogCod = 0x00f600 // wake-on-lan error
+	ERROR_AGENT                    LogCod = 0x00f700 // msh agent connection/protocol error
+	ERROR_WATCHDOG                 LogCod = 0x00f800 // minecraft server unresponsive according to watchdog
+	ERROR_THREAD_DUMP              LogCod = 0x00f801 // error while capturing minecraft server thread dump
 	ERROR_CONVERSION               LogCod = 0x00f400 // variable conversion error
 	ERROR_WRONG_CONNECTION_COUNT   LogCod = 0x00f500 // connection count does not correspond to ms player count
 
@@ -109,13 +119,26 @@ const (
 	ERROR_CONN_READ           LogCod = 0x02f102 // error while reading from client connection
 	ERROR_CONN_WRITE          LogCod = 0x02f103 // error while writing to client connection
 	ERROR_CONN_EOF            LogCod = 0x02f104 // read EOF from client connection
+	ERROR_CLIENT_PROTOCOL     LogCod = 0x02f105 // client protocol is not compatible with ms
 	ERROR_SERVER_DIAL         LogCod = 0x02f200 // error while dialing ms server
 	ERROR_SERVER_REQUEST_INFO LogCod = 0x02f201 // error while msh server info request
 	ERROR_JSON_MARSHAL        LogCod = 0x02f300 // error while exporting struct to json bytes
 	ERROR_JSON_UNMARSHAL      LogCod = 0x02f301 // error while importing struct from json bytes
 	ERROR_QUERY_CHALLENGE     LogCod = 0x02f401 // error caused by query challenge
 	ERROR_QUERY_BAD_REQUEST   LogCod = 0x02f402 // error caused by query request
+	ERROR_QUERY_RATE_LIMIT    LogCod = 0x02f403 // query rate limit exceeded by source address
 	ERROR_PING_PACKET_UNKNOWN LogCod = 0x02f500 // error ping packet received is unknown
+	ERROR_HISTORY_LOAD        LogCod = 0x02f600 // error while loading join history file
+	ERROR_HISTORY_SAVE        LogCod = 0x02f601 // error while saving join history file
+	ERROR_CONNLOG_WRITE       LogCod = 0x02f700 // error while writing connection log file
+	ERROR_CONNLOG_READ        LogCod = 0x02f701 // error while reading connection log file
+	ERROR_AFK_KICK            LogCod = 0x02f800 // error while warning/kicking an idle player
+	ERROR_TRAFFIC_LOAD        LogCod = 0x02f900 // error while loading traffic file
+	ERROR_TRAFFIC_SAVE        LogCod = 0x02f901 // error while saving traffic file
+	ERROR_DATA_CAP            LogCod = 0x02f902 // data cap reached
+	ERROR_LAN_ANNOUNCE        LogCod = 0x02fa00 // error while announcing msh on lan
+	ERROR_CAPTURE             LogCod = 0x02fb00 // error while recording/replaying capture file
+	ERROR_RCON_ENDPOINT       LogCod = 0x02fc00 // error in msh rcon endpoint
 
 	// config package
 
@@ -126,6 +149,7 @@ const (
 	ERROR_ICON_LOAD        LogCod = 0x03f100 // error while loading icon
 	ERROR_VERSION_LOAD     LogCod = 0x03f101 // error while loading version.json from server JAR
 	ERROR_WHITELIST_CHECK  LogCod = 0x03f200 // error while checking whitelist
+	ERROR_KNOCK_CHECK      LogCod = 0x03f201 // error while checking knock hostnames
 	ERROR_TYPE_UNSUPPORTED LogCod = 0x03f300 // error interface{}.(type) not supported
 	ERROR_INVALID_COMMAND  LogCod = 0x03f400 // error start ms command is invalid
 	ERROR_PARSE            LogCod = 0x03f500 // error while parsing args
@@ -166,4 +190,8 @@ const (
 
 	// servstats package
 	ERROR_MINECRAFT_SERVER LogCod = 0x09f000 // major error while starting minecraft server (will be communicated to clients trying to join)
+
+	// hook package
+	ERROR_HOOK       LogCod = 0x0af000 // hook executable error
+	ERROR_HOOK_ABORT LogCod = 0x0af001 // pre-start hook aborted minecraft server start
 )
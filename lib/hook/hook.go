@@ -0,0 +1,215 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+	"msh/lib/opsys"
+	"msh/lib/servstats"
+)
+
+// hook events
+const (
+	EVENT_PRE_START    string = "pre-start"    // ms is going to start
+	EVENT_POST_START   string = "post-start"   // ms is online
+	EVENT_PRE_STOP     string = "pre-stop"     // ms is going to stop
+	EVENT_POST_STOP    string = "post-stop"    // ms is offline
+	EVENT_SUSPEND      string = "suspend"      // ms process was suspended
+	EVENT_RESUME       string = "resume"       // ms process was resumed
+	EVENT_PLAYER_JOIN  string = "player-join"  // a player joined ms
+	EVENT_PLAYER_LEAVE string = "player-leave" // a player left ms
+	EVENT_MAJOR_ERROR  string = "major-error"  // ms encountered a major error
+)
+
+const defaultTimeout time.Duration = 30 * time.Second // hook timeout used when Timeout is not set
+
+// Context is the context of a hook event.
+// It's passed to the hook executable as json on stdin and as MSH_* environment variables.
+type Context struct {
+	Event     string    `json:"event"`               // hook event
+	Time      time.Time `json:"time"`                // time of the event
+	Status    string    `json:"status"`              // ms status
+	Suspended bool      `json:"suspended"`           // ms process is suspended
+	Players   int       `json:"players"`             // players online on ms (player registry)
+	Player    string    `json:"player,omitempty"`    // player name (player-join, player-leave)
+	PlayerIP  string    `json:"player_ip,omitempty"` // player ip (player-join, player-leave)
+	Error     string    `json:"error,omitempty"`     // major error (major-error)
+}
+
+// Run runs the hook executable of event and waits for it to exit.
+// c can be nil, event and ms stats are set by Run.
+//
+// Returns an error if the executable can't be run, exits with non-zero code or times out.
+//
+// [blocking]
+func Run(event string, c *Context) *errco.MshLog {
+	h := hookOf(event)
+	if h.Path == "" {
+		return nil
+	}
+
+	return run(h, newContext(event, c))
+}
+
+// Go runs the hook executable of event without waiting for it, errors are logged.
+// c can be nil, event and ms stats are set by Go (when the event happens).
+//
+// [non-blocking]
+func Go(event string, c *Context) {
+	h := hookOf(event)
+	if h.Path == "" {
+		return
+	}
+
+	c = newContext(event, c)
+
+	// [goroutine]
+	go func() {
+		logMsh := run(h, c)
+		if logMsh != nil {
+			logMsh.Log(true)
+		}
+	}()
+}
+
+// MajorError runs the major-error hook.
+// Should be set as servstats.OnMajorError.
+//
+// [non-blocking]
+func MajorError(e *errco.MshLog) {
+	Go(EVENT_MAJOR_ERROR, &Context{Error: fmt.Sprintf(e.Mex, e.Arg...)})
+}
+
+// newContext sets event and ms stats in hook context c (allocated if nil)
+func newContext(event string, c *Context) *Context {
+	if c == nil {
+		c = &Context{}
+	}
+	c.Event = event
+	c.Time = time.Now()
+	c.Status = statusName(servstats.Stats.Status)
+	c.Suspended = servstats.Stats.Suspended
+	c.Players = servstats.Players.Count()
+
+	return c
+}
+
+// run runs hook executable h with context c
+func run(h model.Hook, c *Context) *errco.MshLog {
+	event := c.Event
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_JSON_MARSHAL, err.Error())
+	}
+
+	timeout := time.Duration(h.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "running %s hook: %s", event, h.Path)
+
+	cmd := exec.CommandContext(ctx, h.Path)
+	cmd.Dir = config.ConfigRuntime.Server.Folder
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), c.env()...)
+
+	// don't wait for background processes started by the hook (they keep the output open)
+	out, err := opsys.CombinedOutput(cmd)
+
+	// log hook output
+	lastLine := ""
+	for _, line := range strings.Split(strings.ReplaceAll(string(out), "\r", ""), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "%s hook: %s", event, line)
+			lastLine = line
+		}
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_HOOK, "%s hook timed out after %s", event, timeout)
+	case errors.As(err, &exitErr):
+		// the last line of output explains why the hook failed
+		if lastLine != "" {
+			return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_HOOK, "%s hook exited with code %d: %s", event, exitErr.ExitCode(), lastLine)
+		}
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_HOOK, "%s hook exited with code %d", event, exitErr.ExitCode())
+	case err != nil:
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_HOOK, "%s hook: %s", event, err.Error())
+	}
+
+	return nil
+}
+
+// hookOf returns the hook of event specified in config
+func hookOf(event string) model.Hook {
+	h := config.ConfigRuntime.Msh.Hooks
+	switch event {
+	case EVENT_PRE_START:
+		return h.PreStart
+	case EVENT_POST_START:
+		return h.PostStart
+	case EVENT_PRE_STOP:
+		return h.PreStop
+	case EVENT_POST_STOP:
+		return h.PostStop
+	case EVENT_SUSPEND:
+		return h.Suspend
+	case EVENT_RESUME:
+		return h.Resume
+	case EVENT_PLAYER_JOIN:
+		return h.PlayerJoin
+	case EVENT_PLAYER_LEAVE:
+		return h.PlayerLeave
+	case EVENT_MAJOR_ERROR:
+		return h.MajorError
+	default:
+		return model.Hook{}
+	}
+}
+
+// env returns the hook context as environment variables
+func (c *Context) env() []string {
+	return []string{
+		"MSH_EVENT=" + c.Event,
+		"MSH_TIME=" + c.Time.Format(time.RFC3339),
+		"MSH_STATUS=" + c.Status,
+		"MSH_SUSPENDED=" + strconv.FormatBool(c.Suspended),
+		"MSH_PLAYERS=" + strconv.Itoa(c.Players),
+		"MSH_PLAYER=" + c.Player,
+		"MSH_PLAYER_IP=" + c.PlayerIP,
+		"MSH_ERROR=" + c.Error,
+	}
+}
+
+// statusName returns the name of ms status
+func statusName(status int) string {
+	switch status {
+	case errco.SERVER_STATUS_OFFLINE:
+		return "offline"
+	case errco.SERVER_STATUS_STARTING:
+		return "starting"
+	case errco.SERVER_STATUS_ONLINE:
+		return "online"
+	case errco.SERVER_STATUS_STOPPING:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
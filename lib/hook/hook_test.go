@@ -0,0 +1,96 @@
+package hook
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+)
+
+// writeScript writes an executable shell script in dir and returns its name
+func writeScript(t *testing.T, dir, name, content string) string {
+	err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+content), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "./" + name
+}
+
+func Test_Run(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts not available")
+	}
+
+	dir := t.TempDir()
+	config.ConfigRuntime.Server.Folder = dir
+
+	// hook receives the context on stdin and as environment variables
+	config.ConfigRuntime.Msh.Hooks.PlayerJoin = model.Hook{
+		Path:    writeScript(t, dir, "join.sh", "cat > ctx.json\necho \"$MSH_EVENT $MSH_PLAYER $MSH_PLAYER_IP $MSH_STATUS\" > env.txt\n"),
+		Timeout: 5,
+	}
+	if logMsh := Run(EVENT_PLAYER_JOIN, &Context{Player: "steve", PlayerIP: "10.0.0.2"}); logMsh != nil {
+		t.Fatalf("player-join hook: unexpected error %q", logMsh.Mex)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "ctx.json"))
+	c := &Context{}
+	if err := json.Unmarshal(data, c); err != nil {
+		t.Fatalf("hook context on stdin: %s (%q)", err.Error(), data)
+	}
+	if c.Event != EVENT_PLAYER_JOIN || c.Player != "steve" || c.PlayerIP != "10.0.0.2" || c.Status != "offline" {
+		t.Errorf("hook context on stdin: unexpected %+v", c)
+	}
+
+	env, _ := os.ReadFile(filepath.Join(dir, "env.txt"))
+	if string(env) != "player-join steve 10.0.0.2 offline\n" {
+		t.Errorf("hook context in environment: unexpected %q", env)
+	}
+
+	// hooks not set are not run
+	if logMsh := Run(EVENT_PLAYER_LEAVE, nil); logMsh != nil {
+		t.Errorf("player-leave hook not set: unexpected error %q", logMsh.Mex)
+	}
+
+	// non-zero exit and timeout are errors
+	config.ConfigRuntime.Msh.Hooks.PreStart = model.Hook{
+		Path:    writeScript(t, dir, "fail.sh", "echo mounting drive\necho drive not available >&2\nexit 3\n"),
+		Timeout: 5,
+	}
+	logMsh := Run(EVENT_PRE_START, nil)
+	if logMsh == nil || logMsh.Cod != errco.ERROR_HOOK {
+		t.Fatalf("failing pre-start hook: unexpected result %v", logMsh)
+	}
+	if !strings.Contains(logMsh.Mex, "exited with code") {
+		t.Errorf("failing pre-start hook: unexpected message %q", logMsh.Mex)
+	}
+	if logMsh.Arg[1] != 3 || logMsh.Arg[2] != "drive not available" {
+		t.Errorf("failing pre-start hook: unexpected args %v", logMsh.Arg)
+	}
+
+	config.ConfigRuntime.Msh.Hooks.PreStop = model.Hook{
+		Path:    writeScript(t, dir, "slow.sh", "exec sleep 5\n"),
+		Timeout: 1,
+	}
+	logMsh = Run(EVENT_PRE_STOP, nil)
+	if logMsh == nil || !strings.Contains(logMsh.Mex, "timed out") {
+		t.Errorf("slow pre-stop hook: unexpected result %v", logMsh)
+	}
+
+	// background process that inherited stdout doesn't delay the hook
+	config.ConfigRuntime.Msh.Hooks.PostStop = model.Hook{
+		Path:    writeScript(t, dir, "background.sh", "sleep 5 &\necho unmounting drive\n"),
+		Timeout: 3,
+	}
+	start := time.Now()
+	if logMsh := Run(EVENT_POST_STOP, nil); logMsh != nil || time.Since(start) > 2*time.Second {
+		t.Errorf("post-stop hook with background process: unexpected result %v in %s", logMsh, time.Since(start))
+	}
+}
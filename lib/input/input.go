@@ -4,7 +4,9 @@ import (
 	"io"
 	"log"
 	"strings"
+	"time"
 
+	"msh/lib/conn"
 	"msh/lib/errco"
 	"msh/lib/progmgr"
 	"msh/lib/servctrl"
@@ -21,8 +23,18 @@ func GetInput() {
 			Prompt: "» ",
 			AutoComplete: readline.NewPrefixCompleter(
 				readline.PcItem("msh",
+					readline.PcItem("status"),
 					readline.PcItem("start"),
 					readline.PcItem("freeze"),
+					readline.PcItem("quorum",
+						readline.PcItem("clear"),
+					),
+					readline.PcItem("stats",
+						readline.PcItem("connections"),
+						readline.PcItem("traffic"),
+					),
+					readline.PcItem("throttle"),
+					readline.PcItem("replay"),
 					readline.PcItem("exit"),
 				),
 				readline.PcItem("mine"),
@@ -71,12 +83,16 @@ func GetInput() {
 		case "msh":
 			// check that there is a command for the target
 			if len(lineSplit) < 2 {
-				errco.NewLogln(errco.TYPE_WAR, errco.LVL_0, errco.ERROR_COMMAND_INPUT, "specify msh command (start - freeze - exit)")
+				errco.NewLogln(errco.TYPE_WAR, errco.LVL_0, errco.ERROR_COMMAND_INPUT, "specify msh command (status - players - start - freeze - quorum - stats - throttle - replay - exit)")
 				continue
 			}
 
 			switch lineSplit[1] {
 
+			case "status":
+				errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "%s", conn.StatusDescription())
+			case "players":
+				errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "%s", conn.PlayersDescription())
 			case "start":
 				logMsh := servctrl.WarmMS()
 				if logMsh != nil {
@@ -88,6 +104,53 @@ func GetInput() {
 				if logMsh != nil {
 					logMsh.Log(true)
 				}
+			case "quorum":
+				// start quorum can be bypassed with "msh start"
+				if len(lineSplit) > 2 && lineSplit[2] == "clear" {
+					conn.QuorumReset()
+				}
+				errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "%s", conn.QuorumStatus())
+			case "stats":
+				// msh stats traffic
+				if len(lineSplit) > 2 && lineSplit[2] == "traffic" {
+					errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "%s", conn.TrafficStats())
+					continue
+				}
+
+				// msh stats connections [period] (example: msh stats connections 2h)
+				if len(lineSplit) < 3 || lineSplit[2] != "connections" {
+					errco.NewLogln(errco.TYPE_WAR, errco.LVL_0, errco.ERROR_COMMAND_INPUT, "specify stats type (connections - traffic)")
+					continue
+				}
+
+				period := 24 * time.Hour
+				if len(lineSplit) > 3 {
+					p, err := time.ParseDuration(lineSplit[3])
+					if err != nil || p <= 0 {
+						errco.NewLogln(errco.TYPE_WAR, errco.LVL_0, errco.ERROR_COMMAND_INPUT, "invalid period (example: 30m, 2h, 168h)")
+						continue
+					}
+					period = p
+				}
+
+				stats, logMsh := conn.ConnStats(period)
+				if logMsh != nil {
+					logMsh.Log(true)
+					continue
+				}
+				errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "%s", stats)
+			case "throttle":
+				errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "%s", conn.ThrottleStatus())
+			case "replay":
+				// replay connections recorded in a capture file
+				if len(lineSplit) < 3 {
+					errco.NewLogln(errco.TYPE_WAR, errco.LVL_0, errco.ERROR_COMMAND_INPUT, "specify capture file (example: msh replay msh-capture.bin)")
+					continue
+				}
+				logMsh := conn.Replay(lineSplit[2])
+				if logMsh != nil {
+					logMsh.Log(true)
+				}
 			case "exit":
 				// stop minecraft server forcefully
 				logMsh := servctrl.FreezeMS(true)
@@ -97,7 +160,7 @@ func GetInput() {
 				// terminate msh
 				progmgr.AutoTerminate()
 			default:
-				errco.NewLogln(errco.TYPE_WAR, errco.LVL_0, errco.ERROR_COMMAND_UNKNOWN, "unknown command (start - freeze - exit)")
+				errco.NewLogln(errco.TYPE_WAR, errco.LVL_0, errco.ERROR_COMMAND_UNKNOWN, "unknown command (status - players - start - freeze - quorum - stats - throttle - replay - exit)")
 			}
 
 		// taget minecraft server
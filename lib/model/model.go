@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 // struct adapted to config file
 type Configuration struct {
 	Server struct {
@@ -13,27 +15,188 @@ type Configuration struct {
 		StartServerParam    string `json:"StartServerParam"`
 		StopServer          string `json:"StopServer"`
 		StopServerAllowKill int    `json:"StopServerAllowKill"`
+		OutputTimeout       int    `json:"OutputTimeout"` // max time waiting for the output of a command read from ms terminal/log (milliseconds)
+		OutputIdle          int    `json:"OutputIdle"`    // time since last output line after which the output of a command is complete (milliseconds)
 	} `json:"Commands"`
 	Msh struct {
-		Debug                         int      `json:"Debug"`
-		ID                            string   `json:"ID"`
-		MshPort                       int      `json:"MshPort"`
-		MshPortQuery                  int      `json:"MshPortQuery"`
-		EnableQuery                   bool     `json:"EnableQuery"`
-		TimeBeforeStoppingEmptyServer int64    `json:"TimeBeforeStoppingEmptyServer"`
-		SuspendAllow                  bool     `json:"SuspendAllow"`   // specify if msh should suspend java server process
-		SuspendRefresh                int      `json:"SuspendRefresh"` // specify if msh should refresh java server process suspension and every how many seconds
-		InfoHibernation               string   `json:"InfoHibernation"`
-		InfoStarting                  string   `json:"InfoStarting"`
-		NotifyUpdate                  bool     `json:"NotifyUpdate"`
-		NotifyMessage                 bool     `json:"NotifyMessage"`
-		Whitelist                     []string `json:"Whitelist"`
-		WhitelistImport               bool     `json:"WhitelistImport"`
-		ShowResourceUsage             bool     `json:"ShowResourceUsage"`
-		ShowInternetUsage             bool     `json:"ShowInternetUsage"`
+		Debug                         int             `json:"Debug"`
+		ID                            string          `json:"ID"`
+		MshPort                       int             `json:"MshPort"`
+		MshPortQuery                  int             `json:"MshPortQuery"`
+		EnableQuery                   bool            `json:"EnableQuery"`
+		TimeBeforeStoppingEmptyServer int64           `json:"TimeBeforeStoppingEmptyServer"`
+		SuspendAllow                  bool            `json:"SuspendAllow"`   // specify if msh should suspend java server process
+		SuspendRefresh                int             `json:"SuspendRefresh"` // specify if msh should refresh java server process suspension and every how many seconds
+		InfoHibernation               string          `json:"InfoHibernation"`
+		InfoStarting                  string          `json:"InfoStarting"`
+		InfoWaking                    string          `json:"InfoWaking"`
+		NotifyUpdate                  bool            `json:"NotifyUpdate"`
+		NotifyMessage                 bool            `json:"NotifyMessage"`
+		Whitelist                     []string        `json:"Whitelist"`
+		WhitelistImport               bool            `json:"WhitelistImport"`
+		ShowResourceUsage             bool            `json:"ShowResourceUsage"`
+		ShowInternetUsage             bool            `json:"ShowInternetUsage"`
+		ProtocolCheck                 bool            `json:"ProtocolCheck"`  // specify if msh should refuse to warm ms for clients with incompatible protocol
+		ProtocolExtra                 []int           `json:"ProtocolExtra"`  // extra client protocols accepted by ms (ViaVersion/ViaBackwards)
+		KnockHostnames                []KnockHostname `json:"KnockHostnames"` // secret hostnames that clients must use to warm ms
+		StartQuorum                   struct {
+			Players int      `json:"Players"` // distinct players that must try to join to warm ms (<= 1 to disable)
+			Window  int      `json:"Window"`  // seconds in which join attempts are counted
+			Bypass  []string `json:"Bypass"`  // players that can warm ms without waiting for quorum
+		} `json:"StartQuorum"`
+		PreWarm struct {
+			Enabled bool `json:"Enabled"` // specify if msh should pre-warm ms when a known client refreshes the server list
+			Pings   int  `json:"Pings"`   // status pings (from a client that joined in the past) needed to pre-warm ms
+			Window  int  `json:"Window"`  // seconds in which status pings are counted
+		} `json:"PreWarm"`
+		ConnectionLog struct {
+			Enabled  bool `json:"Enabled"`  // specify if msh should record connection attempts in msh-connections.log
+			MaxSize  int  `json:"MaxSize"`  // size (MB) at which the connection log is rotated
+			MaxFiles int  `json:"MaxFiles"` // number of rotated connection logs to keep
+		} `json:"ConnectionLog"`
+		AfkKick struct {
+			Enabled  bool   `json:"Enabled"`  // specify if msh should kick idle players (so that ms can hibernate)
+			IdleTime int    `json:"IdleTime"` // seconds of idle traffic after which the player is kicked
+			WarnTime int    `json:"WarnTime"` // seconds before the kick at which the player is warned
+			ByteRate int    `json:"ByteRate"` // client -> server bytes/s under which the player is considered idle
+			Command  string `json:"Command"`  // command used to kick the player (<player> is replaced with the player name)
+		} `json:"AfkKick"`
+		Throttle struct {
+			ConnToClients   int `json:"ConnToClients"`   // bandwidth limit (KB/s) server -> client for each connection (0 to disable)
+			ConnToServer    int `json:"ConnToServer"`    // bandwidth limit (KB/s) client -> server for each connection (0 to disable)
+			GlobalToClients int `json:"GlobalToClients"` // bandwidth limit (KB/s) server -> clients for all connections (0 to disable)
+			GlobalToServer  int `json:"GlobalToServer"`  // bandwidth limit (KB/s) clients -> server for all connections (0 to disable)
+		} `json:"Throttle"`
+		DataCap struct {
+			Cap      int    `json:"Cap"`      // traffic (MB) allowed in a billing cycle (0 to disable)
+			CycleDay int    `json:"CycleDay"` // day of month on which billing cycle starts (1-28)
+			Action   string `json:"Action"`   // action when data cap is reached ("refuse": refuse to warm ms, "freeze": freeze ms and refuse to warm it)
+		} `json:"DataCap"`
+		QueryAdvertise struct {
+			HostIP   string `json:"HostIP"`   // host ip reported in query responses ("" to use msh listen address or outbound ip)
+			HostPort int    `json:"HostPort"` // host port reported in query responses (0 to use msh port)
+		} `json:"QueryAdvertise"`
+		LanAnnounce struct {
+			Enabled   bool   `json:"Enabled"`   // specify if msh should announce itself on the lan
+			Interface string `json:"Interface"` // network interface used for lan announcements ("" to let the system choose)
+		} `json:"LanAnnounce"`
+		Capture struct {
+			File     string `json:"File"`     // file in which the traffic of accepted connections is recorded ("" to disable)
+			MaxSize  int    `json:"MaxSize"`  // capture file size limit (MB)
+			MaxConns int    `json:"MaxConns"` // number of connections to capture
+		} `json:"Capture"`
+		LogProfile  string       `json:"LogProfile"`  // log pattern profile used to track ms status ("auto" to detect it from ms jar or startup log, example: "paper")
+		LogProfiles []LogProfile `json:"LogProfiles"` // user-defined log pattern profiles
+		WakeOnLan   struct {
+			Enabled   bool   `json:"Enabled"`   // specify if msh should wake the machine hosting ms before starting ms
+			MAC       string `json:"MAC"`       // mac address of the machine hosting ms
+			Broadcast string `json:"Broadcast"` // address to which magic packets are sent
+			Port      int    `json:"Port"`      // port to which magic packets are sent
+			Password  string `json:"Password"`  // SecureOn password ("" to disable, example: "01:23:45:67:89:ab")
+			WaitPort  int    `json:"WaitPort"`  // port on which the awake machine answers (0 for ms port or agent port with agent backend, example: 22)
+			Timeout   int    `json:"Timeout"`   // max time to wait for the machine to wake (seconds)
+		} `json:"WakeOnLan"`
+		Agent struct {
+			Enabled  bool   `json:"Enabled"`  // specify if msh runs as agent (controls ms on behalf of a remote msh front, "msh agent")
+			Port     int    `json:"Port"`     // port on which msh agent listens for msh front connections
+			PSK      string `json:"PSK"`      // pre-shared key used to authenticate msh agent and msh front ("" to use only tls)
+			CertFile string `json:"CertFile"` // tls certificate of this msh (mutual tls, "" to disable)
+			KeyFile  string `json:"KeyFile"`  // tls key of this msh
+			CAFile   string `json:"CAFile"`   // tls ca that signed the certificate of the other msh
+		} `json:"Agent"` // [agent mode, agent backend]
+		RconEndpoint struct {
+			Enabled  bool   `json:"Enabled"`  // specify if msh should listen for rcon clients
+			Port     int    `json:"Port"`     // port on which msh listens for rcon clients
+			Password string `json:"Password"` // password required to rcon clients
+			Policy   string `json:"Policy"`   // what to do with ms commands while ms is hibernating ("wake": warm ms and forward, "refuse": refuse)
+		} `json:"RconEndpoint"`
+		Hooks struct {
+			PreStart    Hook `json:"PreStart"`    // run before ms starts (non-zero exit aborts the start)
+			PostStart   Hook `json:"PostStart"`   // run when ms is online
+			PreStop     Hook `json:"PreStop"`     // run before ms is stopped
+			PostStop    Hook `json:"PostStop"`    // run when ms is offline
+			Suspend     Hook `json:"Suspend"`     // run when ms process is suspended
+			Resume      Hook `json:"Resume"`      // run when ms process is resumed
+			PlayerJoin  Hook `json:"PlayerJoin"`  // run when a player joins ms
+			PlayerLeave Hook `json:"PlayerLeave"` // run when a player leaves ms
+			MajorError  Hook `json:"MajorError"`  // run when ms encounters a major error
+		} `json:"Hooks"`
+		Watchdog struct {
+			Enabled        bool `json:"Enabled"`        // specify if msh should stop (and restart) ms when it hangs
+			StartupTimeout int  `json:"StartupTimeout"` // max time for ms to go online after it was started (seconds, 0 to disable)
+			PingInterval   int  `json:"PingInterval"`   // time interval between liveness probes while ms is online (seconds)
+			FailThreshold  int  `json:"FailThreshold"`  // consecutive failed liveness probes after which ms is considered hung
+			ThreadDump     bool `json:"ThreadDump"`     // specify if msh should capture a jvm thread dump of ms before stopping it
+			KillAfter      int  `json:"KillAfter"`      // time to wait for ms to stop before killing it (seconds)
+			Restart        bool `json:"Restart"`        // specify if msh should start ms again after stopping it
+		} `json:"Watchdog"`
+		Backend struct {
+			Type            string `json:"Type"`            // how msh manages ms ("terminal": ms is a child process of msh, "external": ms is managed by external commands, "docker": ms runs in a docker container, "http": remote ms managed by http calls, "agent": ms controlled by a remote msh agent)
+			StartCommand    string `json:"StartCommand"`    // [external] command that starts ms (example: "systemctl start minecraft")
+			StopCommand     string `json:"StopCommand"`     // [external] command that stops ms ("" to use Commands.StopServer)
+			StatusCommand   string `json:"StatusCommand"`   // [external] command that exits with 0 if ms is running ("" to disable)
+			Command         string `json:"Command"`         // [external] command that sends <command> to ms console, used if rcon is disabled (example: "tmux send-keys -t mc <command> Enter")
+			PollStatusPort  bool   `json:"PollStatusPort"`  // [external] ms status is tracked by pinging ms port
+			LogFile         string `json:"LogFile"`         // [external] ms log file followed to track ms status ("" to disable)
+			PollInterval    int    `json:"PollInterval"`    // [external, docker, http] time interval between ms status checks (seconds)
+			DockerSocket    string `json:"DockerSocket"`    // [docker] docker engine unix socket
+			DockerContainer string `json:"DockerContainer"` // [docker] name (or id) of ms container
+			DockerExec      string `json:"DockerExec"`      // [docker] command executed in ms container to send a command to ms ("" to write to container stdin)
+			Http            struct {
+				Host         string   `json:"Host"`         // remote ms host (msh proxies clients to Host:Port)
+				Port         int      `json:"Port"`         // remote ms port
+				Start        HttpCall `json:"Start"`        // call that starts the remote machine/ms
+				Stop         HttpCall `json:"Stop"`         // call that stops the remote machine/ms ("" url to use Commands.StopServer)
+				Status       HttpCall `json:"Status"`       // call that succeeds if the remote machine/ms is running ("" url to use status pings only)
+				Command      HttpCall `json:"Command"`      // call that sends <command> to ms console, used if rcon is disabled ("" url to disable)
+				Retries      int      `json:"Retries"`      // number of retries of a failed call
+				Timeout      int      `json:"Timeout"`      // timeout of a call (seconds)
+				Backoff      int      `json:"Backoff"`      // time to wait before the first retry, doubled at each retry (seconds)
+				ReadyTimeout int      `json:"ReadyTimeout"` // max time for the remote ms to answer status pings after start (seconds)
+			} `json:"Http"` // [http]
+			AgentAddress string `json:"AgentAddress"` // [agent] address of msh agent (example: "192.168.1.20:25590")
+		} `json:"Backend"`
 	} `json:"Msh"`
 }
 
+// struct for secret hostname (knock) in config file
+type KnockHostname struct {
+	Hostname string `json:"Hostname"` // secret hostname (example: "wake-7f3a.example.org")
+	Expiry   string `json:"Expiry"`   // expiry date (format: "2006-01-02" or RFC3339, "" to never expire)
+}
+
+// struct for user-defined log pattern profile in config file.
+// Patterns are regular expressions matched against ms log lines ("" to use the vanilla pattern).
+type LogProfile struct {
+	Name     string `json:"Name"`     // profile name (overrides a built-in profile with the same name)
+	Detect   string `json:"Detect"`   // matches a startup log line of the server software ("" to never detect the profile from log)
+	Done     string `json:"Done"`     // ms is online
+	Progress string `json:"Progress"` // ms load progress (first group is the progress, example: "(\\d+%)")
+	Join     string `json:"Join"`     // a player joined ms (first group is the player name)
+	Leave    string `json:"Leave"`    // a player left ms (first group is the player name)
+	Stopping string `json:"Stopping"` // ms is stopping
+	Crash    string `json:"Crash"`    // ms stopped responding or crashed
+	Lag      string `json:"Lag"`      // ms can't keep up
+}
+
+// struct for lifecycle hook in config file.
+// The hook receives its context as json on stdin and as MSH_* environment variables.
+type Hook struct {
+	Path    string `json:"Path"`    // executable run by the hook, relative to server folder ("" to disable)
+	Timeout int    `json:"Timeout"` // max execution time of the executable (seconds)
+}
+
+// struct for http call in config file.
+// <host>, <port> and <command> placeholders in Url and Body are replaced.
+type HttpCall struct {
+	URL          string            `json:"Url"`          // call url ("" to disable the call)
+	Method       string            `json:"Method"`       // http method ("" for POST)
+	Headers      map[string]string `json:"Headers"`      // request headers (example: {"Authorization": "Bearer <token>"})
+	Body         string            `json:"Body"`         // request body
+	ExpectStatus int               `json:"ExpectStatus"` // expected response status (0 for any 2xx)
+	ExpectBody   string            `json:"ExpectBody"`   // text expected in response body ("" for any)
+}
+
 // struct for message format txt
 type DataTxt struct {
 	Text string `json:"text"`
@@ -45,8 +208,9 @@ type DataInfo struct {
 		Text string `json:"text"`
 	} `json:"description"`
 	Players struct {
-		Max    int `json:"max"`
-		Online int `json:"online"`
+		Max    int            `json:"max"`
+		Online int            `json:"online"`
+		Sample []PlayerSample `json:"sample,omitempty"`
 	} `json:"players"`
 	Version struct {
 		Name     string `json:"name"`
@@ -55,6 +219,12 @@ type DataInfo struct {
 	Favicon string `json:"favicon"`
 }
 
+// struct for player in server info sample
+type PlayerSample struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
 type Api2Req struct {
 	ProtV int `json:"prot-v"` // msh protocol version
 	Msh   struct {
@@ -139,6 +309,34 @@ type MshInstanceV0 struct {
 	CheckSum string `json:"CheckSum"`
 }
 
+// struct for msh join history file (one entry for each client address)
+type JoinHistory struct {
+	LastJoin time.Time `json:"LastJoin"` // time of the last join
+	Joins    int       `json:"Joins"`    // number of joins
+	Hits     int       `json:"Hits"`     // pre-warms followed by a join
+	Misses   int       `json:"Misses"`   // pre-warms not followed by a join (each miss increases the pre-warm threshold)
+}
+
+// struct for msh connection log (one line for each connection attempt)
+type ConnEvent struct {
+	Time     time.Time `json:"time"`               // time of the connection attempt
+	Type     string    `json:"type"`               // request type (info, join, legacy, query)
+	IP       string    `json:"ip"`                 // client address
+	Hostname string    `json:"hostname,omitempty"` // server address used by the client (from handshake)
+	Protocol int       `json:"protocol,omitempty"` // client protocol (from handshake)
+	Version  string    `json:"version,omitempty"`  // client version (derived from protocol)
+	Player   string    `json:"player,omitempty"`   // player name (join only)
+	Decision string    `json:"decision"`           // action taken by msh
+}
+
+// struct for msh traffic file
+type TrafficTotals struct {
+	CycleStart string           `json:"CycleStart"` // start date of the current billing cycle
+	Cycle      int64            `json:"Cycle"`      // bytes exchanged in the current billing cycle
+	Warned     int              `json:"Warned"`     // last data cap percentage (80, 95, 100) for which players were warned
+	Days       map[string]int64 `json:"Days"`       // date -> bytes exchanged in the day
+}
+
 // struct for minecraft server whitelist file
 type MSWhitelist struct {
 	UUID string `json:"uuid"`
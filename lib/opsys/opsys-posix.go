@@ -3,6 +3,7 @@
 package opsys
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
@@ -64,6 +65,17 @@ func procTreeKill(ppid uint32) *errco.MshLog {
 	return nil
 }
 
+func procQuit(pid int32) *errco.MshLog {
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "sending quit signal to process (pid: %d)", pid)
+
+	err := syscall.Kill(int(pid), syscall.SIGQUIT)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_SIGNAL, err.Error())
+	}
+
+	return nil
+}
+
 func fileId(filePath string) (uint64, error) {
 	// https://github.com/hymkor/go-windows-fileid/blob/master/main_unix.go
 	fileInf, err := os.Stat(filePath)
@@ -76,3 +88,7 @@ func fileId(filePath string) (uint64, error) {
 	}
 	return stat.Ino, nil
 }
+
+func connRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
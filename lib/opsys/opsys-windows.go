@@ -3,6 +3,7 @@
 package opsys
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
@@ -150,6 +151,11 @@ func procTreeKill(ppid uint32) *errco.MshLog {
 	return nil
 }
 
+func procQuit(pid int32) *errco.MshLog {
+	// there is no quit signal on windows (jcmd should be used to get a thread dump)
+	return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_SIGNAL, "quit signal not supported on windows (pid: %d)", pid)
+}
+
 // ------------------- utils ------------------- //
 
 // getTreePids will return a list of pids that represent the tree of process pids originating from the specified one.
@@ -252,3 +258,7 @@ func fileId(filePath string) (uint64, error) {
 
 	return (uint64(data.FileIndexHigh) << 32) | uint64(data.FileIndexLow), nil
 }
+
+func connRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED) || errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -1,8 +1,16 @@
 package opsys
 
 import (
+	"bytes"
+	"os"
+	"os/exec"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
 
 	"msh/lib/errco"
 )
@@ -56,7 +64,118 @@ func ProcTreeKill(ppid uint32) *errco.MshLog {
 	return procTreeKill(ppid)
 }
 
+// ProcQuit sends a quit signal to a process (a java process prints a thread dump).
+// when succeeds returns nil
+func ProcQuit(pid int32) *errco.MshLog {
+	return procQuit(pid)
+}
+
+// ProcTreeJavaPid returns the pid of the first java process in a process tree by pid (root process included)
+func ProcTreeJavaPid(ppid uint32) (int32, *errco.MshLog) {
+	processes, err := process.Processes()
+	if err != nil {
+		return -1, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_LIST, "could't get processes slice (%s)", err.Error())
+	}
+
+	// children of each process
+	children := map[int32][]*process.Process{}
+	var root *process.Process
+	for _, p := range processes {
+		if p.Pid == int32(ppid) {
+			root = p
+		}
+		if parent, err := p.Ppid(); err == nil {
+			children[parent] = append(children[parent], p)
+		}
+	}
+	if root == nil {
+		return -1, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_NOT_FOUND, "process with pid %d not found", ppid)
+	}
+
+	// breadth-first search (the java process might be started by a script)
+	queue := []*process.Process{root}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		if name, err := p.Name(); err == nil && strings.TrimSuffix(strings.ToLower(name), ".exe") == "java" {
+			return p.Pid, nil
+		}
+
+		queue = append(queue, children[p.Pid]...)
+	}
+
+	return -1, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_NOT_FOUND, "java process not found in process tree (pid: %d)", ppid)
+}
+
 // FileId returns file id
 func FileId(filePath string) (uint64, error) {
 	return fileId(filePath)
 }
+
+// ConnRefused returns true if err is caused by a refused connection
+func ConnRefused(err error) bool {
+	return connRefused(err)
+}
+
+// outputGrace is the time for which output is still collected after the process exited
+const outputGrace time.Duration = 100 * time.Millisecond
+
+// CombinedOutput runs cmd and returns its combined stdout and stderr.
+//
+// Unlike exec.Cmd.CombinedOutput, it doesn't wait for background processes started by cmd
+// that inherited stdout/stderr (example: "nohup java ... &"):
+// their output is drained and discarded once cmd exited (after outputGrace).
+func CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// the pipe is passed as *os.File: exec doesn't start copy goroutines that Wait would wait for
+	cmd.Stdout, cmd.Stderr = pw, pw
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	m := &sync.Mutex{}
+	out := &bytes.Buffer{}
+	collect := true
+	done := make(chan struct{})
+
+	// read the pipe until all processes that inherited it exit
+	// (background processes don't receive SIGPIPE when writing to it)
+	go func() {
+		defer close(done)
+		defer pr.Close()
+
+		buf := make([]byte, 4096)
+		for {
+			n, err := pr.Read(buf)
+			m.Lock()
+			if collect {
+				out.Write(buf[:n])
+			}
+			m.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(outputGrace):
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	collect = false
+
+	return out.Bytes(), err
+}
@@ -30,6 +30,9 @@ var (
 	}
 )
 
+// OnExit, if not nil, is called before msh exits
+var OnExit func()
+
 type program struct {
 	startTime time.Time      // msh program start time
 	sigExit   chan os.Signal // channel through which OS termination signals are notified
@@ -69,7 +72,7 @@ func MshMgr() {
 		case errco.SERVER_STATUS_STOPPING:
 			// if server is correctly stopping, wait for minecraft server to exit
 			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "waiting for minecraft server terminal to exit (minecraft server is stopping)")
-			servctrl.ServTerm.Wg.Wait()
+			servctrl.WaitMSExit()
 
 		case errco.SERVER_STATUS_OFFLINE:
 			// if server is offline, then it's safe to continue
@@ -79,6 +82,11 @@ func MshMgr() {
 			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "stop command does not seem to be stopping minecraft server during forceful shutdown")
 		}
 
+		// save data kept in memory
+		if OnExit != nil {
+			OnExit()
+		}
+
 		// exit
 		errco.NewLogln(errco.TYPE_INF, errco.LVL_0, errco.ERROR_NIL, "exiting msh")
 		os.Exit(0)
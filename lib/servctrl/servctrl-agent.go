@@ -0,0 +1,431 @@
+package servctrl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/servstats"
+)
+
+// AgentProtocolVersion is the version of the protocol between msh agent and msh front.
+// Peers using a different version refuse the connection.
+const AgentProtocolVersion int = 2
+
+const (
+	agentAuthTimeout  time.Duration = 10 * time.Second       // max time to complete the agent handshake
+	agentPingInterval time.Duration = 15 * time.Second       // time interval between msh front pings
+	agentIdleTimeout  time.Duration = 3 * agentPingInterval  // connection is considered lost if nothing is received for this time
+	agentStatusPoll   time.Duration = 250 * time.Millisecond // time interval between checks of ms status changes (sent to msh front)
+	agentLineBuffer   int           = 256                    // ms lines buffered for each msh front connection
+)
+
+// agent protocol operations (requested by msh front)
+const (
+	agentOpAuth    string = "auth"
+	agentOpPing    string = "ping"
+	agentOpStart   string = "start"
+	agentOpStop    string = "stop"
+	agentOpSuspend string = "suspend"
+	agentOpResume  string = "resume"
+	agentOpKill    string = "kill"
+	agentOpCommand string = "command"
+)
+
+// agent protocol events (sent by msh agent)
+const (
+	agentEvChallenge string = "challenge" // first message of the handshake
+	agentEvResult    string = "result"    // result of an operation (same id of the request)
+	agentEvStatus    string = "status"    // ms status changed
+	agentEvLog       string = "log"       // ms terminal/log line
+)
+
+// agentMsg is a message of the agent protocol.
+// Messages are json objects separated by \n.
+// After the handshake each message is prefixed by its hmac with the session key and a space.
+type agentMsg struct {
+	V           int    `json:"v"`                     // protocol version
+	ID          int    `json:"id,omitempty"`          // request id (result events have the id of the request)
+	Op          string `json:"op,omitempty"`          // [request] operation
+	Arg         string `json:"arg,omitempty"`         // [request] operation argument (command)
+	Event       string `json:"event,omitempty"`       // [event] event type
+	Ok          bool   `json:"ok,omitempty"`          // [result] operation succeeded
+	Err         string `json:"err,omitempty"`         // [result] operation error
+	Out         string `json:"out,omitempty"`         // [result, log] command output, ms line
+	Nonce       string `json:"nonce,omitempty"`       // [challenge, auth] random nonce that the peer must authenticate
+	Mac         string `json:"mac,omitempty"`         // [auth, result] hmac of the peer nonce with the pre-shared key
+	Status      int    `json:"status"`                // [status, result] ms status
+	Suspended   bool   `json:"suspended,omitempty"`   // [status, result] ms is suspended
+	Suspendable bool   `json:"suspendable,omitempty"` // [status] ms can be suspended
+}
+
+// agentPeer is a connection between msh agent and msh front
+type agentPeer struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	wm      *sync.Mutex // serializes writes
+	role    string      // role of this peer ("agent" or "front")
+	key     []byte      // session key (nil during the handshake)
+	sendSeq uint64      // number of messages sent with the session key
+	recvSeq uint64      // number of messages received with the session key
+}
+
+// newAgentPeer returns a new agent peer on conn
+func newAgentPeer(conn net.Conn, role string) *agentPeer {
+	return &agentPeer{conn: conn, r: bufio.NewReader(conn), wm: &sync.Mutex{}, role: role}
+}
+
+// setSessionKey sets the session key derived from the handshake nonces:
+// every following message is authenticated so that it can't be forged, replayed or reordered.
+// (must be called when no message is being sent or received)
+func (p *agentPeer) setSessionKey(agentNonce, frontNonce string) {
+	p.key = []byte(agentMac("session", agentNonce+":"+frontNonce))
+}
+
+// messageMac returns the hmac of a message sent by role with sequence number seq
+func (p *agentPeer) messageMac(role string, seq uint64, data []byte) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(role + ":" + strconv.FormatUint(seq, 10) + ":"))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// peerRole returns the role of the other peer
+func (p *agentPeer) peerRole() string {
+	if p.role == "agent" {
+		return "front"
+	}
+	return "agent"
+}
+
+// send writes a message to the peer
+func (p *agentPeer) send(msg *agentMsg) error {
+	msg.V = AgentProtocolVersion
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	p.wm.Lock()
+	defer p.wm.Unlock()
+
+	if p.key != nil {
+		data = append([]byte(p.messageMac(p.role, p.sendSeq, data)+" "), data...)
+		p.sendSeq++
+	}
+
+	_, err = p.conn.Write(append(data, '\n'))
+	return err
+}
+
+// receive reads a message from the peer (with the specified timeout)
+func (p *agentPeer) receive(timeout time.Duration) (*agentMsg, error) {
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+
+	line, err := p.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if p.key != nil {
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		mac, data, found := bytes.Cut(line, []byte(" "))
+		if !found || !hmac.Equal(mac, []byte(p.messageMac(p.peerRole(), p.recvSeq, data))) {
+			return nil, fmt.Errorf("message authentication failed")
+		}
+		p.recvSeq++
+		line = data
+	}
+
+	msg := &agentMsg{}
+	err = json.Unmarshal(line, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.V != AgentProtocolVersion {
+		return nil, fmt.Errorf("unsupported agent protocol version %d (supported: %d)", msg.V, AgentProtocolVersion)
+	}
+
+	return msg, nil
+}
+
+// agentLines are the channels of msh front connections that receive ms lines
+var agentLines = struct {
+	m    *sync.Mutex
+	subs map[chan string]struct{}
+}{m: &sync.Mutex{}, subs: map[chan string]struct{}{}}
+
+// publishLine sends a ms terminal/log line to msh front connections (if msh is running as agent)
+func publishLine(line string) {
+	agentLines.m.Lock()
+	defer agentLines.m.Unlock()
+
+	for sub := range agentLines.subs {
+		// must be a non-blocking select or a slow connection might cause hanging
+		select {
+		case sub <- line:
+		default:
+		}
+	}
+}
+
+// Agent listens for msh front connections and controls ms on their behalf.
+// ms keeps running if the connection with msh front is lost.
+//
+// msh fronts are authenticated with the pre-shared key (Agent.PSK) and/or mutual tls (Agent.CertFile, Agent.KeyFile, Agent.CAFile).
+func Agent() *errco.MshLog {
+	addr := net.JoinHostPort(config.MshHost, strconv.Itoa(config.ConfigRuntime.Msh.Agent.Port))
+
+	var listener net.Listener
+	var err error
+	if config.ConfigRuntime.Msh.Agent.CertFile != "" {
+		tlsConfig, logMsh := agentTLSConfig(true)
+		if logMsh != nil {
+			return logMsh.AddTrace()
+		}
+		listener, err = tls.Listen("tcp", addr, tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_AGENT, "agent listen: %s", err.Error())
+	}
+	defer listener.Close()
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "%-40s %10s:%5d ...", "listening for msh front connections on", config.MshHost, config.ConfigRuntime.Msh.Agent.Port)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_AGENT, "agent accept: %s", err.Error())
+			continue
+		}
+
+		go agentServe(conn)
+	}
+}
+
+// agentServe handles a msh front connection
+// [goroutine]
+func agentServe(conn net.Conn) {
+	defer conn.Close()
+
+	p := newAgentPeer(conn, "agent")
+
+	// handshake
+	nonce := agentNonce()
+	err := p.send(&agentMsg{Event: agentEvChallenge, Nonce: nonce})
+	if err != nil {
+		return
+	}
+
+	auth, err := p.receive(agentAuthTimeout)
+	if err != nil {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_AGENT, "msh front %s: handshake: %s", conn.RemoteAddr(), err.Error())
+		p.send(&agentMsg{Event: agentEvResult, Err: err.Error()})
+		return
+	}
+	if auth.Op != agentOpAuth || !hmac.Equal([]byte(auth.Mac), []byte(agentMac("front", nonce))) {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_AGENT, "msh front %s: authentication failed", conn.RemoteAddr())
+		p.send(&agentMsg{Event: agentEvResult, ID: auth.ID, Err: "authentication failed"})
+		return
+	}
+
+	// subscribe to ms lines before sending the status snapshot
+	lines := make(chan string, agentLineBuffer)
+	agentLines.m.Lock()
+	agentLines.subs[lines] = struct{}{}
+	agentLines.m.Unlock()
+	defer func() {
+		agentLines.m.Lock()
+		delete(agentLines.subs, lines)
+		agentLines.m.Unlock()
+	}()
+
+	err = p.send(&agentMsg{Event: agentEvResult, ID: auth.ID, Ok: true, Mac: agentMac("agent", auth.Nonce)})
+	if err != nil {
+		return
+	}
+	p.setSessionKey(nonce, auth.Nonce)
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "msh front %s: connected", conn.RemoteAddr())
+	defer errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "msh front %s: disconnected", conn.RemoteAddr())
+
+	// goroutines of the connection must return before agentServe does
+	wg := &sync.WaitGroup{}
+	done := make(chan struct{})
+	defer func() {
+		conn.Close()
+		close(done)
+		wg.Wait()
+	}()
+
+	// stream ms status changes and lines
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agentStream(p, lines, done)
+	}()
+
+	for {
+		req, err := p.receive(agentIdleTimeout)
+		if err != nil {
+			return
+		}
+
+		// operations might take some time (ms command output): pings must not be delayed
+		wg.Add(1)
+		go func(req *agentMsg) {
+			defer wg.Done()
+			res := agentOp(req.Op, req.Arg)
+			res.ID = req.ID
+			p.send(res)
+		}(req)
+	}
+}
+
+// agentStream sends ms status (when it changes) and ms lines to msh front
+// [goroutine]
+func agentStream(p *agentPeer, lines chan string, done chan struct{}) {
+	ticker := time.NewTicker(agentStatusPoll)
+	defer ticker.Stop()
+
+	var last *agentMsg
+
+	for {
+		status := agentStatus()
+		if last == nil || *status != *last {
+			if p.send(status) != nil {
+				return
+			}
+			last = status
+		}
+
+		select {
+		case <-done:
+			return
+		case line := <-lines:
+			if p.send(&agentMsg{Event: agentEvLog, Out: line}) != nil {
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// agentStatus returns the status event of ms
+func agentStatus() *agentMsg {
+	return &agentMsg{
+		V:           AgentProtocolVersion,
+		Event:       agentEvStatus,
+		Status:      servstats.Stats.Status,
+		Suspended:   servstats.Stats.Suspended,
+		Suspendable: ServTerm.IsActive && getBackend().suspendable(),
+	}
+}
+
+// agentOp executes an operation requested by msh front and returns its result
+func agentOp(op, arg string) *agentMsg {
+	var out string
+	var logMsh *errco.MshLog
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "msh front requested: %s %s", op, arg)
+
+	switch op {
+	case agentOpPing:
+	case agentOpStart:
+		logMsh = startMS()
+	case agentOpStop:
+		logMsh = stopMS()
+	case agentOpSuspend:
+		if !ServTerm.IsActive || !getBackend().suspendable() {
+			logMsh = errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_SUSPEND_CALL, "minecraft server can't be suspended")
+			break
+		}
+		logMsh = suspendMS()
+	case agentOpResume:
+		if !ServTerm.IsActive || !getBackend().suspendable() {
+			break
+		}
+		logMsh = resumeMS()
+	case agentOpKill:
+		if !ServTerm.IsActive {
+			logMsh = errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_KILL, "minecraft server is not running")
+			break
+		}
+		logMsh = getBackend().kill()
+	case agentOpCommand:
+		out, logMsh = Execute(arg)
+	default:
+		logMsh = errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_AGENT, "unknown agent operation: %s", op)
+	}
+
+	res := agentStatus()
+	res.Event = agentEvResult
+	res.Out = out
+	res.Ok = logMsh == nil
+	if logMsh != nil {
+		logMsh.Log(true)
+		res.Err = fmt.Sprintf(logMsh.Mex, logMsh.Arg...)
+	}
+
+	return res
+}
+
+// agentNonce returns a random nonce
+func agentNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// agentMac returns the hmac (with the pre-shared key) of the nonce authenticated by the specified role.
+// The role prevents a peer from reflecting the other peer challenge.
+func agentMac(role, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(config.ConfigRuntime.Msh.Agent.PSK))
+	mac.Write([]byte(role + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// agentTLSConfig returns the mutual tls config of msh agent (server == true) or msh front
+func agentTLSConfig(server bool) (*tls.Config, *errco.MshLog) {
+	cert, err := tls.LoadX509KeyPair(config.ConfigRuntime.Msh.Agent.CertFile, config.ConfigRuntime.Msh.Agent.KeyFile)
+	if err != nil {
+		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_AGENT, "agent tls certificate: %s", err.Error())
+	}
+
+	ca, err := os.ReadFile(config.ConfigRuntime.Msh.Agent.CAFile)
+	if err != nil {
+		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_AGENT, "agent tls ca: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_AGENT, "agent tls ca: no certificates found in %s", config.ConfigRuntime.Msh.Agent.CAFile)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if server {
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
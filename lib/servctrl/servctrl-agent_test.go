@@ -0,0 +1,192 @@
+package servctrl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+// startTestAgent starts a msh agent listener and returns its address and accepted connections
+func startTestAgent(t *testing.T) (string, func() []net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// agentServe goroutines must return before the next test changes the config
+	wg := &sync.WaitGroup{}
+	t.Cleanup(wg.Wait)
+	t.Cleanup(func() { l.Close() })
+
+	m := &sync.Mutex{}
+	conns := []net.Conn{}
+
+	// close accepted connections so that msh fronts of the test stop
+	t.Cleanup(func() {
+		m.Lock()
+		defer m.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			m.Lock()
+			conns = append(conns, conn)
+			m.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				agentServe(conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), func() []net.Conn {
+		m.Lock()
+		defer m.Unlock()
+		return append([]net.Conn{}, conns...)
+	}
+}
+
+func Test_agentHandshake(t *testing.T) {
+	config.ConfigRuntime.Msh.Agent.PSK = "secret"
+	addr, _ := startTestAgent(t)
+
+	// msh front with the pre-shared key
+	p, err := agentConnect(addr)
+	if err != nil {
+		t.Fatalf("agentConnect: %s", err.Error())
+	}
+
+	// messages are authenticated with the session key: a replayed message closes the connection
+	data := []byte(fmt.Sprintf(`{"v":%d,"id":1,"op":"ping","status":0}`, AgentProtocolVersion))
+	line := []byte(p.messageMac("front", 0, data) + " " + string(data) + "\n")
+	p.conn.Write(line)
+	for {
+		msg, err := p.receive(2 * time.Second)
+		if err != nil {
+			t.Fatalf("ping: %s", err.Error())
+		}
+		if msg.Event == agentEvResult && msg.ID == 1 && msg.Ok {
+			break
+		}
+	}
+	p.conn.Write(line)
+	for {
+		if _, err := p.receive(2 * time.Second); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Error("replayed message: connection not closed")
+			}
+			break
+		}
+	}
+	p.conn.Close()
+
+	// raw connection: the agent rejects wrong keys and other protocol versions
+	for _, c := range []struct {
+		name string
+		auth func(nonce string) string
+		exp  string
+	}{
+		{"wrong key", func(nonce string) string {
+			return fmt.Sprintf(`{"v":%d,"op":"auth","nonce":"00","mac":"%s"}`, AgentProtocolVersion, strings.Repeat("0", 64))
+		}, "authentication failed"},
+		{"other version", func(nonce string) string {
+			return fmt.Sprintf(`{"v":%d,"op":"auth","nonce":"00","mac":"%s"}`, AgentProtocolVersion+1, agentMac("front", nonce))
+		}, fmt.Sprintf("unsupported agent protocol version %d", AgentProtocolVersion+1)},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+
+		challenge := &agentMsg{}
+		line, _ := r.ReadBytes('\n')
+		if json.Unmarshal(line, challenge) != nil || challenge.Event != agentEvChallenge {
+			t.Fatalf("%s: unexpected challenge %q", c.name, line)
+		}
+
+		conn.Write([]byte(c.auth(challenge.Nonce) + "\n"))
+
+		res := &agentMsg{}
+		line, _ = r.ReadBytes('\n')
+		if json.Unmarshal(line, res) != nil || res.Ok || !strings.Contains(res.Err, c.exp) {
+			t.Errorf("%s: unexpected result %q", c.name, line)
+		}
+
+		// connection is closed by the agent
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := r.ReadBytes('\n'); err == nil {
+			t.Errorf("%s: connection not closed", c.name)
+		}
+		conn.Close()
+	}
+}
+
+func Test_agentBackend(t *testing.T) {
+	config.ConfigRuntime.Msh.Agent.PSK = "secret"
+	addr, conns := startTestAgent(t)
+
+	a := &agentBackend{m: &sync.Mutex{}, pending: map[int]chan *agentMsg{}}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		a.run(addr, stop)
+		close(stopped)
+	}()
+
+	// msh front returns when the connection with the agent is lost
+	t.Cleanup(func() {
+		close(stop)
+		for _, c := range conns() {
+			c.Close()
+		}
+		<-stopped
+	})
+
+	if _, err := a.request(agentOpPing, ""); err != nil {
+		t.Fatalf("ping: %s", err.Error())
+	}
+
+	// agent errors are returned to msh front
+	if _, logMsh := a.send("list"); logMsh == nil || !strings.Contains(logMsh.Arg[0].(string), "not active") {
+		t.Errorf("command on offline ms: unexpected result %v", logMsh)
+	}
+
+	// connection lost: msh front reconnects
+	for _, c := range conns() {
+		c.Close()
+	}
+	for i := 0; i < 100; i++ {
+		a.m.Lock()
+		connected := a.peer != nil
+		a.m.Unlock()
+		if !connected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := a.request(agentOpPing, ""); err != nil {
+		t.Fatalf("ping after reconnection: %s", err.Error())
+	}
+	if n := len(conns()); n != 2 {
+		t.Errorf("%d connections to msh agent, expected 2", n)
+	}
+}
@@ -0,0 +1,386 @@
+package servctrl
+
+import (
+	"crypto/hmac"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/servstats"
+)
+
+const (
+	agentDialTimeout  time.Duration = 10 * time.Second // timeout for the connection to msh agent
+	agentConnWait     time.Duration = 10 * time.Second // max time an operation waits for the connection to msh agent (reconnecting)
+	agentOpTimeout    time.Duration = 30 * time.Second // max time to wait for the result of an operation
+	agentBackoffMax   time.Duration = 30 * time.Second // max time between reconnection attempts
+	agentBackoffStart time.Duration = 1 * time.Second  // time before the first reconnection attempt
+)
+
+// agBackend is the agent backend
+var agBackend *agentBackend = &agentBackend{m: &sync.Mutex{}, pending: map[int]chan *agentMsg{}}
+
+// agentBackend represents a ms controlled by a remote msh agent (msh front mode).
+//
+// The connection with msh agent is re-established if lost:
+// operations requested while reconnecting wait for the connection (at most agentConnWait)
+// and ms status is synchronized as soon as the connection is back.
+type agentBackend struct {
+	m          *sync.Mutex
+	peer       *agentPeer             // connection with msh agent (nil if not connected)
+	nextID     int                    // id of the next request
+	pending    map[int]chan *agentMsg // requests waiting for a result
+	canSuspend bool                   // ms can be suspended (reported by msh agent)
+	startedMsh bool                   // ms was started by msh (startup time can be measured)
+}
+
+// start requests msh agent to start ms
+func (a *agentBackend) start() *errco.MshLog {
+	if ServTerm.IsActive {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_SERVER_IS_WARM, "minecraft server already running")
+		return nil
+	}
+
+	// set before the request: msh agent might report the starting status before the result
+	a.m.Lock()
+	a.startedMsh = true
+	a.m.Unlock()
+
+	_, err := a.request(agentOpStart, "")
+	if err != nil {
+		a.m.Lock()
+		a.startedMsh = false
+		a.m.Unlock()
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_TERMINAL_START, "agent start: %s", err.Error())
+	}
+
+	if !ServTerm.IsActive {
+		setStarting()
+	}
+
+	return nil
+}
+
+// stop requests msh agent to stop ms
+func (a *agentBackend) stop() *errco.MshLog {
+	_, err := a.request(agentOpStop, "")
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_KILL, "agent stop: %s", err.Error())
+	}
+
+	return nil
+}
+
+// send requests msh agent to execute a command on ms (returns the command output)
+func (a *agentBackend) send(command string) (string, *errco.MshLog) {
+	res, err := a.request(agentOpCommand, command)
+	if err != nil {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "agent command: %s", err.Error())
+	}
+
+	return res.Out, nil
+}
+
+// suspendable returns true if msh agent is connected and reported that ms can be suspended
+func (a *agentBackend) suspendable() bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	return a.peer != nil && a.canSuspend
+}
+
+// suspend requests msh agent to suspend ms
+func (a *agentBackend) suspend() (bool, *errco.MshLog) {
+	res, err := a.request(agentOpSuspend, "")
+	if err != nil {
+		return false, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_SUSPEND_CALL, "agent suspend: %s", err.Error())
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "EXECUTED AGENT SUSPEND!")
+
+	return res.Suspended, nil
+}
+
+// resume requests msh agent to resume ms
+func (a *agentBackend) resume() (bool, *errco.MshLog) {
+	res, err := a.request(agentOpResume, "")
+	if err != nil {
+		return true, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_RESUME_CALL, "agent resume: %s", err.Error())
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "EXECUTED AGENT RESUME!")
+
+	return res.Suspended, nil
+}
+
+// kill requests msh agent to kill ms
+func (a *agentBackend) kill() *errco.MshLog {
+	_, err := a.request(agentOpKill, "")
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_KILL, "agent kill: %s", err.Error())
+	}
+
+	return nil
+}
+
+// wait waits for ms status to be offline (or for the connection with msh agent to be lost)
+func (a *agentBackend) wait() {
+	for servstats.Stats.Status != errco.SERVER_STATUS_OFFLINE {
+		a.m.Lock()
+		connected := a.peer != nil
+		a.m.Unlock()
+		if !connected {
+			return
+		}
+
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// AgentMonitor keeps the connection with msh agent (Backend.AgentAddress) and
+// synchronizes ms status with the status reported by msh agent.
+//
+// [goroutine]
+func AgentMonitor() {
+	agBackend.run(config.ConfigRuntime.Msh.Backend.AgentAddress, nil)
+}
+
+// run connects to msh agent and reconnects (with backoff) when the connection is lost.
+// If stop is closed, run returns after the current connection is lost.
+func (a *agentBackend) run(addr string, stop chan struct{}) {
+	backoff := agentBackoffStart
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		p, err := agentConnect(addr)
+		if err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_AGENT, "msh agent %s: %s (retry in %s)", addr, err.Error(), backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > agentBackoffMax {
+				backoff = agentBackoffMax
+			}
+			continue
+		}
+
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "msh agent %s: connected", addr)
+		backoff = agentBackoffStart
+
+		a.serve(p)
+
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_AGENT, "msh agent %s: connection lost (ms keeps running, reconnecting...)", addr)
+	}
+}
+
+// serve handles the messages received from msh agent until the connection is lost
+func (a *agentBackend) serve(p *agentPeer) {
+	a.m.Lock()
+	a.peer = p
+	a.m.Unlock()
+
+	// keep the connection alive
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(agentPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				a.m.Lock()
+				a.nextID++
+				id := a.nextID
+				a.m.Unlock()
+				p.send(&agentMsg{ID: id, Op: agentOpPing})
+			}
+		}
+	}()
+
+	for {
+		msg, err := p.receive(agentIdleTimeout)
+		if err != nil {
+			break
+		}
+
+		switch msg.Event {
+		case agentEvStatus:
+			a.sync(msg)
+
+		case agentEvLog:
+			errco.NewLogln(errco.TYPE_SER, errco.LVL_2, errco.ERROR_NIL, msg.Out)
+
+		case agentEvResult:
+			a.m.Lock()
+			res, ok := a.pending[msg.ID]
+			delete(a.pending, msg.ID)
+			a.m.Unlock()
+			if ok {
+				res <- msg
+			}
+		}
+	}
+
+	close(done)
+	p.conn.Close()
+
+	// requests waiting for a result will not receive it
+	a.m.Lock()
+	a.peer = nil
+	for id, res := range a.pending {
+		close(res)
+		delete(a.pending, id)
+	}
+	a.m.Unlock()
+}
+
+// sync synchronizes ms status with the status reported by msh agent
+func (a *agentBackend) sync(msg *agentMsg) {
+	a.m.Lock()
+	a.canSuspend = msg.Suspendable
+	startedMsh := a.startedMsh
+	a.m.Unlock()
+
+	// ms was started by msh front, by msh agent console or before msh front connected
+	if msg.Status != errco.SERVER_STATUS_OFFLINE && !ServTerm.IsActive {
+		if !startedMsh {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "minecraft server is running on msh agent")
+		}
+		setStarting()
+	}
+
+	switch {
+	case msg.Status == errco.SERVER_STATUS_ONLINE && servstats.Stats.Status == errco.SERVER_STATUS_STARTING:
+		setOnline(startedMsh)
+	case msg.Status == errco.SERVER_STATUS_STOPPING && servstats.Stats.Status != errco.SERVER_STATUS_STOPPING:
+		servstats.Stats.Status = errco.SERVER_STATUS_STOPPING
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS STOPPING!")
+	case msg.Status == errco.SERVER_STATUS_OFFLINE && ServTerm.IsActive:
+		a.m.Lock()
+		a.startedMsh = false
+		a.m.Unlock()
+		setOffline()
+	}
+
+	if ServTerm.IsActive {
+		servstats.Stats.Suspended = msg.Suspended
+	}
+}
+
+// request sends an operation request to msh agent and waits for its result
+func (a *agentBackend) request(op, arg string) (*agentMsg, error) {
+	// wait for the connection with msh agent (it might be reconnecting)
+	deadline := time.Now().Add(agentConnWait)
+	for {
+		a.m.Lock()
+		if a.peer != nil {
+			break
+		}
+		a.m.Unlock()
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("msh agent not connected")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	a.nextID++
+	id := a.nextID
+	res := make(chan *agentMsg, 1)
+	a.pending[id] = res
+	p := a.peer
+	a.m.Unlock()
+
+	err := p.send(&agentMsg{ID: id, Op: op, Arg: arg})
+	if err != nil {
+		a.m.Lock()
+		delete(a.pending, id)
+		a.m.Unlock()
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-res:
+		if !ok {
+			return nil, fmt.Errorf("connection with msh agent lost")
+		}
+		if !msg.Ok {
+			return nil, fmt.Errorf("%s", msg.Err)
+		}
+		return msg, nil
+
+	case <-time.After(agentOpTimeout):
+		a.m.Lock()
+		delete(a.pending, id)
+		a.m.Unlock()
+		return nil, fmt.Errorf("msh agent did not answer in %s", agentOpTimeout)
+	}
+}
+
+// agentConnect connects to msh agent and performs the handshake
+func agentConnect(addr string) (*agentPeer, error) {
+	var conn net.Conn
+	var err error
+	if config.ConfigRuntime.Msh.Agent.CertFile != "" {
+		tlsConfig, logMsh := agentTLSConfig(false)
+		if logMsh != nil {
+			return nil, fmt.Errorf(logMsh.Mex, logMsh.Arg...)
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: agentDialTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, agentDialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := newAgentPeer(conn, "front")
+
+	err = agentHandshake(p)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// agentHandshake authenticates msh front to msh agent and msh agent to msh front
+func agentHandshake(p *agentPeer) error {
+	challenge, err := p.receive(agentAuthTimeout)
+	if err != nil {
+		return err
+	}
+	if challenge.Event != agentEvChallenge {
+		return fmt.Errorf("unexpected handshake message")
+	}
+
+	nonce := agentNonce()
+	err = p.send(&agentMsg{Op: agentOpAuth, Nonce: nonce, Mac: agentMac("front", challenge.Nonce)})
+	if err != nil {
+		return err
+	}
+
+	res, err := p.receive(agentAuthTimeout)
+	if err != nil {
+		return err
+	}
+	if !res.Ok {
+		return fmt.Errorf("msh agent refused connection: %s", res.Err)
+	}
+	if !hmac.Equal([]byte(res.Mac), []byte(agentMac("agent", nonce))) {
+		return fmt.Errorf("msh agent authentication failed")
+	}
+	p.setSessionKey(challenge.Nonce, nonce)
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package servctrl
+
+import (
+	"fmt"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/hook"
+	"msh/lib/servstats"
+)
+
+// backend represents the way msh starts, stops and interacts with ms
+type backend interface {
+	// start starts ms
+	start() *errco.MshLog
+	// stop stops ms
+	stop() *errco.MshLog
+	// send writes a command to ms console.
+	// Returns the command output if the backend receives it ("" if output is read from ms terminal/log)
+	send(command string) (string, *errco.MshLog)
+	// suspendable returns true if ms can be suspended
+	suspendable() bool
+	// suspend suspends ms (returns ms suspension state)
+	suspend() (bool, *errco.MshLog)
+	// resume resumes ms (returns ms suspension state)
+	resume() (bool, *errco.MshLog)
+	// kill kills ms
+	kill() *errco.MshLog
+	// wait waits for ms to exit
+	wait()
+}
+
+// monitoredBackend is a backend that manages a ms that is not a child process of msh:
+// ms status is tracked by polling the backend (see monitorMS)
+type monitoredBackend interface {
+	// poll returns if ms is running and if ms is ready (online)
+	poll() (bool, bool, *errco.MshLog)
+	// detected is called when ms is found running but ms was not started by msh
+	detected()
+	// exited is called when ms is found not running
+	exited()
+	// measured returns true if ms was started by msh (startup time can be measured)
+	measured() bool
+}
+
+// getBackend returns the backend specified in config
+func getBackend() backend {
+	switch config.ConfigRuntime.Msh.Backend.Type {
+	case config.BACKEND_EXTERNAL:
+		return extBackend
+	case config.BACKEND_DOCKER:
+		return dkBackend
+	case config.BACKEND_HTTP:
+		return htBackend
+	case config.BACKEND_AGENT:
+		return agBackend
+	default:
+		return ServTerm
+	}
+}
+
+// WaitMSExit waits for ms to exit
+func WaitMSExit() {
+	getBackend().wait()
+}
+
+// monitorMS tracks the status of a ms managed by a monitored backend.
+//
+// ms might be started/stopped externally (not by msh): in this case msh
+// detects it and manages the hibernation as if ms was started by msh.
+func monitorMS(mb monitoredBackend) {
+	pollInterval := time.Duration(config.ConfigRuntime.Msh.Backend.PollInterval) * time.Second
+	if pollInterval <= 0 {
+		pollInterval = 2 * time.Second
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		running, ready, logMsh := mb.poll()
+		if logMsh != nil {
+			logMsh.Log(true)
+			<-ticker.C
+			continue
+		}
+
+		switch {
+		case running && !ServTerm.IsActive:
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "minecraft server was started externally")
+			setStarting()
+			mb.detected()
+
+		case !running && ServTerm.IsActive:
+			mb.exited()
+			setOffline()
+		}
+
+		// ms is ready: it's online (if ms output didn't already report it)
+		if ServTerm.IsActive && servstats.Stats.Status == errco.SERVER_STATUS_STARTING && ready {
+			setOnline(mb.measured())
+		}
+
+		<-ticker.C
+	}
+}
+
+// waitOffline waits for ms to go offline for the specified time (timeout <= 0: no time limit).
+// Returns true if ms is offline.
+func waitOffline(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		// status might be set by a monitor goroutine
+		servstats.Stats.M.Lock()
+		offline := servstats.Stats.Status == errco.SERVER_STATUS_OFFLINE
+		servstats.Stats.M.Unlock()
+		if offline {
+			return true
+		}
+
+		if timeout > 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// outputLine handles a line of ms terminal/log:
+// the line is logged, added to the output ring buffer (so that func Execute() can collect the output of the command)
+// and sent to msh front (agent mode).
+// The line should then be parsed by the caller.
+func outputLine(line string) {
+	errco.NewLogln(errco.TYPE_SER, errco.LVL_2, errco.ERROR_NIL, line)
+
+	termOut.add(line)
+
+	publishLine(line)
+}
+
+// suspendAllowed returns true if ms suspension is allowed and possible
+func suspendAllowed() bool {
+	return config.ConfigRuntime.Msh.SuspendAllow && getBackend().suspendable()
+}
+
+// startMS runs the pre-start hook and starts ms.
+// If the pre-start hook fails, ms is not started.
+//
+// While the pre-start hook runs Stats.Starting is true (ms status is offline):
+// concurrent calls return ERROR_SERVER_STARTING without running the hook again.
+func startMS() *errco.MshLog {
+	servstats.Stats.M.Lock()
+	if servstats.Stats.Starting {
+		servstats.Stats.M.Unlock()
+		return errco.NewLog(errco.TYPE_INF, errco.LVL_3, errco.ERROR_SERVER_STARTING, "minecraft server start already in progress")
+	}
+	servstats.Stats.Starting = true
+	servstats.Stats.M.Unlock()
+
+	// starting phase ends when ms is starting (or start failed)
+	defer func() {
+		servstats.Stats.M.Lock()
+		servstats.Stats.Starting = false
+		servstats.Stats.M.Unlock()
+	}()
+
+	logMsh := hook.Run(hook.EVENT_PRE_START, nil)
+	if logMsh != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_HOOK_ABORT, "minecraft server start aborted (%s)", fmt.Sprintf(logMsh.Mex, logMsh.Arg...))
+	}
+
+	logMsh = getBackend().start()
+	if logMsh != nil {
+		return logMsh.AddTrace()
+	}
+
+	return nil
+}
+
+// stopMS runs the pre-stop hook and stops ms.
+// ms is stopped even if the pre-stop hook fails.
+func stopMS() *errco.MshLog {
+	logMsh := hook.Run(hook.EVENT_PRE_STOP, nil)
+	if logMsh != nil {
+		logMsh.Log(true)
+	}
+
+	logMsh = getBackend().stop()
+	if logMsh != nil {
+		return logMsh.AddTrace()
+	}
+
+	return nil
+}
+
+// suspendMS suspends ms and runs the suspend hook if ms process was suspended
+func suspendMS() *errco.MshLog {
+	var logMsh *errco.MshLog
+
+	wasSuspended := servstats.Stats.Suspended
+	servstats.Stats.Suspended, logMsh = getBackend().suspend()
+	if !wasSuspended && servstats.Stats.Suspended {
+		hook.Go(hook.EVENT_SUSPEND, nil)
+	}
+	if logMsh != nil {
+		return logMsh.AddTrace()
+	}
+
+	return nil
+}
+
+// resumeMS resumes ms and runs the resume hook if ms process was resumed
+func resumeMS() *errco.MshLog {
+	var logMsh *errco.MshLog
+
+	wasSuspended := servstats.Stats.Suspended
+	servstats.Stats.Suspended, logMsh = getBackend().resume()
+	if wasSuspended && !servstats.Stats.Suspended {
+		hook.Go(hook.EVENT_RESUME, nil)
+	}
+	if logMsh != nil {
+		return logMsh.AddTrace()
+	}
+
+	return nil
+}
+
+// setStarting sets ms terminal as active and ms status as starting
+func setStarting() {
+	ServTerm.IsActive = true
+	ServTerm.startTime = time.Now()
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "ms terminal started")
+
+	servstats.Stats.Status = errco.SERVER_STATUS_STARTING
+	servstats.Stats.Suspended = false
+	servstats.Stats.ConnCount = 0
+	servstats.Stats.LoadProgress = "0%"
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS STARTING!")
+}
+
+// setStopping sets ms status as stopping (if ms is online).
+// Used by backends whose status tracking doesn't detect the stopping status.
+func setStopping() {
+	if servstats.Stats.Status == errco.SERVER_STATUS_ONLINE {
+		servstats.Stats.Status = errco.SERVER_STATUS_STOPPING
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS STOPPING!")
+	}
+}
+
+// setOnline sets ms status as online and schedules a soft freeze of ms.
+// If measured is true, the startup time of ms is updated.
+func setOnline(measured bool) {
+	servstats.Stats.Status = errco.SERVER_STATUS_ONLINE
+	if measured {
+		servstats.Stats.StartupTime = time.Since(ServTerm.startTime)
+	}
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS ONLINE! (startup time: %s)", servstats.Stats.StartupTime.Round(time.Second))
+
+	hook.Go(hook.EVENT_POST_START, nil)
+
+	// schedule soft freeze of ms
+	// (if no players connect the server will shutdown)
+	FreezeMSSchedule()
+}
+
+// setOffline sets ms status as offline and ms terminal as not active
+func setOffline() {
+	// close rcon connection (ms closed it)
+	rconClose()
+
+	servstats.Stats.Status = errco.SERVER_STATUS_OFFLINE
+	servstats.Stats.Suspended = false
+	servstats.Stats.ConnCount = 0
+	servstats.Players.Reset()
+	servstats.Stats.LoadProgress = "0%"
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS OFFLINE!")
+
+	hook.Go(hook.EVENT_POST_STOP, nil)
+
+	ServTerm.IsActive = false
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "ms terminal exited")
+}
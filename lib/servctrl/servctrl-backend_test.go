@@ -0,0 +1,64 @@
+package servctrl
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+)
+
+func Test_startMSConcurrent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts not available")
+	}
+
+	dir := t.TempDir()
+	folder := config.ConfigRuntime.Server.Folder
+	config.ConfigRuntime.Server.Folder = dir
+	defer func() { config.ConfigRuntime.Server.Folder = folder }()
+
+	// slow pre-start hook that aborts ms start
+	err := os.WriteFile(filepath.Join(dir, "pre-start.sh"), []byte("#!/bin/sh\necho run >> runs.txt\nsleep 0.5\nexit 1\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConfigRuntime.Msh.Hooks.PreStart = model.Hook{Path: "./pre-start.sh", Timeout: 5}
+	defer func() { config.ConfigRuntime.Msh.Hooks.PreStart = model.Hook{} }()
+
+	// concurrent warms run the pre-start hook once, the others are told that the start is in progress
+	wg := &sync.WaitGroup{}
+	aborted := make(chan struct{}, 3)
+	inProgress := make(chan struct{}, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logMsh := startMS()
+			switch {
+			case logMsh == nil:
+			case logMsh.Cod == errco.ERROR_HOOK_ABORT:
+				aborted <- struct{}{}
+			case logMsh.Cod == errco.ERROR_SERVER_STARTING:
+				inProgress <- struct{}{}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, _ := os.ReadFile(filepath.Join(dir, "runs.txt"))
+	if n := strings.Count(string(data), "run"); n != 1 {
+		t.Errorf("pre-start hook executed %d times, expected 1", n)
+	}
+	if n := len(aborted); n != 1 {
+		t.Errorf("%d starts aborted, expected 1", n)
+	}
+	if n := len(inProgress); n != 2 {
+		t.Errorf("%d starts in progress, expected 2", n)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"io"
 	"os/exec"
-	"strings"
 	"sync"
 	"time"
 
@@ -31,73 +30,112 @@ type servTerminal struct {
 	inPipe    io.WriteCloser
 }
 
-// lastOut is a channel used to communicate the last line got from the printer function
-var lastOut = make(chan string)
+// Execute executes a command on ms and returns its output.
+// See ExecuteCmd.
+//
+// [non-blocking]
+func Execute(command string) (string, *errco.MshLog) {
+	res, logMsh := executeCmd(command, string(errco.Trace(2)))
+	if logMsh != nil {
+		return "", logMsh.AddTrace()
+	}
+
+	return res.Out, nil
+}
 
-// Execute executes a command on ms.
+// ExecuteCmd executes a command on ms.
 //
-// Returns the output lines of ms terminal with a timeout of 200ms since last output line.
+// Commands are serialized: a command is executed after the output of the previous one was collected.
 //
-// (Execute on command with no output doesn't cause hanging)
+// If rcon is enabled in server.properties, the command is executed over rcon
+// and the exact command output is returned.
 //
-// (Execute on command with multiple lines returns them separated by \n, if print time between them was less than timeout)
+// Otherwise (or if rcon fails) the command is sent with the backend and,
+// if the backend doesn't receive the exact output, the output lines of ms terminal/log
+// are matched with the output pattern of the command (see collectOutput).
 //
 // [non-blocking]
-func Execute(command string) (string, *errco.MshLog) {
+func ExecuteCmd(command string) (*CmdResult, *errco.MshLog) {
+	res, logMsh := executeCmd(command, string(errco.Trace(2)))
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	}
+
+	return res, nil
+}
+
+// executeCmd executes a command on ms (origin is logged)
+func executeCmd(command, origin string) (*CmdResult, *errco.MshLog) {
+	cmdQueue.Lock()
+	defer cmdQueue.Unlock()
+
 	// check if ms is warm and interactable
 	logMsh := CheckMSWarm()
 	if logMsh != nil {
-		return "", logMsh.AddTrace()
+		return nil, logMsh.AddTrace()
 	}
 
-	errco.NewLogln(errco.TYPE_INF, errco.LVL_2, errco.ERROR_NIL, "ms command: %s%s%s\t(origin: %s%s%s)", errco.COLOR_CYAN, command, errco.COLOR_RESET, errco.COLOR_YELLOW, errco.Trace(2), errco.COLOR_RESET)
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_2, errco.ERROR_NIL, "ms command: %s%s%s\t(origin: %s%s%s)", errco.COLOR_CYAN, command, errco.COLOR_RESET, errco.COLOR_YELLOW, origin, errco.COLOR_RESET)
 
-	// write to server terminal (\n indicates the enter key)
-	_, err := ServTerm.inPipe.Write([]byte(command + "\n"))
-	if err != nil {
-		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, err.Error())
+	res := &CmdResult{Command: command}
+	t := time.Now()
+	defer func() { res.Duration = time.Since(t) }()
+
+	// execute command over rcon (if enabled)
+	if out, ok, logMsh := execRcon(command); logMsh != nil {
+		return nil, logMsh.AddTrace()
+	} else if ok {
+		errco.NewLogln(errco.TYPE_SER, errco.LVL_2, errco.ERROR_NIL, "rcon: %s", out)
+		res.Out, res.Source, res.Complete = out, CMD_SRC_RCON, true
+		res.Failed = cmdError.MatchString(out)
+		return res, nil
 	}
 
-	// read all lines from lastOut
-	// (watchdog used in case there are no more lines to read or output takes too long)
-	var out string = ""
-a:
-	for {
-		select {
-		case lo := <-lastOut:
-			out += lo + "\n"
-		case <-time.NewTimer(200 * time.Millisecond).C:
-			break a
-		}
+	// lines printed after the command is sent are part of its output
+	seq := termOut.seq()
+
+	// write to server console
+	out, logMsh := getBackend().send(command)
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	} else if out != "" {
+		// backend received the exact command output
+		res.Out, res.Source, res.Complete = out, CMD_SRC_BACKEND, true
+		res.Failed = cmdError.MatchString(out)
+		return res, nil
 	}
 
-	// return the (possibly) full terminal output of Execute()
-	return out, nil
+	res.Source = CMD_SRC_LOG
+	collectOutput(res, seq)
+
+	return res, nil
 }
 
 // TellRaw executes a tellraw on ms
 // [non-blocking]
 func TellRaw(reason, text, origin string) *errco.MshLog {
-	// check if ms is warm and interactable
-	logMsh := CheckMSWarm()
-	if logMsh != nil {
-		return logMsh.AddTrace()
-	}
+	return tellRaw("@a", reason, text, origin)
+}
+
+// TellRawPlayer executes a tellraw on ms targeting a single player
+// [non-blocking]
+func TellRawPlayer(player, reason, text, origin string) *errco.MshLog {
+	return tellRaw(player, reason, text, origin)
+}
 
+// tellRaw executes a tellraw on ms targeting the specified selector/player
+// [non-blocking]
+func tellRaw(target, reason, text, origin string) *errco.MshLog {
 	gameMessage, err := json.Marshal(&model.GameRawMessage{Text: "[MSH] " + reason + ": " + text, Color: "aqua", Bold: false})
 	if err != nil {
 		return errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_JSON_MARSHAL, err.Error())
 	}
 
-	gameMessage = append([]byte("tellraw @a "), gameMessage...)
-	gameMessage = append(gameMessage, []byte("\n")...)
-
-	errco.NewLogln(errco.TYPE_INF, errco.LVL_2, errco.ERROR_NIL, "ms tellraw: %s%s%s\t(origin: %s)", errco.COLOR_YELLOW, string(gameMessage), errco.COLOR_RESET, origin)
+	gameMessage = append([]byte("tellraw "+target+" "), gameMessage...)
 
-	// write to server terminal (\n indicates the enter key)
-	_, err = ServTerm.inPipe.Write(gameMessage)
-	if err != nil {
-		return errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, err.Error())
+	_, logMsh := executeCmd(string(gameMessage), origin)
+	if logMsh != nil {
+		return logMsh.AddTrace()
 	}
 
 	return nil
@@ -143,10 +181,10 @@ func CheckMSWarm() *errco.MshLog {
 	return nil
 }
 
-// termStart starts a new terminal.
+// start starts a new terminal.
 // If server terminal is already active it returns without doing anything
 // [non-blocking]
-func termStart() *errco.MshLog {
+func (t *servTerminal) start() *errco.MshLog {
 	if ServTerm.IsActive {
 		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_SERVER_IS_WARM, "minecraft server terminal already active")
 		return nil
@@ -169,6 +207,52 @@ func termStart() *errco.MshLog {
 	return nil
 }
 
+// stop executes the stop command in ms terminal
+func (t *servTerminal) stop() *errco.MshLog {
+	_, logMsh := Execute(config.ConfigRuntime.Commands.StopServer)
+	if logMsh != nil {
+		return logMsh.AddTrace()
+	}
+
+	return nil
+}
+
+// send writes a command to ms terminal (output is read from ms terminal)
+func (t *servTerminal) send(command string) (string, *errco.MshLog) {
+	// write to server terminal (\n indicates the enter key)
+	_, err := t.inPipe.Write([]byte(command + "\n"))
+	if err != nil {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, err.Error())
+	}
+
+	return "", nil
+}
+
+// suspendable returns true if ms terminal process is started
+func (t *servTerminal) suspendable() bool {
+	return t.cmd != nil && t.cmd.Process != nil
+}
+
+// suspend suspends ms terminal process tree
+func (t *servTerminal) suspend() (bool, *errco.MshLog) {
+	return opsys.ProcTreeSuspend(uint32(t.cmd.Process.Pid))
+}
+
+// resume resumes ms terminal process tree
+func (t *servTerminal) resume() (bool, *errco.MshLog) {
+	return opsys.ProcTreeResume(uint32(t.cmd.Process.Pid))
+}
+
+// kill kills ms terminal process tree
+func (t *servTerminal) kill() *errco.MshLog {
+	return opsys.ProcTreeKill(uint32(t.cmd.Process.Pid))
+}
+
+// wait waits for ms terminal StdoutPipe/StderrPipe to exit
+func (t *servTerminal) wait() {
+	t.Wg.Wait()
+}
+
 // termLoad loads cmd/pipes into ServTerm
 func termLoad() *errco.MshLog {
 	// set terminal cmd
@@ -221,87 +305,9 @@ func printerOutErr() {
 		for scanner.Scan() {
 			line = scanner.Text()
 
-			errco.NewLogln(errco.TYPE_SER, errco.LVL_2, errco.ERROR_NIL, line)
-
-			// communicate to lastOut so that func Execute() can return the output of the command.
-			// must be a non-blocking select or it might cause hanging
-			select {
-			case lastOut <- line:
-			default:
-			}
+			outputLine(line)
 
-			switch servstats.Stats.Status {
-
-			case errco.SERVER_STATUS_STARTING:
-				// for modded server terminal compatibility, use separate check for "INFO" and flag-word
-				// using only "INFO" and not "[Server thread/INFO]"" because paper minecraft servers don't use "[Server thread/INFO]"
-
-				// "Preparing spawn area: " -> update ServStats.LoadProgress
-				if strings.Contains(line, "INFO") && strings.Contains(line, "Preparing spawn area: ") {
-					servstats.Stats.LoadProgress = strings.Split(strings.Split(line, "Preparing spawn area: ")[1], "\n")[0]
-				}
-
-				// ": Done (" -> set ServStats.Status = ONLINE
-				// using ": Done (" instead of "Done" to avoid false positives (issue #112)
-				if strings.Contains(line, "INFO") && strings.Contains(line, ": Done (") {
-					servstats.Stats.Status = errco.SERVER_STATUS_ONLINE
-					errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS ONLINE!")
-
-					// schedule soft freeze of ms
-					// (if no players connect the server will shutdown)
-					FreezeMSSchedule()
-				}
-
-			case errco.SERVER_STATUS_ONLINE:
-				// It is possible that a player could send a message that contains text similar to server output:
-				// 		[14:08:43] [Server thread/INFO]: <player> Stopping
-				// 		[14:09:32] [Server thread/INFO]: [player] Stopping
-				//
-				// These are the correct shutdown logs:
-				// 		[14:09:46] [Server thread/INFO]: Stopping the server
-				// 		[15Mar2021 14:09:46.581] [Server thread/INFO] [net.minecraft.server.dedicated.DedicatedServer/]: Stopping the server
-				//
-				// lineSplit is therefore implemented:
-				//
-				// [14:09:46] [Server thread/INFO]: <player> ciao
-				// ^-----------header------------^##^--content--^
-
-				// Continue if line does not contain ": "
-				// (it does not adhere to expected log format or it is a multiline java exception)
-				if !strings.Contains(line, ": ") {
-					continue
-				}
-
-				lineSplit := strings.SplitN(line, ": ", 2)
-				lineHeader := lineSplit[0]
-				lineContent := lineSplit[1]
-
-				if strings.Contains(lineHeader, "INFO") {
-					switch {
-					// player leaves the server
-					case strings.Contains(lineContent, "lost connection:"): // "lost connection" is more general compared to "left the game" (even too much: player might write it in chat -> added ":")
-						FreezeMSSchedule()
-
-					// the server is stopping
-					case strings.Contains(lineContent, "Stopping") && strings.Contains(lineContent, "server"):
-						servstats.Stats.Status = errco.SERVER_STATUS_STOPPING
-						errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS STOPPING!")
-					}
-				}
-
-				if strings.Contains(lineHeader, "ERROR") {
-					switch {
-					case strings.Contains(lineContent, "stopped responding!") || strings.Contains(lineContent, "----------"):
-						// example:
-						// PROCESS TREE UNSUSPEDED!
-						// [18:49:08 WARN]: Can't keep up! Is the server overloaded? Running 121938ms or 2438 ticks behind
-						// [18:49:08 ERROR]: ------------------------------
-						// [18:49:08 ERROR]: The server has stopped responding! This is (probably) not a Paper bug.
-						LogMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_SERVER_UNRESPONDING, "MINECRAFT SERVER IS NOT RESPONDING!")
-						servstats.Stats.SetMajorError(LogMsh)
-					}
-				}
-			}
+			parseLine(line)
 		}
 	}()
 
@@ -322,6 +328,57 @@ func printerOutErr() {
 	}()
 }
 
+// parseLine updates ms status according to a line of ms terminal/log.
+// Log lines are matched with the log profile of the server software.
+func parseLine(line string) {
+	ev, arg := currentLogProfile(line, servstats.Stats.Status == errco.SERVER_STATUS_STARTING).event(line)
+
+	switch servstats.Stats.Status {
+
+	case errco.SERVER_STATUS_STARTING:
+		switch ev {
+		// update ServStats.LoadProgress
+		case logEvProgress:
+			servstats.Stats.LoadProgress = arg
+
+		// set ServStats.Status = ONLINE
+		case logEvDone:
+			setOnline(true)
+		}
+
+	case errco.SERVER_STATUS_ONLINE:
+		switch ev {
+		// player joins the server
+		case logEvJoin:
+			servstats.Players.Join(arg, "", "", servstats.PLAYER_SRC_LOG)
+
+		// player leaves the server
+		case logEvLeave:
+			servstats.Players.Leave(arg, servstats.PLAYER_SRC_LOG)
+			FreezeMSSchedule()
+
+		// the server is stopping
+		case logEvStopping:
+			servstats.Stats.Status = errco.SERVER_STATUS_STOPPING
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS STOPPING!")
+
+		// the server is not responding
+		case logEvCrash:
+			// example:
+			// PROCESS TREE UNSUSPEDED!
+			// [18:49:08 WARN]: Can't keep up! Is the server overloaded? Running 121938ms or 2438 ticks behind
+			// [18:49:08 ERROR]: ------------------------------
+			// [18:49:08 ERROR]: The server has stopped responding! This is (probably) not a Paper bug.
+			LogMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_SERVER_UNRESPONDING, "MINECRAFT SERVER IS NOT RESPONDING!")
+			servstats.Stats.SetMajorError(LogMsh)
+
+		// the server is overloaded
+		case logEvLag:
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_NIL, "minecraft server can't keep up (overloaded)")
+		}
+	}
+}
+
 // waitForExit waits for server terminal to exit and manages:
 //
 // - ServTerm.isActive, ServTerm.startTime.
@@ -332,15 +389,7 @@ func printerOutErr() {
 //
 // [goroutine]
 func waitForExit() {
-	ServTerm.IsActive = true
-	ServTerm.startTime = time.Now()
-	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "ms terminal started")
-
-	servstats.Stats.Status = errco.SERVER_STATUS_STARTING
-	servstats.Stats.Suspended = false
-	servstats.Stats.ConnCount = 0
-	servstats.Stats.LoadProgress = "0%"
-	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS STARTING!")
+	setStarting()
 
 	// start suspension refresher
 	stopSuspendRefresherC := make(chan bool, 1)
@@ -357,14 +406,7 @@ func waitForExit() {
 	// stop suspension refresher
 	stopSuspendRefresherC <- true
 
-	servstats.Stats.Status = errco.SERVER_STATUS_OFFLINE
-	servstats.Stats.Suspended = false
-	servstats.Stats.ConnCount = 0
-	servstats.Stats.LoadProgress = "0%"
-	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MINECRAFT SERVER IS OFFLINE!")
-
-	ServTerm.IsActive = false
-	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "ms terminal exited")
+	setOffline()
 }
 
 // suspendRefresher refreshes ms suspension by warming and freezing the server every set amount of time.
@@ -0,0 +1,244 @@
+package servctrl
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+)
+
+// command output sources
+const (
+	CMD_SRC_RCON    string = "rcon"    // exact output received over rcon
+	CMD_SRC_BACKEND string = "backend" // exact output received by the backend
+	CMD_SRC_LOG     string = "log"     // output lines read from ms terminal/log
+)
+
+const (
+	cmdOutputTimeout time.Duration = 3 * time.Second        // default max time waiting for the output of a command
+	cmdOutputIdle    time.Duration = 200 * time.Millisecond // default time since last output line after which the output is complete
+	outRingSize      int           = 1000                   // number of ms terminal/log lines kept in the output ring buffer
+)
+
+// CmdResult is the result of a command executed on ms
+type CmdResult struct {
+	Command  string        // command executed
+	Out      string        // command output (lines separated by \n)
+	Source   string        // source of the output (CMD_SRC_*)
+	Complete bool          // the whole output was received (exact output or end of output matched)
+	Failed   bool          // ms reported a command error
+	Duration time.Duration // time taken to execute the command
+}
+
+// cmdPattern describes the output of a known ms command
+type cmdPattern struct {
+	known bool           // the command output is described by the pattern
+	none  bool           // the command has no output
+	match *regexp.Regexp // matches the output lines of the command (nil: all lines)
+	end   *regexp.Regexp // matches the last output line of the command (nil: output ends when ms terminal/log is idle)
+}
+
+// cmdListOut matches the output line of list command (also translated by plugins: "Es sind 0 von maximal 15 Spielern online.")
+var cmdListOut *regexp.Regexp = regexp.MustCompile(`INFO.* \d+ .*online`)
+
+// cmdSayOut and cmdKickOut match the output line of say and kick commands
+var (
+	cmdSayOut  *regexp.Regexp = regexp.MustCompile(`\[Server\] `)
+	cmdKickOut *regexp.Regexp = regexp.MustCompile(`Kicked `)
+)
+
+// cmdPatterns are the output patterns of known ms commands (key: first word of the command)
+var cmdPatterns map[string]cmdPattern = map[string]cmdPattern{
+	"list":     {known: true, match: cmdListOut, end: cmdListOut},
+	"save-all": {known: true, match: regexp.MustCompile(`Sav(?:ed|ing)`), end: regexp.MustCompile(`Saved the game|Saving is already`)},
+	"stop":     {known: true, match: regexp.MustCompile(`Stopping`), end: regexp.MustCompile(`Stopping (?:the )?server`)},
+	"say":      {known: true, match: cmdSayOut, end: cmdSayOut},
+	"kick":     {known: true, match: cmdKickOut, end: cmdKickOut},
+	"tellraw":  {known: true, none: true},
+	"title":    {known: true, none: true},
+}
+
+// cmdError matches the output lines of ms that report a command error
+var cmdError *regexp.Regexp = regexp.MustCompile(`Unknown or incomplete command|Incorrect argument for command|Unknown command\.|No player was found|<--\[HERE\]`)
+
+// cmdQueue serializes the commands executed on ms:
+// a command is executed only after the output of the previous one was collected
+var cmdQueue *sync.Mutex = &sync.Mutex{}
+
+// termOut is the ring buffer of ms terminal/log lines
+var termOut *outRing = newOutRing(outRingSize)
+
+// outRing is a bounded buffer of ms terminal/log lines.
+// Each line has a sequence number so that readers can collect the lines received after a point in time.
+type outRing struct {
+	m      *sync.Mutex
+	lines  []string
+	next   uint64        // sequence number of the next line
+	notify chan struct{} // closed when a line is added
+}
+
+// newOutRing returns an output ring buffer that keeps the last size lines
+func newOutRing(size int) *outRing {
+	return &outRing{
+		m:      &sync.Mutex{},
+		lines:  make([]string, size),
+		notify: make(chan struct{}),
+	}
+}
+
+// add adds a line to the ring buffer and notifies readers
+func (r *outRing) add(line string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.lines[r.next%uint64(len(r.lines))] = line
+	r.next++
+
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+// seq returns the sequence number of the next line
+func (r *outRing) seq() uint64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.next
+}
+
+// since returns the lines starting from sequence number seq, the sequence number of the next line
+// and a channel that is closed when a new line is added.
+// Lines already overwritten are skipped.
+func (r *outRing) since(seq uint64) ([]string, uint64, chan struct{}) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.next-seq > uint64(len(r.lines)) {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_NIL, "output ring buffer: %d lines lost", r.next-seq-uint64(len(r.lines)))
+		seq = r.next - uint64(len(r.lines))
+	}
+
+	lines := []string{}
+	for s := seq; s < r.next; s++ {
+		lines = append(lines, r.lines[s%uint64(len(r.lines))])
+	}
+
+	return lines, r.next, r.notify
+}
+
+// last returns the last n lines in the ring buffer
+func (r *outRing) last(n int) []string {
+	r.m.Lock()
+	next := r.next
+	r.m.Unlock()
+
+	if uint64(n) > next {
+		n = int(next)
+	}
+	lines, _, _ := r.since(next - uint64(n))
+
+	return lines
+}
+
+// TermOutput returns the last n lines of ms terminal/log
+func TermOutput(n int) []string {
+	return termOut.last(n)
+}
+
+// cmdPatternOf returns the output pattern of a command
+func cmdPatternOf(command string) cmdPattern {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return cmdPattern{known: true, none: true}
+	}
+
+	return cmdPatterns[strings.ToLower(strings.TrimPrefix(fields[0], "/"))]
+}
+
+// collectOutput collects the output of a command from the lines added to the ring buffer starting from seq.
+//
+// The output is complete when its last line is matched or an error is reported by ms.
+// For commands without end pattern, the output is complete when no output line is received for OutputIdle after the first one.
+// If no output is received in OutputTimeout, the (possibly partial) output is returned.
+//
+// The output of unknown commands is not collected: any ms line could be part of it
+// and a busy ms would hold the command queue until OutputTimeout.
+func collectOutput(res *CmdResult, seq uint64) {
+	p := cmdPatternOf(res.Command)
+	if !p.known {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "ms command %s: output not collected (unknown command)", res.Command)
+		return
+	}
+	if p.none {
+		res.Complete = true
+		return
+	}
+
+	timeout, idle := cmdOutputTimeout, cmdOutputIdle
+	if config.ConfigRuntime.Commands.OutputTimeout > 0 {
+		timeout = time.Duration(config.ConfigRuntime.Commands.OutputTimeout) * time.Millisecond
+	}
+	if config.ConfigRuntime.Commands.OutputIdle > 0 {
+		idle = time.Duration(config.ConfigRuntime.Commands.OutputIdle) * time.Millisecond
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	// idle timer is started when the first output line is received
+	idleTimer := time.NewTimer(timeout)
+	defer idleTimer.Stop()
+
+	out := []string{}
+
+	for {
+		lines, next, notify := termOut.since(seq)
+		seq = next
+
+		// lines not part of the output don't delay the end of the output
+		added := false
+		for _, line := range lines {
+			switch {
+			case cmdError.MatchString(line):
+				res.Failed = true
+			case p.match != nil && !p.match.MatchString(line):
+				continue
+			}
+
+			out = append(out, line)
+			added = true
+
+			if p.end != nil && p.end.MatchString(line) {
+				res.Complete = true
+			}
+		}
+		res.Out = strings.Join(out, "\n")
+
+		if res.Complete {
+			return
+		}
+
+		if added && (p.end == nil || res.Failed) {
+			if !idleTimer.Stop() {
+				select {
+				case <-idleTimer.C:
+				default:
+				}
+			}
+			idleTimer.Reset(idle)
+		}
+
+		select {
+		case <-notify:
+		case <-idleTimer.C:
+			res.Complete = true
+			return
+		case <-deadline.C:
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_NIL, "ms command %s: output not complete after %s", res.Command, timeout)
+			return
+		}
+	}
+}
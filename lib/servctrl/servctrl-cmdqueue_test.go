@@ -0,0 +1,147 @@
+package servctrl
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"msh/lib/errco"
+	"msh/lib/servstats"
+)
+
+// fakeConsole is a ms terminal stdin that prints the output of commands to the output ring buffer
+type fakeConsole struct {
+	delay time.Duration // time taken by ms to answer a command
+}
+
+func (f *fakeConsole) Write(p []byte) (int, error) {
+	command := strings.TrimSpace(string(p))
+
+	go func() {
+		time.Sleep(f.delay)
+
+		switch strings.Fields(command)[0] {
+		case "list":
+			termOut.add("[12:00:00] [Server thread/INFO]: There are 1 of a max of 20 players online: Steve")
+		case "say":
+			termOut.add("[12:00:00] [Server thread/INFO]: [Server] " + strings.TrimPrefix(command, "say "))
+		case "kick":
+			termOut.add("[12:00:00] [Server thread/INFO]: No player was found")
+		case "whitelist":
+			termOut.add("[12:00:00] [Server thread/INFO]: There are 2 whitelisted players: Steve, Alex")
+			time.Sleep(50 * time.Millisecond)
+			termOut.add("[12:00:00] [Server thread/INFO]: Whitelist is enabled")
+		default:
+			termOut.add("[12:00:00] [Server thread/INFO]: Unknown or incomplete command, see below for error")
+			termOut.add("[12:00:00] [Server thread/INFO]: " + command + "<--[HERE]")
+		}
+	}()
+
+	return len(p), nil
+}
+
+func (f *fakeConsole) Close() error { return nil }
+
+func Test_ExecuteCmd(t *testing.T) {
+	ServTerm.IsActive, ServTerm.inPipe = true, &fakeConsole{delay: 300 * time.Millisecond}
+	servstats.Stats.Status = errco.SERVER_STATUS_ONLINE
+	defer func() {
+		ServTerm.IsActive, ServTerm.inPipe = false, nil
+		servstats.Stats.Status = errco.SERVER_STATUS_OFFLINE
+	}()
+
+	// concurrent commands and unrelated log lines don't steal each other's output
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				termOut.add("[12:00:00] [Server thread/INFO]: <Alex> hello")
+			}
+		}
+	}()
+
+	results := make([]*CmdResult, 3)
+	wg := sync.WaitGroup{}
+	for i, command := range []string{"list", "say msh test", "list"} {
+		wg.Add(1)
+		go func(i int, command string) {
+			defer wg.Done()
+			res, logMsh := ExecuteCmd(command)
+			if logMsh != nil {
+				t.Errorf("%s: unexpected error %q", command, logMsh.Mex)
+				return
+			}
+			results[i] = res
+		}(i, command)
+	}
+	wg.Wait()
+
+	for _, res := range results {
+		if res == nil {
+			t.FailNow()
+		}
+		if !res.Complete || res.Failed || res.Source != CMD_SRC_LOG {
+			t.Errorf("%s: unexpected result %+v", res.Command, res)
+		}
+		switch res.Command {
+		case "list":
+			if res.Out != "[12:00:00] [Server thread/INFO]: There are 1 of a max of 20 players online: Steve" {
+				t.Errorf("list: unexpected output %q", res.Out)
+			}
+		case "say msh test":
+			if !strings.HasSuffix(res.Out, "[Server] msh test") {
+				t.Errorf("say: unexpected output %q", res.Out)
+			}
+		}
+	}
+
+	// unknown command: output is not collected (the command queue is not held by unrelated lines)
+	ServTerm.inPipe = &fakeConsole{delay: 10 * time.Millisecond}
+
+	res, logMsh := ExecuteCmd("whitelist list")
+	if logMsh != nil {
+		t.Fatalf("whitelist: unexpected error %q", logMsh.Mex)
+	}
+	if res.Complete || res.Out != "" || res.Duration > 100*time.Millisecond {
+		t.Errorf("whitelist: unexpected result %+v", res)
+	}
+
+	// command error reported by ms (output ends when no output line is received, even if ms is busy)
+	res, logMsh = ExecuteCmd("kick Nobody")
+	if logMsh != nil {
+		t.Fatalf("kick: unexpected error %q", logMsh.Mex)
+	}
+	if !res.Complete || !res.Failed || res.Out != "[12:00:00] [Server thread/INFO]: No player was found" || res.Duration > time.Second {
+		t.Errorf("kick: unexpected result %+v", res)
+	}
+	close(stop)
+
+	// command without output
+	res, logMsh = ExecuteCmd(`tellraw @a {"text":"hi"}`)
+	if logMsh != nil || !res.Complete || res.Duration > 100*time.Millisecond {
+		t.Errorf("tellraw: unexpected result %+v", res)
+	}
+}
+
+func Test_outRing(t *testing.T) {
+	r := newOutRing(3)
+
+	seq := r.seq()
+	for _, line := range []string{"a", "b", "c", "d"} {
+		r.add(line)
+	}
+
+	// lines overwritten are skipped
+	lines, next, _ := r.since(seq)
+	if strings.Join(lines, ",") != "b,c,d" || next != 4 {
+		t.Errorf("since: got %v (next %d)", lines, next)
+	}
+
+	if lines := r.last(2); strings.Join(lines, ",") != "c,d" {
+		t.Errorf("last: got %v", lines)
+	}
+}
@@ -0,0 +1,568 @@
+package servctrl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/servstats"
+)
+
+const (
+	dockerAPI         string        = "http://docker" // docker engine api base url (host is ignored: requests are sent over the unix socket)
+	dockerCallTimeout time.Duration = 2 * time.Minute // timeout for docker engine api calls (log stream excluded)
+	dockerStopTimeout int           = 60              // seconds given to ms to stop before the container is killed
+)
+
+// dkBackend is the docker backend
+var dkBackend *dockerBackend = &dockerBackend{m: &sync.Mutex{}}
+
+// dockerBackend represents a ms running in a docker container that is managed
+// through the docker engine api (example: itzg/minecraft-server image).
+//
+// ms status is tracked by inspecting the container and following its log stream.
+// ms suspension is implemented by pausing the container.
+type dockerBackend struct {
+	m          *sync.Mutex
+	client     *http.Client // http client connected to docker engine unix socket
+	attach     net.Conn     // [DockerExec ""] connection attached to the container stdin
+	following  bool         // container log stream is being followed
+	startedMsh bool         // ms was started by msh (startup time can be measured)
+	paused     bool         // container was paused when last inspected
+}
+
+// dockerState is the container state returned by docker engine api
+type dockerState struct {
+	State struct {
+		Running bool `json:"Running"`
+		Paused  bool `json:"Paused"`
+	} `json:"State"`
+	Config struct {
+		Tty bool `json:"Tty"`
+	} `json:"Config"`
+}
+
+// dockerError is an error returned by docker engine api
+type dockerError struct {
+	status  int
+	message string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker engine api: %s (status %d)", e.message, e.status)
+}
+
+// start starts ms container
+func (d *dockerBackend) start() *errco.MshLog {
+	if ServTerm.IsActive {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_SERVER_IS_WARM, "minecraft server container already running")
+		return nil
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "starting minecraft server container: %s", config.ConfigRuntime.Msh.Backend.DockerContainer)
+
+	// 304 is returned if the container is already started
+	err := d.call(http.MethodPost, d.containerPath("start"), nil, nil)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_TERMINAL_START, err.Error())
+	}
+
+	d.m.Lock()
+	d.startedMsh = true
+	d.m.Unlock()
+
+	setStarting()
+
+	// follow log stream since container start
+	d.follow()
+
+	return nil
+}
+
+// stop stops ms container (ms receives SIGTERM and saves the world)
+func (d *dockerBackend) stop() *errco.MshLog {
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "stopping minecraft server container: %s", config.ConfigRuntime.Msh.Backend.DockerContainer)
+
+	// container stop blocks until the container exited
+	go func() {
+		err := d.call(http.MethodPost, d.containerPath("stop")+fmt.Sprintf("?t=%d", dockerStopTimeout), nil, nil)
+		if err != nil {
+			errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_KILL, "container stop: %s", err.Error())
+		}
+	}()
+
+	// container stop is not reported in the log stream until ms starts stopping
+	setStopping()
+
+	return nil
+}
+
+// send executes a command on ms with DockerExec (returns the command output)
+// or writes it to the container stdin if DockerExec is not set (output is read from the log stream)
+func (d *dockerBackend) send(command string) (string, *errco.MshLog) {
+	if config.ConfigRuntime.Msh.Backend.DockerExec == "" {
+		logMsh := d.write(command)
+		if logMsh != nil {
+			return "", logMsh.AddTrace()
+		}
+		return "", nil
+	}
+
+	cmd := append(strings.Fields(config.ConfigRuntime.Msh.Backend.DockerExec), command)
+
+	out, err := d.exec(cmd)
+	if err != nil {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "container exec: %s", err.Error())
+	}
+
+	return strings.TrimSpace(out), nil
+}
+
+// suspendable returns true if ms container is running
+func (d *dockerBackend) suspendable() bool {
+	return ServTerm.IsActive
+}
+
+// suspend pauses ms container
+func (d *dockerBackend) suspend() (bool, *errco.MshLog) {
+	err := d.call(http.MethodPost, d.containerPath("pause"), nil, nil)
+	if err != nil && !(isDockerConflict(err) && d.isPaused()) {
+		return false, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_SUSPEND_CALL, err.Error())
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "EXECUTED CONTAINER PAUSE!")
+
+	return true, nil
+}
+
+// isPaused returns true if ms container is paused
+// (409 is returned both if the container is already paused and if it's not running)
+func (d *dockerBackend) isPaused() bool {
+	state, err := d.inspect()
+	return err == nil && state.State.Paused
+}
+
+// resume unpauses ms container
+func (d *dockerBackend) resume() (bool, *errco.MshLog) {
+	// 409 is returned if the container is not paused
+	err := d.call(http.MethodPost, d.containerPath("unpause"), nil, nil)
+	if err != nil && !isDockerConflict(err) {
+		return true, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_RESUME_CALL, err.Error())
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "EXECUTED CONTAINER UNPAUSE!")
+
+	return false, nil
+}
+
+// kill kills ms container
+func (d *dockerBackend) kill() *errco.MshLog {
+	err := d.call(http.MethodPost, d.containerPath("kill"), nil, nil)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_KILL, err.Error())
+	}
+
+	return nil
+}
+
+// wait waits for ms status to be offline
+func (d *dockerBackend) wait() {
+	waitOffline(0)
+}
+
+// DockerMonitor tracks the status of ms container managed by the docker backend (see monitorMS).
+//
+// [goroutine]
+func DockerMonitor() {
+	monitorMS(dkBackend)
+}
+
+// poll returns if ms container is running and if ms is ready.
+// ms readiness is checked only if ms was already running when detected
+// (": Done (" is not in the log stream: ms is ready when it answers a status ping).
+func (d *dockerBackend) poll() (bool, bool, *errco.MshLog) {
+	state, err := d.inspect()
+	if err != nil {
+		return false, false, errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_DOCKER, "container inspect: %s", err.Error())
+	}
+
+	d.m.Lock()
+	d.paused = state.State.Paused
+	startedMsh := d.startedMsh
+	d.m.Unlock()
+
+	if !state.State.Running || !ServTerm.IsActive {
+		return state.State.Running, false, nil
+	}
+
+	// follow log stream again if it was interrupted
+	d.follow()
+
+	ready := false
+	if !startedMsh && servstats.Stats.Status == errco.SERVER_STATUS_STARTING && !servstats.Stats.Suspended {
+		_, logMsh := pingServInfo(pingLocalTimeout)
+		ready = logMsh == nil
+	}
+
+	return true, ready, nil
+}
+
+// detected updates the backend state when ms container was started externally
+// and follows the container log stream
+func (d *dockerBackend) detected() {
+	d.m.Lock()
+	d.startedMsh = false
+	servstats.Stats.Suspended = d.paused
+	d.m.Unlock()
+
+	d.follow()
+}
+
+// exited closes the connection attached to ms container stdin
+func (d *dockerBackend) exited() {
+	d.closeAttach()
+}
+
+// measured returns true if ms container was started by msh
+func (d *dockerBackend) measured() bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	return d.startedMsh
+}
+
+// follow starts following ms container log stream (if not already followed)
+func (d *dockerBackend) follow() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.following {
+		return
+	}
+	d.following = true
+
+	// [goroutine]
+	go func() {
+		defer func() {
+			d.m.Lock()
+			d.following = false
+			d.m.Unlock()
+		}()
+
+		err := d.logs(time.Now(), d.logLine)
+		if err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_DOCKER, "container log stream: %s", err.Error())
+		}
+	}()
+}
+
+// logLine handles a line read from ms container log stream
+func (d *dockerBackend) logLine(line string) {
+	outputLine(line)
+
+	parseLine(line)
+}
+
+// inspect returns ms container state
+func (d *dockerBackend) inspect() (*dockerState, error) {
+	state := &dockerState{}
+	err := d.call(http.MethodGet, d.containerPath("json"), nil, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// logs follows ms container log stream (from since) and calls handle for each line.
+// Returns when the container stops.
+func (d *dockerBackend) logs(since time.Time, handle func(string)) error {
+	state, err := d.inspect()
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("follow", "1")
+	q.Set("stdout", "1")
+	q.Set("stderr", "1")
+	q.Set("since", fmt.Sprintf("%d", since.Unix()))
+
+	req, err := http.NewRequest(http.MethodGet, dockerAPI+d.containerPath("logs")+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := d.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := dockerCheck(res); err != nil {
+		return err
+	}
+
+	var r io.Reader = res.Body
+	if !state.Config.Tty {
+		r = &dockerStream{r: bufio.NewReader(res.Body)}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		handle(strings.TrimRight(scanner.Text(), "\r"))
+	}
+
+	return scanner.Err()
+}
+
+// exec runs a command in ms container and returns its output
+func (d *dockerBackend) exec(cmd []string) (string, error) {
+	var created struct {
+		Id string `json:"Id"`
+	}
+	err := d.call(http.MethodPost, d.containerPath("exec"), map[string]interface{}{"AttachStdout": true, "AttachStderr": true, "Cmd": cmd}, &created)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerCallTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dockerAPI+"/exec/"+created.Id+"/start", strings.NewReader(`{"Detach":false,"Tty":false}`))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := d.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if err := dockerCheck(res); err != nil {
+		return "", err
+	}
+
+	out, err := io.ReadAll(&dockerStream{r: bufio.NewReader(res.Body)})
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	err = d.call(http.MethodGet, "/exec/"+created.Id+"/json", nil, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.ExitCode != 0 {
+		return "", fmt.Errorf("%s exited with code %d (%s)", cmd[0], result.ExitCode, strings.TrimSpace(string(out)))
+	}
+
+	return string(out), nil
+}
+
+// write writes a command to ms container stdin (container must be created with stdin open).
+// The attach connection is kept open and reused for next commands.
+func (d *dockerBackend) write(command string) *errco.MshLog {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.attach == nil {
+		conn, err := d.hijack(d.containerPath("attach") + "?stream=1&stdin=1")
+		if err != nil {
+			return errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "container attach: %s", err.Error())
+		}
+		d.attach = conn
+	}
+
+	// write to container stdin (\n indicates the enter key)
+	_, err := d.attach.Write([]byte(command + "\n"))
+	if err != nil {
+		d.attach.Close()
+		d.attach = nil
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "container attach: %s", err.Error())
+	}
+
+	return nil
+}
+
+// closeAttach closes the connection attached to ms container stdin
+func (d *dockerBackend) closeAttach() {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.attach != nil {
+		d.attach.Close()
+		d.attach = nil
+	}
+}
+
+// hijack sends a request to docker engine api that upgrades the connection to a raw stream
+func (d *dockerBackend) hijack(path string) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", config.ConfigRuntime.Msh.Backend.DockerSocket, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, dockerAPI+path, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols && res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, dockerCheck(res)
+	}
+
+	return conn, nil
+}
+
+// call executes a docker engine api call.
+// If in is not nil it's sent as json body, if out is not nil the json response is decoded into it.
+func (d *dockerBackend) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerCallTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, dockerAPI+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := d.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := dockerCheck(res); err != nil {
+		return err
+	}
+
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+
+	return nil
+}
+
+// httpClient returns the http client connected to docker engine unix socket
+func (d *dockerBackend) httpClient() *http.Client {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.client == nil {
+		socket := config.ConfigRuntime.Msh.Backend.DockerSocket
+		d.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	}
+
+	return d.client
+}
+
+// containerPath returns the docker engine api path of an action on ms container
+func (d *dockerBackend) containerPath(action string) string {
+	return "/containers/" + url.PathEscape(config.ConfigRuntime.Msh.Backend.DockerContainer) + "/" + action
+}
+
+// dockerCheck returns an error if docker engine api response status is not successful
+// (304 not modified is considered successful: container already started/stopped)
+func dockerCheck(res *http.Response) error {
+	if res.StatusCode < 300 || res.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	var e struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(res.Body)
+	if json.Unmarshal(data, &e) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(data))
+	}
+
+	return &dockerError{status: res.StatusCode, message: e.Message}
+}
+
+// isDockerConflict returns true if err is a docker engine api conflict
+// (example: pause of an already paused container)
+func isDockerConflict(err error) bool {
+	de, ok := err.(*dockerError)
+	return ok && de.status == http.StatusConflict
+}
+
+// dockerStream reads a multiplexed docker stream (container not started with tty)
+// and returns the payload of stdout/stderr frames.
+//
+// Each frame has an 8 byte header: [stream type, 0, 0, 0, size (4 byte big endian)]
+type dockerStream struct {
+	r    *bufio.Reader
+	left int // payload bytes left in current frame
+}
+
+// Read reads the payload of the multiplexed stream frames
+func (s *dockerStream) Read(p []byte) (int, error) {
+	for s.left == 0 {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(s.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		s.left = int(binary.BigEndian.Uint32(header[4:]))
+	}
+
+	if len(p) > s.left {
+		p = p[:s.left]
+	}
+
+	n, err := s.r.Read(p)
+	s.left -= n
+
+	return n, err
+}
@@ -0,0 +1,213 @@
+package servctrl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+// dockerFrame returns a multiplexed docker stream frame
+func dockerFrame(stream byte, payload string) []byte {
+	header := []byte{stream, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+// newDockerStandIn starts a stand-in docker engine api on a unix socket
+func newDockerStandIn(t *testing.T) (*dockerBackend, *[]string) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix socket not supported: %s", err.Error())
+	}
+
+	m := &sync.Mutex{}
+	calls := []string{}
+	running, paused := true, false
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// container state is shared by concurrent requests
+		m.Lock()
+		defer m.Unlock()
+
+		calls = append(calls, r.Method+" "+r.URL.Path)
+
+		switch r.Method + " " + r.URL.Path {
+		case "POST /containers/mc/start":
+			running = true
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /containers/mc/kill":
+			running, paused = false, false
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /containers/mc/pause":
+			switch {
+			case !running:
+				w.WriteHeader(http.StatusConflict)
+				io.WriteString(w, `{"message":"Container mc is not running"}`)
+				return
+			case paused:
+				w.WriteHeader(http.StatusConflict)
+				io.WriteString(w, `{"message":"Container mc is already paused"}`)
+				return
+			}
+			paused = true
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /containers/mc/unpause":
+			if !paused {
+				w.WriteHeader(http.StatusConflict)
+				io.WriteString(w, `{"message":"Container mc is not paused"}`)
+				return
+			}
+			paused = false
+			w.WriteHeader(http.StatusNoContent)
+		case "GET /containers/mc/json":
+			fmt.Fprintf(w, `{"State":{"Running":%t,"Paused":%t},"Config":{"Tty":false}}`, running, paused)
+		case "GET /containers/mc/logs":
+			w.Write(dockerFrame(1, "[12:00:00] [Server thread/INFO]: Starting minecraft server\n[12:00:01] [Server "))
+			w.Write(dockerFrame(2, "thread/INFO]: Done (1.0s)!\n"))
+		case "POST /containers/mc/exec":
+			if !strings.Contains(readBody(r), `"Cmd":["rcon-cli","list"]`) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"Id":"e1"}`)
+		case "POST /exec/e1/start":
+			w.Write(dockerFrame(1, "There are 0 of a max of 20 players online: \n"))
+		case "GET /exec/e1/json":
+			io.WriteString(w, `{"ExitCode":0}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"message":"No such container"}`)
+		}
+	}))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	config.ConfigRuntime.Msh.Backend.DockerSocket = socket
+	config.ConfigRuntime.Msh.Backend.DockerContainer = "mc"
+	config.ConfigRuntime.Msh.Backend.DockerExec = "rcon-cli"
+
+	return &dockerBackend{m: &sync.Mutex{}}, &calls
+}
+
+func readBody(r *http.Request) string {
+	data, _ := io.ReadAll(r.Body)
+	return string(data)
+}
+
+func Test_dockerBackend(t *testing.T) {
+	d, calls := newDockerStandIn(t)
+
+	state, err := d.inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.State.Running || state.State.Paused {
+		t.Errorf("unexpected container state: %+v", state.State)
+	}
+
+	// container pause maps to suspension
+	if suspended, logMsh := d.suspend(); logMsh != nil || !suspended {
+		t.Errorf("suspend: %v %v", suspended, logMsh)
+	}
+	// pausing a container that is already paused is not an error
+	if suspended, logMsh := d.suspend(); logMsh != nil || !suspended {
+		t.Errorf("suspend (already paused): %v %v", suspended, logMsh)
+	}
+	if suspended, logMsh := d.resume(); logMsh != nil || suspended {
+		t.Errorf("resume: %v %v", suspended, logMsh)
+	}
+	// resuming a container that is not paused is not an error
+	if suspended, logMsh := d.resume(); logMsh != nil || suspended {
+		t.Errorf("resume (not paused): %v %v", suspended, logMsh)
+	}
+
+	out, logMsh := d.send("list")
+	if logMsh != nil {
+		t.Fatalf("send: %v", logMsh)
+	}
+	if out != "There are 0 of a max of 20 players online:" {
+		t.Errorf("send: unexpected output %q", out)
+	}
+
+	if logMsh := d.kill(); logMsh != nil {
+		t.Errorf("kill: %v", logMsh)
+	}
+
+	// pausing a container that is not running is an error
+	if suspended, logMsh := d.suspend(); logMsh == nil || suspended {
+		t.Errorf("suspend (not running): %v %v", suspended, logMsh)
+	}
+
+	// docker engine api errors report the api message
+	config.ConfigRuntime.Msh.Backend.DockerContainer = "missing"
+	_, err = d.inspect()
+	if err == nil || !strings.Contains(err.Error(), "No such container") {
+		t.Errorf("inspect of missing container: unexpected error %v", err)
+	}
+
+	exp := []string{
+		"GET /containers/mc/json",
+		"POST /containers/mc/pause",
+		"POST /containers/mc/pause",
+		"GET /containers/mc/json",
+		"POST /containers/mc/unpause",
+		"POST /containers/mc/unpause",
+		"POST /containers/mc/exec",
+		"POST /exec/e1/start",
+		"GET /exec/e1/json",
+		"POST /containers/mc/kill",
+		"POST /containers/mc/pause",
+		"GET /containers/mc/json",
+		"GET /containers/missing/json",
+	}
+	if strings.Join(*calls, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("unexpected api calls:\n%s\nexpected:\n%s", strings.Join(*calls, "\n"), strings.Join(exp, "\n"))
+	}
+}
+
+func Test_dockerLogs(t *testing.T) {
+	d, _ := newDockerStandIn(t)
+
+	lines := []string{}
+	err := d.logs(time.Now(), func(l string) { lines = append(lines, l) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// frames are joined: lines can be split across frames
+	exp := []string{
+		"[12:00:00] [Server thread/INFO]: Starting minecraft server",
+		"[12:00:01] [Server thread/INFO]: Done (1.0s)!",
+	}
+	if strings.Join(lines, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("unexpected log lines: %q", lines)
+	}
+}
+
+func Test_dockerStream(t *testing.T) {
+	data := append(dockerFrame(1, "out"), dockerFrame(2, "err\n")...)
+	data = append(data, dockerFrame(1, "")...)
+	data = append(data, dockerFrame(1, "last")...)
+
+	out, err := io.ReadAll(&dockerStream{r: bufio.NewReader(strings.NewReader(string(data)))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "outerr\nlast" {
+		t.Errorf("unexpected stream payload: %q", out)
+	}
+}
@@ -0,0 +1,343 @@
+package servctrl
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/opsys"
+	"msh/lib/servstats"
+)
+
+const (
+	extCommandTimeout time.Duration = 2 * time.Minute        // timeout for external start/stop/status/console commands
+	extStartTimeout   time.Duration = 10 * time.Minute       // max time ms port can be closed while ms is starting
+	extStartGrace     time.Duration = 30 * time.Second       // time given to the status command to report ms running after the start command
+	extPingFails      int           = 3                      // consecutive failed pings after which ms is considered offline
+	extLogIdle        time.Duration = 5 * time.Second        // [log file only] ms is considered offline if the log is idle for this time while stopping
+	extTailPoll       time.Duration = 500 * time.Millisecond // time interval between log file reads
+)
+
+// extBackend is the external backend
+var extBackend *externalBackend = &externalBackend{m: &sync.Mutex{}}
+
+// externalBackend represents a ms that is started/stopped by external commands
+// (ms process is not a child of msh: systemd, screen, tmux, panels).
+//
+// ms status is tracked by polling ms status port, following ms log file, running a status command (or a combination).
+type externalBackend struct {
+	m           *sync.Mutex
+	pingFails   int       // consecutive failed pings of ms status port
+	lastLogLine time.Time // time at which the last ms log line was read
+	startedMsh  bool      // ms was started by msh (startup time can be measured)
+}
+
+// start runs the external start command
+func (e *externalBackend) start() *errco.MshLog {
+	if ServTerm.IsActive {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_SERVER_IS_WARM, "minecraft server already running")
+		return nil
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "running external start command: %s", config.ConfigRuntime.Msh.Backend.StartCommand)
+
+	out, err := runShell(config.ConfigRuntime.Msh.Backend.StartCommand)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_TERMINAL_START, "external start command: %s (%s)", err.Error(), strings.TrimSpace(out))
+	}
+
+	e.m.Lock()
+	e.startedMsh, e.pingFails = true, 0
+	e.m.Unlock()
+
+	setStarting()
+
+	return nil
+}
+
+// stop runs the external stop command (or the ms stop command if not set)
+func (e *externalBackend) stop() *errco.MshLog {
+	if config.ConfigRuntime.Msh.Backend.StopCommand == "" {
+		_, logMsh := Execute(config.ConfigRuntime.Commands.StopServer)
+		if logMsh != nil {
+			return logMsh.AddTrace()
+		}
+	} else {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "running external stop command: %s", config.ConfigRuntime.Msh.Backend.StopCommand)
+
+		// stop commands might block until ms exited (ex: systemctl stop)
+		go func() {
+			out, err := runShell(config.ConfigRuntime.Msh.Backend.StopCommand)
+			if err != nil {
+				errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_KILL, "external stop command: %s (%s)", err.Error(), strings.TrimSpace(out))
+			}
+		}()
+	}
+
+	// status port polling doesn't detect the stopping status
+	setStopping()
+
+	return nil
+}
+
+// send sends a command to ms console using the external console command
+// (output is read from ms log file)
+func (e *externalBackend) send(command string) (string, *errco.MshLog) {
+	if config.ConfigRuntime.Msh.Backend.Command == "" {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "can't send command to minecraft server: enable rcon or set external console command")
+	}
+
+	out, err := runShell(strings.ReplaceAll(config.ConfigRuntime.Msh.Backend.Command, "<command>", shellQuote(command)))
+	if err != nil {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "external console command: %s (%s)", err.Error(), strings.TrimSpace(out))
+	}
+
+	return "", nil
+}
+
+// suspendable returns false (ms process is not a child of msh)
+func (e *externalBackend) suspendable() bool {
+	return false
+}
+
+// suspend is not supported by external backend
+func (e *externalBackend) suspend() (bool, *errco.MshLog) {
+	return false, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_SUSPEND_CALL, "external backend: minecraft server can't be suspended")
+}
+
+// resume is not supported by external backend (ms is never suspended)
+func (e *externalBackend) resume() (bool, *errco.MshLog) {
+	return false, nil
+}
+
+// kill is not supported by external backend
+func (e *externalBackend) kill() *errco.MshLog {
+	return errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_PROCESS_KILL, "external backend: minecraft server process can't be killed (msh is not its parent process)")
+}
+
+// wait waits for ms status to be offline
+func (e *externalBackend) wait() {
+	waitOffline(0)
+}
+
+// ExternalMonitor tracks the status of a ms managed by the external backend (see monitorMS).
+// If a log file is set, ms log file is followed.
+//
+// [goroutine]
+func ExternalMonitor() {
+	if config.ConfigRuntime.Msh.Backend.LogFile != "" {
+		logFile := config.ConfigRuntime.Msh.Backend.LogFile
+		if !filepath.IsAbs(logFile) {
+			logFile = filepath.Join(config.ConfigRuntime.Server.Folder, logFile)
+		}
+
+		go tailFile(logFile, extBackend.logLine, nil)
+	}
+
+	monitorMS(extBackend)
+}
+
+// detected resets the backend state when ms was started externally
+func (e *externalBackend) detected() {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	e.startedMsh, e.pingFails = false, 0
+}
+
+// exited does nothing (no backend resources are bound to ms)
+func (e *externalBackend) exited() {}
+
+// measured returns true if ms was started by msh
+func (e *externalBackend) measured() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	return e.startedMsh
+}
+
+// poll returns if ms is running and if ms status port is responding
+func (e *externalBackend) poll() (bool, bool, *errco.MshLog) {
+	var portUp bool
+	if config.ConfigRuntime.Msh.Backend.PollStatusPort {
+		_, logMsh := pingServInfo(pingLocalTimeout)
+		portUp = logMsh == nil
+	}
+
+	var statusErr error
+	if config.ConfigRuntime.Msh.Backend.StatusCommand != "" {
+		_, statusErr = runShell(config.ConfigRuntime.Msh.Backend.StatusCommand)
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if portUp {
+		e.pingFails = 0
+	} else {
+		e.pingFails++
+	}
+
+	switch {
+	case config.ConfigRuntime.Msh.Backend.StatusCommand != "":
+		if statusErr != nil && e.startedMsh && servstats.Stats.Status == errco.SERVER_STATUS_STARTING && time.Since(ServTerm.startTime) < extStartGrace {
+			// the process manager might not report ms as running immediately after the start command
+			return true, portUp, nil
+		}
+		return statusErr == nil, portUp, nil
+
+	case config.ConfigRuntime.Msh.Backend.PollStatusPort:
+		switch {
+		case portUp:
+			return true, portUp, nil
+		case !ServTerm.IsActive:
+			return false, portUp, nil
+		case servstats.Stats.Status == errco.SERVER_STATUS_STARTING:
+			// ms port is not open while ms is starting
+			return time.Since(ServTerm.startTime) < extStartTimeout, portUp, nil
+		case servstats.Stats.Status == errco.SERVER_STATUS_STOPPING:
+			return false, portUp, nil
+		default:
+			// a single failed ping might be caused by a lag spike
+			return e.pingFails < extPingFails, portUp, nil
+		}
+
+	default:
+		// log file only: ms status is updated by log lines,
+		// ms is considered offline when the log is idle while stopping
+		return ServTerm.IsActive && !(servstats.Stats.Status == errco.SERVER_STATUS_STOPPING && time.Since(e.lastLogLine) > extLogIdle), portUp, nil
+	}
+}
+
+// logLine handles a line read from ms log file
+func (e *externalBackend) logLine(line string) {
+	outputLine(line)
+
+	e.m.Lock()
+	e.lastLogLine = time.Now()
+	e.m.Unlock()
+
+	// log file only: ms start is detected from log
+	if !ServTerm.IsActive && config.ConfigRuntime.Msh.Backend.StatusCommand == "" && !config.ConfigRuntime.Msh.Backend.PollStatusPort {
+		if strings.Contains(line, "INFO") && strings.Contains(line, "Starting minecraft server") {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "minecraft server was started externally")
+			setStarting()
+		}
+		return
+	}
+
+	parseLine(line)
+}
+
+// tailFile follows a file (tail -F semantics) and calls handle for each new line.
+// The file is reopened if it's rotated, truncated or not yet created.
+// If stop is closed, tailFile returns.
+func tailFile(path string, handle func(string), stop chan struct{}) {
+	var f *os.File
+	var r *bufio.Reader
+	var id uint64
+	var pos int64   // read position in file
+	var part string // partial line (not yet terminated by \n)
+	var seekEnd = true
+
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		// open file
+		if f == nil {
+			var err error
+			f, err = os.Open(path)
+			if err != nil {
+				// file not created yet: ms history is not read
+				seekEnd = false
+				time.Sleep(extTailPoll)
+				continue
+			}
+
+			id, _ = opsys.FileId(path)
+			pos, part = 0, ""
+
+			// when msh starts, lines already in the file are skipped
+			if seekEnd {
+				pos, _ = f.Seek(0, io.SeekEnd)
+				seekEnd = false
+			}
+
+			r = bufio.NewReader(f)
+		}
+
+		data, err := r.ReadString('\n')
+		pos += int64(len(data))
+		if err == nil {
+			handle(strings.TrimRight(part+data, "\r\n"))
+			part = ""
+			continue
+		}
+		part += data
+
+		// end of file reached: wait for new data
+		time.Sleep(extTailPoll)
+
+		// file rotated (or removed): reopen file from the beginning
+		if newID, err := opsys.FileId(path); err != nil || newID != id {
+			f.Close()
+			f = nil
+			continue
+		}
+
+		// file truncated: read file from the beginning
+		if st, err := f.Stat(); err == nil && st.Size() < pos {
+			f.Seek(0, io.SeekStart)
+			r.Reset(f)
+			pos, part = 0, ""
+		}
+	}
+}
+
+// runShell runs a command with the system shell (in ms folder) and returns its combined output.
+// Output of background processes started by the command is not collected.
+func runShell(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), extCommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Dir = config.ConfigRuntime.Server.Folder
+
+	// don't wait for background processes started by the command (start command: ms)
+	out, err := opsys.CombinedOutput(cmd)
+
+	return string(out), err
+}
+
+// shellQuote quotes a string so that it's passed as a single argument to the system shell
+func shellQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
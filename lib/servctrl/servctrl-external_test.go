@@ -0,0 +1,101 @@
+package servctrl
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_tailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latest.log")
+
+	// lines already in the file when tail starts are skipped
+	if err := os.WriteFile(path, []byte("old line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go tailFile(path, func(l string) { lines <- l }, stop)
+
+	expect := func(exp string) {
+		t.Helper()
+		select {
+		case l := <-lines:
+			if l != exp {
+				t.Errorf("received %q, expected %q", l, exp)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", exp)
+		}
+	}
+	appendFile := func(p, data string) {
+		t.Helper()
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+
+	time.Sleep(2 * extTailPoll)
+
+	// appended lines (a partial line is returned only when terminated)
+	appendFile(path, "line 1\nline")
+	expect("line 1")
+	time.Sleep(2 * extTailPoll)
+	appendFile(path, " 2\r\n")
+	expect("line 2")
+
+	// truncated file is read from the beginning
+	if err := os.WriteFile(path, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("a")
+
+	// rotated file: new file is read from the beginning
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(path, "rotated\n")
+	expect("rotated")
+}
+
+func Test_shellQuote(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell required")
+	}
+
+	for _, s := range []string{
+		`say hello`,
+		`tellraw @a {"text":"[MSH] it's 'quoted'","color":"aqua"}`,
+		`$(touch /tmp/msh-injection) ; echo`,
+	} {
+		out, err := runShell("printf %s " + shellQuote(s))
+		if err != nil || out != s {
+			t.Errorf("received (%q, %v), expected %q", out, err, s)
+		}
+	}
+}
+
+func Test_runShellBackground(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("posix shell required")
+	}
+
+	// background process that inherited stdout doesn't delay the command (start command: "nohup java ... &")
+	start := time.Now()
+	out, err := runShell("sleep 5 & echo started; echo failed >&2")
+	if err != nil || out != "started\nfailed\n" || time.Since(start) > 2*time.Second {
+		t.Errorf("received (%q, %v) in %s, expected \"started\\nfailed\\n\" without waiting for the background process", out, err, time.Since(start))
+	}
+
+	// exit code is reported with the output
+	if out, err := runShell("echo error; exit 3"); err == nil || out != "error\n" {
+		t.Errorf("received (%q, %v), expected exit error", out, err)
+	}
+}
@@ -0,0 +1,298 @@
+package servctrl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+	"msh/lib/servstats"
+)
+
+// httpBackend is the http backend
+var htBackend *httpBackend = &httpBackend{m: &sync.Mutex{}, client: &http.Client{}}
+
+// httpBackend represents a remote ms (on a machine or cloud instance that is switched on when needed)
+// that is started/stopped by http calls to a management api.
+//
+// ms is considered online when it answers a minecraft status ping on the remote address.
+type httpBackend struct {
+	m          *sync.Mutex
+	client     *http.Client
+	pingFails  int       // consecutive failed pings of remote ms
+	startedMsh bool      // ms was started by msh (startup time can be measured)
+	notReady   time.Time // start time of the ms start after which the remote machine was stopped (ms not ready)
+}
+
+// start executes the http start call
+func (h *httpBackend) start() *errco.MshLog {
+	if ServTerm.IsActive {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_SERVER_IS_WARM, "minecraft server already running")
+		return nil
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "executing http start call: %s %s", config.ConfigRuntime.Msh.Backend.Http.Start.Method, config.ConfigRuntime.Msh.Backend.Http.Start.URL)
+
+	_, err := h.do(config.ConfigRuntime.Msh.Backend.Http.Start, "")
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_TERMINAL_START, "http start call: %s", err.Error())
+	}
+
+	h.m.Lock()
+	h.startedMsh, h.pingFails = true, 0
+	h.m.Unlock()
+
+	setStarting()
+
+	return nil
+}
+
+// stop executes the http stop call (or the ms stop command if not set)
+func (h *httpBackend) stop() *errco.MshLog {
+	if config.ConfigRuntime.Msh.Backend.Http.Stop.URL == "" {
+		_, logMsh := Execute(config.ConfigRuntime.Commands.StopServer)
+		if logMsh != nil {
+			return logMsh.AddTrace()
+		}
+	} else {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "executing http stop call: %s %s", config.ConfigRuntime.Msh.Backend.Http.Stop.Method, config.ConfigRuntime.Msh.Backend.Http.Stop.URL)
+
+		// retries might take a long time
+		go func() {
+			_, err := h.do(config.ConfigRuntime.Msh.Backend.Http.Stop, "")
+			if err != nil {
+				errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_KILL, "http stop call: %s", err.Error())
+			}
+		}()
+	}
+
+	// status ping doesn't detect the stopping status
+	setStopping()
+
+	return nil
+}
+
+// send executes the http command call and returns the response body
+func (h *httpBackend) send(command string) (string, *errco.MshLog) {
+	if config.ConfigRuntime.Msh.Backend.Http.Command.URL == "" {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "can't send command to minecraft server: enable rcon or set http command call")
+	}
+
+	out, err := h.do(config.ConfigRuntime.Msh.Backend.Http.Command, command)
+	if err != nil {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_2, errco.ERROR_PIPE_INPUT_WRITE, "http command call: %s", err.Error())
+	}
+
+	return strings.TrimSpace(out), nil
+}
+
+// suspendable returns false (ms runs on a remote machine)
+func (h *httpBackend) suspendable() bool {
+	return false
+}
+
+// suspend is not supported by http backend
+func (h *httpBackend) suspend() (bool, *errco.MshLog) {
+	return false, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_PROCESS_SUSPEND_CALL, "http backend: minecraft server can't be suspended")
+}
+
+// resume is not supported by http backend (ms is never suspended)
+func (h *httpBackend) resume() (bool, *errco.MshLog) {
+	return false, nil
+}
+
+// kill is not supported by http backend
+func (h *httpBackend) kill() *errco.MshLog {
+	return errco.NewLog(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_PROCESS_KILL, "http backend: minecraft server process can't be killed (minecraft server runs on a remote machine)")
+}
+
+// wait waits for ms status to be offline
+func (h *httpBackend) wait() {
+	waitOffline(0)
+}
+
+// HttpMonitor tracks the status of the remote ms managed by the http backend (see monitorMS).
+//
+// The remote ms is online when it answers a minecraft status ping (readiness probe),
+// it's running while the http status call succeeds (or while it answers status pings, if not set).
+//
+// [goroutine]
+func HttpMonitor() {
+	monitorMS(htBackend)
+}
+
+// detected resets the backend state when the remote ms was started externally
+func (h *httpBackend) detected() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.startedMsh, h.pingFails = false, 0
+}
+
+// exited does nothing (no backend resources are bound to ms)
+func (h *httpBackend) exited() {}
+
+// measured returns true if the remote ms was started by msh
+func (h *httpBackend) measured() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return h.startedMsh
+}
+
+// poll returns if the remote ms is running and if it's ready (answers a minecraft status ping)
+func (h *httpBackend) poll() (bool, bool, *errco.MshLog) {
+	_, logMsh := pingServInfo(pingRemoteTimeout)
+	ready := logMsh == nil
+
+	var statusErr error
+	if config.ConfigRuntime.Msh.Backend.Http.Status.URL != "" {
+		// status call is not retried: a failure means that the remote ms is not running
+		_, statusErr = h.request(config.ConfigRuntime.Msh.Backend.Http.Status, "")
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if ready {
+		h.pingFails = 0
+	} else {
+		h.pingFails++
+	}
+
+	// the remote machine might be running but ms failed to start:
+	// the remote machine is stopped (if the stop call is set) and ms is considered offline.
+	// (not a major error: ms can be warmed again)
+	readyTimeout := time.Duration(config.ConfigRuntime.Msh.Backend.Http.ReadyTimeout) * time.Second
+	notReady := ServTerm.IsActive && servstats.Stats.Status == errco.SERVER_STATUS_STARTING && !ready && time.Since(ServTerm.startTime) > readyTimeout
+	if notReady && !h.notReady.Equal(ServTerm.startTime) {
+		h.notReady = ServTerm.startTime
+		errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_SERVER_NOT_ONLINE, "remote minecraft server not ready after %s", readyTimeout)
+
+		if config.ConfigRuntime.Msh.Backend.Http.Stop.URL != "" {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "executing http stop call: %s %s", config.ConfigRuntime.Msh.Backend.Http.Stop.Method, config.ConfigRuntime.Msh.Backend.Http.Stop.URL)
+
+			// retries might take a long time
+			go func() {
+				_, err := h.do(config.ConfigRuntime.Msh.Backend.Http.Stop, "")
+				if err != nil {
+					errco.NewLogln(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_KILL, "http stop call: %s", err.Error())
+				}
+			}()
+		}
+	}
+
+	switch {
+	case config.ConfigRuntime.Msh.Backend.Http.Status.URL != "":
+		if statusErr != nil && h.startedMsh && servstats.Stats.Status == errco.SERVER_STATUS_STARTING && time.Since(ServTerm.startTime) < readyTimeout {
+			// the remote machine might not report ms as running while booting
+			return true, ready, nil
+		}
+		return statusErr == nil, ready, nil
+
+	case ready:
+		return true, ready, nil
+	case !ServTerm.IsActive:
+		return false, ready, nil
+	case servstats.Stats.Status == errco.SERVER_STATUS_STARTING:
+		// remote machine is booting (until ReadyTimeout)
+		return !notReady, ready, nil
+	case servstats.Stats.Status == errco.SERVER_STATUS_STOPPING:
+		return false, ready, nil
+	default:
+		// a single failed ping might be caused by a lag spike
+		return h.pingFails < extPingFails, ready, nil
+	}
+}
+
+// do executes an http call (command replaces the <command> placeholder) and returns the response body.
+// The call is retried (with exponential backoff) if it fails or the response is not the expected one.
+func (h *httpBackend) do(call model.HttpCall, command string) (string, error) {
+	backoff := time.Duration(config.ConfigRuntime.Msh.Backend.Http.Backoff) * time.Second
+
+	var body string
+	var err error
+	for attempt := 0; ; attempt++ {
+		body, err = h.request(call, command)
+		if err == nil || attempt >= config.ConfigRuntime.Msh.Backend.Http.Retries {
+			break
+		}
+
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_HTTP_BACKEND, "http call %s %s failed (retry in %s): %s", call.Method, call.URL, backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return body, err
+}
+
+// request executes a single http call and checks the response
+func (h *httpBackend) request(call model.HttpCall, command string) (string, error) {
+	// command is escaped as url query value in Url and as json string content in Body
+	jsonCommand, _ := json.Marshal(command)
+	ru := strings.NewReplacer(
+		"<host>", config.ServHost,
+		"<port>", fmt.Sprintf("%d", config.ServPort),
+		"<command>", url.QueryEscape(command),
+	)
+	rb := strings.NewReplacer(
+		"<host>", config.ServHost,
+		"<port>", fmt.Sprintf("%d", config.ServPort),
+		"<command>", string(jsonCommand[1:len(jsonCommand)-1]),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ConfigRuntime.Msh.Backend.Http.Timeout)*time.Second)
+	defer cancel()
+
+	method := call.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	var reqBody io.Reader
+	if call.Body != "" {
+		reqBody = strings.NewReader(rb.Replace(call.Body))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ru.Replace(call.URL), reqBody)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range call.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// check response status (any 2xx if expected status is not set)
+	switch {
+	case call.ExpectStatus == 0 && (res.StatusCode < 200 || res.StatusCode > 299):
+		return "", fmt.Errorf("unexpected response status %d", res.StatusCode)
+	case call.ExpectStatus != 0 && res.StatusCode != call.ExpectStatus:
+		return "", fmt.Errorf("unexpected response status %d (expected %d)", res.StatusCode, call.ExpectStatus)
+	}
+
+	// check response body
+	if !strings.Contains(string(data), call.ExpectBody) {
+		return "", fmt.Errorf("response body does not contain %q", call.ExpectBody)
+	}
+
+	return string(data), nil
+}
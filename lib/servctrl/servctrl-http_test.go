@@ -0,0 +1,170 @@
+package servctrl
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+	"msh/lib/servstats"
+)
+
+func Test_httpBackend(t *testing.T) {
+	m := &sync.Mutex{}
+	startCalls := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		switch r.URL.Path {
+		case "/start":
+			// first call fails: it must be retried
+			m.Lock()
+			startCalls++
+			n := startCalls
+			m.Unlock()
+			if n == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer token" || string(body) != `{"host":"198.51.100.7"}` {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		case "/status":
+			io.WriteString(w, `{"state":"stopped"}`)
+		case "/escape":
+			// command must be intact both in url query and json body
+			var b struct{ Cmd string }
+			if err := json.Unmarshal(body, &b); err != nil || b.Cmd != r.URL.Query().Get("cmd") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			io.WriteString(w, b.Cmd)
+		case "/command":
+			io.WriteString(w, "ran: "+string(body)+"\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	config.ServHost = "198.51.100.7"
+	config.ConfigRuntime.Msh.Backend.Http.Retries = 2
+	config.ConfigRuntime.Msh.Backend.Http.Timeout = 5
+	config.ConfigRuntime.Msh.Backend.Http.Backoff = 0
+	config.ConfigRuntime.Msh.Backend.Http.Command = model.HttpCall{URL: srv.URL + "/command", Body: "<command>"}
+
+	h := &httpBackend{m: &sync.Mutex{}, client: &http.Client{}}
+
+	// retried call with headers and body template
+	start := model.HttpCall{
+		URL:          srv.URL + "/start",
+		Method:       http.MethodPost,
+		Headers:      map[string]string{"Authorization": "Bearer token"},
+		Body:         `{"host":"<host>"}`,
+		ExpectStatus: http.StatusAccepted,
+	}
+	if _, err := h.do(start, ""); err != nil {
+		t.Errorf("start call: %s", err.Error())
+	}
+	if startCalls != 2 {
+		t.Errorf("start call executed %d times, expected 2", startCalls)
+	}
+
+	// unexpected response body
+	status := model.HttpCall{URL: srv.URL + "/status", Method: http.MethodGet, ExpectBody: `"state":"running"`}
+	if _, err := h.do(status, ""); err == nil {
+		t.Error("status call: expected error for unexpected response body")
+	}
+
+	// unexpected response status (retries exhausted)
+	missing := model.HttpCall{URL: srv.URL + "/missing"}
+	if _, err := h.do(missing, ""); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing call: unexpected error %v", err)
+	}
+
+	// command call returns the response body
+	out, logMsh := h.send("list")
+	if logMsh != nil {
+		t.Fatalf("send: %v", logMsh)
+	}
+	if out != "ran: list" {
+		t.Errorf("send: unexpected output %q", out)
+	}
+
+	// command is escaped in url and body
+	escape := model.HttpCall{URL: srv.URL + "/escape?cmd=<command>&x=1", Body: `{"cmd":"<command>"}`}
+	cmd := "say \"hi\" & x=2 #1\\"
+	if out, err := h.do(escape, cmd); err != nil || out != cmd {
+		t.Errorf("escape call: unexpected output %q (%v)", out, err)
+	}
+}
+
+func Test_httpPollReadyTimeout(t *testing.T) {
+	stopped := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stop" {
+			stopped <- struct{}{}
+		}
+	}))
+	defer srv.Close()
+
+	// remote ms never answers status pings
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ServHost, config.ServPort = "127.0.0.1", l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	config.ConfigRuntime.Msh.Backend.Http.Status = model.HttpCall{}
+	config.ConfigRuntime.Msh.Backend.Http.Stop = model.HttpCall{URL: srv.URL + "/stop"}
+	config.ConfigRuntime.Msh.Backend.Http.ReadyTimeout = 60
+	config.ConfigRuntime.Msh.Backend.Http.Timeout = 5
+
+	servstats.Stats.Status, servstats.Stats.MajorError = errco.SERVER_STATUS_STARTING, nil
+	ServTerm.IsActive, ServTerm.startTime = true, time.Now()
+	defer func() {
+		servstats.Stats.Status, servstats.Stats.MajorError = errco.SERVER_STATUS_OFFLINE, nil
+		ServTerm.IsActive = false
+	}()
+
+	h := &httpBackend{m: &sync.Mutex{}, client: &http.Client{}, startedMsh: true}
+
+	// remote machine is booting
+	if running, ready, _ := h.poll(); !running || ready {
+		t.Errorf("poll while booting: running %t ready %t", running, ready)
+	}
+
+	// ReadyTimeout expired: remote machine is stopped and ms is not running
+	ServTerm.startTime = time.Now().Add(-2 * time.Minute)
+	if running, _, _ := h.poll(); running {
+		t.Error("poll after ReadyTimeout: expected not running")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("stop call not executed after ReadyTimeout")
+	}
+
+	// ms can be warmed again (no major error) and the stop call is executed once for each start
+	if servstats.Stats.MajorError != nil {
+		t.Errorf("poll after ReadyTimeout: unexpected major error %v", servstats.Stats.MajorError)
+	}
+	h.poll()
+	select {
+	case <-stopped:
+		t.Error("stop call executed again for the same start")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,317 @@
+package servctrl
+
+import (
+	"archive/zip"
+	"bufio"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/model"
+)
+
+// log profile "auto" detects the profile from ms jar manifest or ms startup log
+const logProfileAuto string = "auto"
+
+// events matched by log profiles
+const (
+	logEvDone     string = "done"     // ms is online
+	logEvProgress string = "progress" // ms load progress (arg: progress)
+	logEvJoin     string = "join"     // a player joined ms (arg: player name)
+	logEvLeave    string = "leave"    // a player left ms (arg: player name)
+	logEvStopping string = "stopping" // ms is stopping
+	logEvCrash    string = "crash"    // ms stopped responding or crashed
+	logEvLag      string = "lag"      // ms can't keep up
+)
+
+// logProfile is a set of regular expressions matching the log lines of a server software.
+// Regular expressions can be nil (event not detected).
+type logProfile struct {
+	name     string
+	detect   *regexp.Regexp // matches a startup log line of the server software (nil: never detected from log)
+	done     *regexp.Regexp
+	progress *regexp.Regexp // first group is the load progress
+	join     *regexp.Regexp // first group is the player name
+	leave    *regexp.Regexp // first group is the player name
+	stopping *regexp.Regexp
+	crash    *regexp.Regexp
+	lag      *regexp.Regexp
+}
+
+// log lines of java edition servers (vanilla and derivatives)
+//
+// chat messages contain "<player>" and are excluded from stopping and crash:
+//
+//	[14:09:46] [Server thread/INFO]: Stopping the server
+//	[15Mar2021 14:09:46.581] [Server thread/INFO] [net.minecraft.server.dedicated.DedicatedServer/]: Stopping the server
+//	[14:08:43] [Server thread/INFO]: <player> Stopping the server
+var (
+	javaDone     = regexp.MustCompile(`INFO.*: Done \(`) // ": Done (" instead of "Done" to avoid false positives (issue #112)
+	javaProgress = regexp.MustCompile(`INFO.*Preparing spawn area: (\d+%)`)
+	javaJoin     = regexp.MustCompile(`INFO[^<]*: (\w{1,16}) joined the game`)
+	javaLeave    = regexp.MustCompile(`INFO[^<]*: (\w{1,16}) lost connection:`) // "lost connection:" is more general compared to "left the game"
+	javaStopping = regexp.MustCompile(`INFO[^<]*: Stopping (?:the )?server`)
+	javaCrash    = regexp.MustCompile(`^[^<]*ERROR\]?[^<]*: (?:.*stopped responding!|-{10})`)
+	javaLag      = regexp.MustCompile(`Can't keep up!`)
+)
+
+// builtinLogProfiles are the log profiles of supported server software.
+// The first profile is used when the profile can't be detected.
+var builtinLogProfiles []*logProfile = []*logProfile{
+	{
+		name: "vanilla", detect: nil,
+		done: javaDone, progress: javaProgress, join: javaJoin, leave: javaLeave, stopping: javaStopping, crash: javaCrash, lag: javaLag,
+	},
+	{
+		name: "paper", detect: regexp.MustCompile(`This server is running (Paper|Purpur|Pufferfish|Folia) version`),
+		done: javaDone, progress: javaProgress, join: javaJoin, leave: javaLeave, stopping: javaStopping, crash: javaCrash, lag: javaLag,
+	},
+	{
+		name: "fabric", detect: regexp.MustCompile(`Loading Minecraft \S+ with Fabric Loader`),
+		done: javaDone, progress: javaProgress, join: javaJoin, leave: javaLeave, stopping: javaStopping, crash: javaCrash, lag: javaLag,
+	},
+	{
+		name: "forge", detect: regexp.MustCompile(`(ModLauncher running: .*forge|MinecraftForge v\d)`),
+		done: javaDone, progress: javaProgress, join: javaJoin, leave: javaLeave, stopping: javaStopping, crash: javaCrash, lag: javaLag,
+	},
+	{
+		name: "neoforge", detect: regexp.MustCompile(`(ModLauncher running: .*neoforge|NeoForge v?\d)`),
+		done: javaDone, progress: javaProgress, join: javaJoin, leave: javaLeave, stopping: javaStopping, crash: javaCrash, lag: javaLag,
+	},
+	{
+		name: "velocity", detect: regexp.MustCompile(`Booting up Velocity`),
+		done:     javaDone,
+		join:     regexp.MustCompile(`\[connected player\] (\w{1,16}) \(.*\) has connected`),
+		leave:    regexp.MustCompile(`\[connected player\] (\w{1,16}) \(.*\) has disconnected`),
+		stopping: regexp.MustCompile(`Shutting down the proxy`),
+	},
+	{
+		name: "bungeecord", detect: regexp.MustCompile(`(Enabled BungeeCord|Waterfall) version`),
+		done:     regexp.MustCompile(`Listening on /`),
+		join:     regexp.MustCompile(`\[(\w{1,16})\] <-> ServerConnector \[.*\] has connected`),
+		leave:    regexp.MustCompile(`\[(\w{1,16})\] -> UpstreamBridge has disconnected`),
+		stopping: regexp.MustCompile(`Closing listener`),
+	},
+	{
+		name: "bds", detect: regexp.MustCompile(`INFO\] Starting Server$`),
+		done:     regexp.MustCompile(`INFO\] Server started\.`),
+		join:     regexp.MustCompile(`Player connected: ([^,]+),`),
+		leave:    regexp.MustCompile(`Player disconnected: ([^,]+),`),
+		stopping: regexp.MustCompile(`(?:Server stop requested\.|INFO\] Stopping server\.\.\.)`),
+		crash:    regexp.MustCompile(`(?:Crash|crash) (?:detected|reported)`),
+	},
+}
+
+// jarLogProfiles associates ms jar manifest entries to log profiles
+// (checked in order: neoforge jars also reference forge)
+var jarLogProfiles = []struct {
+	substr  string
+	profile string
+}{
+	{"neoforged", "neoforge"},
+	{"minecraftforge", "forge"},
+	{"fabricmc", "fabric"},
+	{"papermc", "paper"},
+	{"velocitypowered", "velocity"},
+	{"md_5.bungee", "bungeecord"},
+	{"net.minecraft", "vanilla"},
+}
+
+// logProf is the log profile used to parse ms log lines
+var logProf = struct {
+	m        *sync.Mutex
+	all      []*logProfile // user-defined and built-in log profiles (nil if not loaded yet)
+	p        *logProfile   // log profile in use (nil if not selected yet)
+	detected bool          // log profile was selected by config or detected
+}{
+	m: &sync.Mutex{},
+}
+
+// currentLogProfile returns the log profile used to parse a line of ms log.
+// If the profile is "auto" and it was not detected from ms jar, the line is checked for a startup banner.
+func currentLogProfile(line string, starting bool) *logProfile {
+	logProf.m.Lock()
+	defer logProf.m.Unlock()
+
+	if logProf.p == nil {
+		logProf.p, logProf.detected = selectLogProfile()
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "using log profile: %s", logProf.p.name)
+	}
+
+	// startup banners are printed while ms is starting
+	if !logProf.detected && starting {
+		for _, p := range logProfiles() {
+			if p.detect != nil && p.detect.MatchString(line) {
+				errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "log profile detected from minecraft server log: %s", p.name)
+				logProf.p, logProf.detected = p, true
+				break
+			}
+		}
+	}
+
+	return logProf.p
+}
+
+// selectLogProfile returns the log profile specified in config
+// or the one detected from ms jar manifest (LogProfile "auto").
+// Returns false if the profile should be detected from ms log.
+// logProf.m must be locked.
+func selectLogProfile() (*logProfile, bool) {
+	name := config.ConfigRuntime.Msh.LogProfile
+
+	if name != logProfileAuto && name != "" {
+		if p := findLogProfile(name); p != nil {
+			return p, true
+		}
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "log profile %s not found (detecting it)", name)
+	}
+
+	// ms jar is available only if ms runs on this machine
+	if config.ConfigRuntime.Msh.Backend.Type == config.BACKEND_TERMINAL {
+		jarPath := filepath.Join(config.ConfigRuntime.Server.Folder, config.ConfigRuntime.Server.FileName)
+		if name := jarLogProfile(jarPath); name != "" {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "log profile detected from minecraft server jar: %s", name)
+			return findLogProfile(name), true
+		}
+	}
+
+	return builtinLogProfiles[0], false
+}
+
+// findLogProfile returns the log profile with the specified name (nil if not found).
+// User-defined profiles override built-in profiles with the same name.
+// logProf.m must be locked.
+func findLogProfile(name string) *logProfile {
+	for _, p := range logProfiles() {
+		if strings.EqualFold(p.name, name) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// logProfiles returns the user-defined log profiles followed by the built-in ones.
+// logProf.m must be locked.
+func logProfiles() []*logProfile {
+	if logProf.all != nil {
+		return logProf.all
+	}
+
+	profiles := []*logProfile{}
+
+	for _, lp := range config.ConfigRuntime.Msh.LogProfiles {
+		p, logMsh := compileLogProfile(lp)
+		if logMsh != nil {
+			logMsh.Log(true)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+
+	logProf.all = append(profiles, builtinLogProfiles...)
+
+	return logProf.all
+}
+
+// compileLogProfile compiles a user-defined log profile.
+// Patterns not set are taken from the vanilla profile (Detect excluded).
+func compileLogProfile(lp model.LogProfile) (*logProfile, *errco.MshLog) {
+	vanilla := builtinLogProfiles[0]
+	p := &logProfile{name: lp.Name}
+
+	for _, f := range []struct {
+		pattern string
+		re      **regexp.Regexp
+		def     *regexp.Regexp
+	}{
+		{lp.Detect, &p.detect, nil},
+		{lp.Done, &p.done, vanilla.done},
+		{lp.Progress, &p.progress, vanilla.progress},
+		{lp.Join, &p.join, vanilla.join},
+		{lp.Leave, &p.leave, vanilla.leave},
+		{lp.Stopping, &p.stopping, vanilla.stopping},
+		{lp.Crash, &p.crash, vanilla.crash},
+		{lp.Lag, &p.lag, vanilla.lag},
+	} {
+		if f.pattern == "" {
+			*f.re = f.def
+			continue
+		}
+
+		re, err := regexp.Compile(f.pattern)
+		if err != nil {
+			return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_CONFIG_CHECK, "log profile %s: invalid pattern %q: %s", lp.Name, f.pattern, err.Error())
+		}
+		*f.re = re
+	}
+
+	return p, nil
+}
+
+// jarLogProfile returns the name of the log profile that matches the manifest of a jar ("" if unknown)
+func jarLogProfile(jarPath string) string {
+	r, err := zip.OpenReader(jarPath)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+
+	f, err := r.Open("META-INF/MANIFEST.MF")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// manifest entries that identify the server software
+	entries := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		switch key {
+		case "Main-Class", "Launcher-Agent-Class", "Implementation-Title", "Implementation-Vendor", "Specification-Title":
+			if found {
+				entries += strings.ToLower(value) + " "
+			}
+		}
+	}
+
+	for _, j := range jarLogProfiles {
+		if strings.Contains(entries, j.substr) {
+			return j.profile
+		}
+	}
+
+	return ""
+}
+
+// event returns the event matched by a line of ms log and its argument ("" if no event matches)
+func (p *logProfile) event(line string) (string, string) {
+	for _, e := range []struct {
+		ev string
+		re *regexp.Regexp
+	}{
+		{logEvDone, p.done},
+		{logEvProgress, p.progress},
+		{logEvJoin, p.join},
+		{logEvLeave, p.leave},
+		{logEvStopping, p.stopping},
+		{logEvCrash, p.crash},
+		{logEvLag, p.lag},
+	} {
+		if e.re == nil {
+			continue
+		}
+		if m := e.re.FindStringSubmatch(line); m != nil {
+			if len(m) > 1 {
+				return e.ev, m[1]
+			}
+			return e.ev, ""
+		}
+	}
+
+	return "", ""
+}
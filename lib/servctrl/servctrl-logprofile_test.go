@@ -0,0 +1,137 @@
+package servctrl
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"msh/lib/config"
+	"msh/lib/model"
+)
+
+func Test_logProfileEvent(t *testing.T) {
+	logProf.m.Lock()
+	logProf.all = nil
+	logProf.m.Unlock()
+
+	for _, c := range []struct {
+		profile string
+		line    string
+		ev      string
+		arg     string
+	}{
+		{"vanilla", "[14:00:01] [Worker-Main-2/INFO]: Preparing spawn area: 83%", logEvProgress, "83%"},
+		{"vanilla", "[14:00:02] [Server thread/INFO]: Done (4.213s)! For help, type \"help\"", logEvDone, ""},
+		{"vanilla", "[14:05:00] [Server thread/INFO]: Steve joined the game", logEvJoin, "Steve"},
+		{"vanilla", "[14:06:00] [Server thread/INFO]: Steve lost connection: Disconnected", logEvLeave, "Steve"},
+		{"vanilla", "[14:09:46] [Server thread/INFO]: Stopping the server", logEvStopping, ""},
+		{"vanilla", "[14:08:43] [Server thread/INFO]: <Steve> Stopping the server", "", ""},
+		{"vanilla", "[14:09:32] [Server thread/INFO]: [Steve] Stopping", "", ""},
+		{"vanilla", "[18:49:08] [Server Watchdog/ERROR]: The server has stopped responding! This is (probably) not a Paper bug.", logEvCrash, ""},
+		{"vanilla", "[18:49:08] [Server Watchdog/ERROR]: ------------------------------", logEvCrash, ""},
+		{"vanilla", "[18:49:08] [Server thread/INFO]: <Steve> ERROR: the server has stopped responding!", "", ""},
+		{"vanilla", "[18:49:08] [Server thread/INFO]: <Steve> ERROR ----------", "", ""},
+		{"paper", "[18:49:08 ERROR]: ------------------------------", logEvCrash, ""},
+		{"vanilla", "[18:49:08] [Server thread/WARN]: Can't keep up! Is the server overloaded? Running 2050ms or 41 ticks behind", logEvLag, ""},
+		{"paper", "[12:00:00 INFO]: Done (3.210s)! For help, type \"help\"", logEvDone, ""},
+		{"paper", "[12:30:00 INFO]: Stopping server", logEvStopping, ""},
+		{"forge", "[15Mar2021 14:09:46.581] [Server thread/INFO] [net.minecraft.server.dedicated.DedicatedServer/]: Stopping the server", logEvStopping, ""},
+		{"velocity", "[12:00:00 INFO]: Done (1.23s)!", logEvDone, ""},
+		{"velocity", "[12:01:00 INFO]: [connected player] Steve (/10.0.0.2:53122) has connected", logEvJoin, "Steve"},
+		{"velocity", "[12:02:00 INFO]: [connected player] Steve (/10.0.0.2:53122) has disconnected", logEvLeave, "Steve"},
+		{"velocity", "[12:03:00 INFO]: Shutting down the proxy...", logEvStopping, ""},
+		{"bungeecord", "12:00:00 [INFO] Listening on /0.0.0.0:25577", logEvDone, ""},
+		{"bungeecord", "12:01:00 [INFO] [Steve] <-> ServerConnector [lobby] has connected", logEvJoin, "Steve"},
+		{"bungeecord", "12:02:00 [INFO] [Steve] -> UpstreamBridge has disconnected", logEvLeave, "Steve"},
+		{"bds", "[2024-01-01 12:00:05:000 INFO] Server started.", logEvDone, ""},
+		{"bds", "[2024-01-01 12:01:00:000 INFO] Player connected: Steve Jobs, xuid: 2535400000000000", logEvJoin, "Steve Jobs"},
+		{"bds", "[2024-01-01 12:02:00:000 INFO] Player disconnected: Steve Jobs, xuid: 2535400000000000, pfid: 0000", logEvLeave, "Steve Jobs"},
+		{"bds", "[2024-01-01 12:03:00:000 INFO] Server stop requested.", logEvStopping, ""},
+	} {
+		logProf.m.Lock()
+		p := findLogProfile(c.profile)
+		logProf.m.Unlock()
+
+		ev, arg := p.event(c.line)
+		if ev != c.ev || arg != c.arg {
+			t.Errorf("%s %q: got (%q, %q), expected (%q, %q)", c.profile, c.line, ev, arg, c.ev, c.arg)
+		}
+	}
+}
+
+func Test_currentLogProfile(t *testing.T) {
+	defer func() {
+		config.ConfigRuntime.Msh.LogProfile = ""
+		config.ConfigRuntime.Msh.LogProfiles = nil
+		config.ConfigRuntime.Msh.Backend.Type = ""
+		logProf.p, logProf.all, logProf.detected = nil, nil, false
+	}()
+
+	// profile detected from startup banner
+	config.ConfigRuntime.Msh.LogProfile = logProfileAuto
+	config.ConfigRuntime.Msh.Backend.Type = config.BACKEND_EXTERNAL
+	logProf.p, logProf.all, logProf.detected = nil, nil, false
+
+	if p := currentLogProfile("[12:00:00] [main/INFO]: Loading Minecraft 1.20.4 with Fabric Loader 0.15.6", false); p.name != "vanilla" {
+		t.Errorf("banner while not starting: got profile %s", p.name)
+	}
+	if p := currentLogProfile("[12:00:00] [main/INFO]: Loading Minecraft 1.20.4 with Fabric Loader 0.15.6", true); p.name != "fabric" {
+		t.Errorf("fabric banner: got profile %s", p.name)
+	}
+	if p := currentLogProfile("[12:00:01 INFO]: This server is running Paper version 1.20.4", true); p.name != "fabric" {
+		t.Errorf("profile changed after detection: got profile %s", p.name)
+	}
+
+	// user-defined profile selected by config, empty patterns are taken from vanilla
+	config.ConfigRuntime.Msh.LogProfile = "custom"
+	config.ConfigRuntime.Msh.LogProfiles = []model.LogProfile{{Name: "custom", Done: `Server ready`}}
+	logProf.p, logProf.all, logProf.detected = nil, nil, false
+
+	p := currentLogProfile("", true)
+	if p.name != "custom" {
+		t.Fatalf("user-defined profile: got profile %s", p.name)
+	}
+	if ev, _ := p.event("[12:00:00] Server ready"); ev != logEvDone {
+		t.Errorf("user-defined done pattern: got event %q", ev)
+	}
+	if ev, arg := p.event("[14:05:00] [Server thread/INFO]: Steve joined the game"); ev != logEvJoin || arg != "Steve" {
+		t.Errorf("vanilla join pattern in user-defined profile: got (%q, %q)", ev, arg)
+	}
+}
+
+func Test_jarLogProfile(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, c := range []struct {
+		manifest string
+		profile  string
+	}{
+		{"Manifest-Version: 1.0\r\nMain-Class: io.papermc.paperclip.Main\r\n", "paper"},
+		{"Manifest-Version: 1.0\r\nMain-Class: net.fabricmc.installer.ServerLauncher\r\n", "fabric"},
+		{"Manifest-Version: 1.0\r\nMain-Class: net.minecraft.bundler.Main\r\n", "vanilla"},
+		{"Manifest-Version: 1.0\r\nMain-Class: net.neoforged.serverstarterjar.Main\r\nImplementation-Vendor: net.minecraftforge\r\n", "neoforge"},
+		{"Manifest-Version: 1.0\r\nMain-Class: com.velocitypowered.proxy.Velocity\r\n", "velocity"},
+		{"Manifest-Version: 1.0\r\nMain-Class: org.example.Unknown\r\n", ""},
+	} {
+		jarPath := filepath.Join(dir, "server.jar")
+		f, err := os.Create(jarPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := zip.NewWriter(f)
+		mf, _ := w.Create("META-INF/MANIFEST.MF")
+		mf.Write([]byte(c.manifest))
+		w.Close()
+		f.Close()
+
+		if profile := jarLogProfile(jarPath); profile != c.profile {
+			t.Errorf("manifest %q: got profile %q, expected %q", c.manifest, profile, c.profile)
+		}
+	}
+
+	// not a jar (bedrock dedicated server)
+	if profile := jarLogProfile(filepath.Join(dir, "bedrock_server")); profile != "" {
+		t.Errorf("missing jar: got profile %q", profile)
+	}
+}
@@ -0,0 +1,283 @@
+package servctrl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+)
+
+// rcon packet types
+const (
+	RconTypeResponse int32 = 0   // SERVERDATA_RESPONSE_VALUE
+	RconTypeCommand  int32 = 2   // SERVERDATA_EXECCOMMAND (also SERVERDATA_AUTH_RESPONSE)
+	RconTypeAuth     int32 = 3   // SERVERDATA_AUTH
+	rconTypeSentinel int32 = 200 // unknown type: ms answers it after all the response packets of the previous command
+)
+
+const (
+	rconDefaultPort int           = 25575           // default rcon port of ms
+	rconTimeout     time.Duration = 5 * time.Second // timeout for rcon dial/read/write
+	rconMinPacket   int32         = 4 + 4 + 1 + 1   // min packet length (request id + type + 2 null bytes)
+	rconMaxPacket   int32         = 4 + 4 + 8192    // max packet length accepted (ms splits responses in 4096 bytes packets)
+)
+
+// rcon is the rcon client used to execute commands on ms
+var rcon *rconClient = &rconClient{m: &sync.Mutex{}}
+
+// rconClient represents a rcon connection to ms.
+//
+// Commands are executed one at a time: each command has its own request id
+// and its response (possibly split in multiple packets) is read until the
+// response to a sentinel packet is received.
+type rconClient struct {
+	m     *sync.Mutex
+	conn  net.Conn
+	r     *bufio.Reader
+	addr  string // address of the current connection
+	reqID int32  // last request id used
+}
+
+// rconConfig returns the rcon address and password of ms.
+// If rcon is not enabled in server.properties (enable-rcon and rcon.password), ok is false.
+func rconConfig() (string, string, bool) {
+	if enabled, logMsh := config.ConfigRuntime.ParsePropertiesBool("enable-rcon"); logMsh != nil || !enabled {
+		return "", "", false
+	}
+
+	password, logMsh := config.ConfigRuntime.ParsePropertiesString("rcon.password")
+	if logMsh != nil || password == "" {
+		return "", "", false
+	}
+
+	port, logMsh := config.ConfigRuntime.ParsePropertiesInt("rcon.port")
+	if logMsh != nil {
+		port = rconDefaultPort
+	}
+
+	return fmt.Sprintf("%s:%d", config.ServHost, port), password, true
+}
+
+// execRcon executes a command on ms using rcon.
+//
+// If rcon is not enabled or the command could not be sent (dial or authentication failure),
+// ok is false and the caller should fall back to stdin.
+// If the command was sent but its output could not be received, ok is true and an error is returned
+// (the command should not be executed again as it might have been executed).
+func execRcon(command string) (string, bool, *errco.MshLog) {
+	addr, password, ok := rconConfig()
+	if !ok {
+		return "", false, nil
+	}
+
+	out, sent, logMsh := rcon.exec(addr, password, command)
+	if logMsh != nil {
+		if sent {
+			return "", true, logMsh.AddTrace()
+		}
+
+		logMsh.AddTrace().Log(true)
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_RCON, "rcon command not sent: falling back to ms terminal")
+		return "", false, nil
+	}
+
+	return out, true, nil
+}
+
+// exec executes a command using rcon and returns its exact output.
+// If the connection is not open (or it was closed by ms), a new connection is opened and authenticated.
+//
+// sent is true if the command was written to ms (if an error is returned, the command might have been executed).
+func (rc *rconClient) exec(addr, password, command string) (string, bool, *errco.MshLog) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	// replace connections to another address or closed by ms (ex: ms restarted)
+	if rc.conn != nil && (rc.addr != addr || !rc.alive()) {
+		rc.close()
+	}
+
+	if rc.conn == nil {
+		logMsh := rc.connect(addr, password)
+		if logMsh != nil {
+			return "", false, logMsh.AddTrace()
+		}
+	}
+
+	out, sent, logMsh := rc.command(command)
+	if logMsh != nil {
+		rc.close()
+		return "", sent, logMsh.AddTrace()
+	}
+
+	return out, true, nil
+}
+
+// alive returns true if the rcon connection was not closed by ms.
+// (rconClient mutex should be locked by caller function)
+func (rc *rconClient) alive() bool {
+	// no data is expected: a read that times out means that the connection is still open
+	rc.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := rc.r.Peek(1)
+
+	var netErr net.Error
+	return err == nil || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// connect opens and authenticates a rcon connection.
+// (rconClient mutex should be locked by caller function)
+func (rc *rconClient) connect(addr, password string) *errco.MshLog {
+	conn, err := net.DialTimeout("tcp", addr, rconTimeout)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON, "rcon dial: %s", err.Error())
+	}
+
+	rc.conn, rc.r, rc.addr = conn, bufio.NewReader(conn), addr
+
+	id, err := rc.send(RconTypeAuth, password)
+	if err != nil {
+		rc.close()
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON, "rcon auth: %s", err.Error())
+	}
+
+	for {
+		respID, respType, _, err := rc.receive()
+		if err != nil {
+			rc.close()
+			return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON, "rcon auth: %s", err.Error())
+		}
+
+		// some servers send an empty response value before the auth response
+		if respType != RconTypeCommand {
+			continue
+		}
+
+		if respID == -1 || respID != id {
+			rc.close()
+			return errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON_AUTH, "rcon authentication failed (check rcon.password)")
+		}
+
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "rcon connection to %s authenticated", addr)
+
+		return nil
+	}
+}
+
+// command sends a command and reads its full output.
+// sent is true if the command was written to ms.
+// (rconClient mutex should be locked by caller function)
+func (rc *rconClient) command(command string) (string, bool, *errco.MshLog) {
+	id, err := rc.send(RconTypeCommand, command)
+	if err != nil {
+		return "", false, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON, "rcon send: %s", err.Error())
+	}
+
+	// responses longer than a packet are split: the sentinel response marks the end of the command output
+	sentinelID, err := rc.send(rconTypeSentinel, "")
+	if err != nil {
+		return "", true, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON, "rcon send: %s", err.Error())
+	}
+
+	out := ""
+	for {
+		respID, respType, body, err := rc.receive()
+		if err != nil {
+			return "", true, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_RCON, "rcon receive: %s", err.Error())
+		}
+
+		switch {
+		case respID == sentinelID:
+			return out, true, nil
+		case respID == id && respType == RconTypeResponse:
+			out += body
+		default:
+			// response to a previous (timed out) request
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_RCON, "rcon: discarding unexpected response (id: %d, type: %d)", respID, respType)
+		}
+	}
+}
+
+// send writes a rcon packet and returns its request id.
+// (rconClient mutex should be locked by caller function)
+func (rc *rconClient) send(packetType int32, body string) (int32, error) {
+	// request ids are positive (-1 is used by ms for failed authentication)
+	rc.reqID++
+	if rc.reqID <= 0 {
+		rc.reqID = 1
+	}
+
+	rc.conn.SetWriteDeadline(time.Now().Add(rconTimeout))
+
+	return rc.reqID, WriteRconPacket(rc.conn, rc.reqID, packetType, body)
+}
+
+// receive reads a rcon packet.
+// (rconClient mutex should be locked by caller function)
+func (rc *rconClient) receive() (int32, int32, string, error) {
+	rc.conn.SetReadDeadline(time.Now().Add(rconTimeout))
+
+	return ReadRconPacket(rc.r)
+}
+
+// close closes the rcon connection (if open).
+// (rconClient mutex should be locked by caller function)
+func (rc *rconClient) close() {
+	if rc.conn != nil {
+		rc.conn.Close()
+	}
+	rc.conn, rc.r = nil, nil
+}
+
+// WriteRconPacket writes a rcon packet:
+// [ length (int32) | request id (int32) | type (int32) | body | 0x00 | 0x00 ] (little endian)
+func WriteRconPacket(w io.Writer, id, packetType int32, body string) error {
+	packet := bytes.NewBuffer(nil)
+	binary.Write(packet, binary.LittleEndian, int32(4+4+len(body)+2))
+	binary.Write(packet, binary.LittleEndian, id)
+	binary.Write(packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+
+	_, err := w.Write(packet.Bytes())
+	return err
+}
+
+// ReadRconPacket reads a rcon packet and returns its request id, type and body
+func ReadRconPacket(r io.Reader) (int32, int32, string, error) {
+	var length int32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return 0, 0, "", err
+	}
+
+	if length < rconMinPacket || length > rconMaxPacket {
+		return 0, 0, "", fmt.Errorf("invalid rcon packet length (%d)", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, 0, "", err
+	}
+
+	id := int32(binary.LittleEndian.Uint32(data[0:4]))
+	packetType := int32(binary.LittleEndian.Uint32(data[4:8]))
+	body := strings.TrimRight(string(data[8:]), "\x00")
+
+	return id, packetType, body, nil
+}
+
+// rconClose closes the rcon connection (called when ms terminal exits)
+func rconClose() {
+	rcon.m.Lock()
+	defer rcon.m.Unlock()
+
+	rcon.close()
+}
@@ -0,0 +1,130 @@
+package servctrl
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRconServer emulates ms rcon: responses are split in 4096 bytes packets
+// and unknown packet types are answered with "Unknown request".
+// Commands received are counted in executed.
+func fakeRconServer(t *testing.T, password string, executed map[string]int, m *sync.Mutex) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err.Error())
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				authed, bye := false, false
+				for {
+					id, packetType, body, err := ReadRconPacket(conn)
+					if err != nil {
+						return
+					}
+
+					if authed && packetType == RconTypeCommand {
+						m.Lock()
+						executed[body]++
+						m.Unlock()
+					}
+
+					switch {
+					case packetType == RconTypeAuth:
+						authed = body == password
+						if !authed {
+							id = -1
+						}
+						WriteRconPacket(conn, id, RconTypeCommand, "")
+					case !authed:
+						return
+					case packetType == RconTypeCommand && body == "long":
+						out := strings.Repeat("a", 4096) + strings.Repeat("b", 100)
+						WriteRconPacket(conn, id, RconTypeResponse, out[:4096])
+						WriteRconPacket(conn, id, RconTypeResponse, out[4096:])
+					case packetType == RconTypeCommand && body == "drop":
+						return
+					case packetType == RconTypeCommand && body == "bye":
+						// connection is closed by ms after the command output (ex: ms restarting)
+						WriteRconPacket(conn, id, RconTypeResponse, "executed: "+body)
+						bye = true
+					case packetType == RconTypeCommand:
+						WriteRconPacket(conn, id, RconTypeResponse, "executed: "+body)
+					default:
+						WriteRconPacket(conn, id, RconTypeResponse, "Unknown request c8")
+						if bye {
+							return
+						}
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func Test_rconClient(t *testing.T) {
+	executed, m := map[string]int{}, &sync.Mutex{}
+	addr := fakeRconServer(t, "secret", executed, m)
+
+	rc := &rconClient{m: rcon.m}
+	defer rc.close()
+
+	// wrong password: command is not sent
+	if _, sent, logMsh := rc.exec(addr, "wrong", "list"); logMsh == nil || sent {
+		t.Errorf("wrong password: expected error (sent: %t)", sent)
+	}
+
+	// simple command
+	out, _, logMsh := rc.exec(addr, "secret", "list")
+	if logMsh != nil || out != "executed: list" {
+		t.Errorf("received (%q, %v), expected %q", out, logMsh, "executed: list")
+	}
+
+	// multi-packet response
+	out, _, logMsh = rc.exec(addr, "secret", "long")
+	if logMsh != nil || len(out) != 4196 || !strings.HasSuffix(out, "b") {
+		t.Errorf("multi-packet response: received %d bytes (%v), expected 4196 bytes", len(out), logMsh)
+	}
+
+	// broken connection after the command was sent: command is not retried
+	if _, sent, logMsh := rc.exec(addr, "secret", "drop"); logMsh == nil || !sent {
+		t.Errorf("dropped connection: expected error after command was sent (sent: %t)", sent)
+	}
+	m.Lock()
+	if executed["drop"] != 1 {
+		t.Errorf("dropped connection: command executed %d times, expected 1", executed["drop"])
+	}
+	m.Unlock()
+
+	// reconnection after broken connection
+	out, _, logMsh = rc.exec(addr, "secret", "say hi")
+	if logMsh != nil || out != "executed: say hi" {
+		t.Errorf("reconnection: received (%q, %v), expected %q", out, logMsh, "executed: say hi")
+	}
+
+	// connection closed by ms: a new connection is opened before sending the command
+	out, _, logMsh = rc.exec(addr, "secret", "bye")
+	if logMsh != nil || out != "executed: bye" {
+		t.Errorf("received (%q, %v), expected %q", out, logMsh, "executed: bye")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	out, _, logMsh = rc.exec(addr, "secret", "say again")
+	if logMsh != nil || out != "executed: say again" {
+		t.Errorf("closed connection: received (%q, %v), expected %q", out, logMsh, "executed: say again")
+	}
+}
@@ -2,6 +2,7 @@ package servctrl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -17,51 +18,85 @@ import (
 	"msh/lib/servstats"
 )
 
-// countPlayerSafe returns the number of players on the server.
-//
-// Players are retrived by (in order): server info, list command, internal connection count.
+const (
+	// pingLocalTimeout is the status ping read timeout for a ms on this machine
+	pingLocalTimeout time.Duration = 200 * time.Millisecond
+	// pingRemoteTimeout is the status ping read timeout for a ms on a remote machine
+	pingRemoteTimeout time.Duration = 2 * time.Second
+)
+
+// playerSampleInterval is the time interval between status ping samples of online players
+const playerSampleInterval time.Duration = 30 * time.Second
+
+// countPlayerSafe returns the number of players on the server according to the player registry.
 //
-// Internal connection count is reset if a more reliable method is used.
+// Before counting, the registry is reconciled with a status ping sample of ms
+// (or with the player count of list command if ms does not answer the status ping).
 //
 // no error is returned: the return integer is always meaningful
-// (might be more or less reliable depending from where it retrieved).
+// (if ms can't be sampled the registry is fed only by proxied connections and ms log).
 func countPlayerSafe() int {
-	var logMsh *errco.MshLog
-	var playerCount int
-	var method string
-
 	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "retrieving player count...")
 
-	if playerCount, logMsh = getPlayersByServInfo(); logMsh.Log(true) == nil {
-		method = "server info"
-		if playerCount != servstats.Stats.ConnCount {
-			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_WRONG_CONNECTION_COUNT, "connection count (%d) different from %s player count (%d)", servstats.Stats.ConnCount, method, playerCount)
+	if servInfo, logMsh := getServInfo(); logMsh.Log(true) == nil {
+		servstats.Players.Sample(servInfo.Players.Online, servInfo.Players.Sample)
+	} else if playerCount, logMsh := getPlayersByListCom(); logMsh.Log(true) == nil {
+		servstats.Players.Sample(playerCount, nil)
+	}
+
+	playerCount := servstats.Players.Count()
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "%d online players - %s", playerCount, playerNames())
+
+	return playerCount
+}
+
+// PlayerSampler reconciles the player registry with a status ping of ms
+// every playerSampleInterval (while ms is online and not suspended).
+//
+// [goroutine]
+func PlayerSampler() {
+	ticker := time.NewTicker(playerSampleInterval)
+	for {
+		<-ticker.C
+
+		if servstats.Stats.Status != errco.SERVER_STATUS_ONLINE || servstats.Stats.Suspended {
+			continue
 		}
 
-	} else if playerCount, logMsh = getPlayersByListCom(); logMsh.Log(true) == nil {
-		method = "list command"
-		if playerCount != servstats.Stats.ConnCount {
-			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_WRONG_CONNECTION_COUNT, "connection count (%d) different from %s player count (%d)", servstats.Stats.ConnCount, method, playerCount)
+		servInfo, logMsh := getServInfo()
+		if logMsh != nil {
+			logMsh.Log(true)
+			continue
 		}
+		servstats.Players.Sample(servInfo.Players.Online, servInfo.Players.Sample)
+	}
+}
 
-	} else {
-		method = "connection count"
-		playerCount = servstats.Stats.ConnCount
+// playerNames returns the names of the players in the player registry
+func playerNames() string {
+	names := []string{}
+	for _, p := range servstats.Players.List() {
+		names = append(names, p.Name)
 	}
 
-	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "%d online players - method for player count: %s", playerCount, method)
+	if len(names) == 0 {
+		return "no players registered"
+	}
 
-	return playerCount
+	return strings.Join(names, ", ")
 }
 
 // getPlayersByListCom returns the number of players using "list" command
 func getPlayersByListCom() (int, *errco.MshLog) {
-	output, logMsh := Execute("list")
+	res, logMsh := ExecuteCmd("list")
 	if logMsh != nil {
 		return -1, logMsh.AddTrace()
 	}
+	if res.Failed {
+		return -1, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_UNEXP_OUTPUT, "list command failed: %s", res.Out)
+	}
 
-	playerCount, logMsh := searchListCom(output)
+	playerCount, logMsh := searchListCom(res.Out)
 	if logMsh != nil {
 		return -1, logMsh.AddTrace()
 	}
@@ -69,10 +104,13 @@ func getPlayersByListCom() (int, *errco.MshLog) {
 	return playerCount, nil
 }
 
-// searchListCom analyzes the output of the list command to extract player count
+// searchListCom analyzes the output of the list command to extract player count.
+//
+// The output can be read from ms terminal (log lines) or received over rcon (command output only).
 func searchListCom(s string) (int, *errco.MshLog) {
-	// return if string has unexpected format
-	if !strings.Contains(s, "INFO]:") {
+	// return if terminal output has unexpected format
+	// (rcon output has no log header)
+	if strings.HasPrefix(s, "[") && !strings.Contains(s, "INFO]:") {
 		return -1, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_UNEXP_OUTPUT, "string does not contain \"INFO]:\"")
 	}
 
@@ -92,30 +130,60 @@ func searchListCom(s string) (int, *errco.MshLog) {
 	return players, nil
 }
 
-// getPlayersByServInfo returns the number of players using server info request
-func getPlayersByServInfo() (int, *errco.MshLog) {
-	servInfo, logMsh := getServInfo()
-	if logMsh != nil {
-		return -1, logMsh.AddTrace()
+// pingReadTimeout returns the status ping read timeout for the configured backend
+// (ms managed by the http backend runs on a remote machine)
+func pingReadTimeout() time.Duration {
+	if config.ConfigRuntime.Msh.Backend.Type == config.BACKEND_HTTP {
+		return pingRemoteTimeout
 	}
-
-	return servInfo.Players.Online, nil
+	return pingLocalTimeout
 }
 
 // getServInfo returns server info after emulating a server info request to the minecraft server
 func getServInfo() (*model.DataInfo, *errco.MshLog) {
-	var recInfoData []byte = []byte{}
-	var recInfo *model.DataInfo = &model.DataInfo{}
-	var buf []byte = make([]byte, 1024)
-
 	// check if ms is warm and interactable
 	logMsh := CheckMSWarm()
 	if logMsh != nil {
 		return nil, logMsh.AddTrace()
 	}
 
+	recInfo, logMsh := pingServInfo(pingReadTimeout())
+	if logMsh != nil {
+		return nil, logMsh.AddTrace()
+	}
+
+	// update server version and protocol in config
+	if recInfo.Version.Name != config.ConfigRuntime.Server.Version || recInfo.Version.Protocol != config.ConfigRuntime.Server.Protocol {
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "server version found! serverVersion: %s serverProtocol: %d", recInfo.Version.Name, recInfo.Version.Protocol)
+
+		// update runtime config if version is not specified
+		if config.ConfigRuntime.Server.Version == "" {
+			config.ConfigRuntime.Server.Version = recInfo.Version.Name
+			config.ConfigRuntime.Server.Protocol = recInfo.Version.Protocol
+		}
+
+		// update and save default config
+		config.ConfigDefault.Server.Version = recInfo.Version.Name
+		config.ConfigDefault.Server.Protocol = recInfo.Version.Protocol
+		logMsh := config.ConfigDefault.Save()
+		if logMsh != nil {
+			return nil, logMsh.AddTrace()
+		}
+	}
+
+	return recInfo, nil
+}
+
+// pingServInfo emulates a server info request to the minecraft server and returns server info.
+// readTimeout is the max wait between response chunks (pingLocalTimeout/pingRemoteTimeout).
+// (it doesn't check if ms is warm: it's also used to check if ms is listening)
+func pingServInfo(readTimeout time.Duration) (*model.DataInfo, *errco.MshLog) {
+	var recInfoData []byte = []byte{}
+	var recInfo *model.DataInfo = &model.DataInfo{}
+	var buf []byte = make([]byte, 1024)
+
 	// open connection to minecraft server
-	serverSocket, err := net.Dial("tcp", fmt.Sprintf("%s:%d", config.ServHost, config.ServPort))
+	serverSocket, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", config.ServHost, config.ServPort), 2*time.Second)
 	if err != nil {
 		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_SERVER_DIAL, err.Error())
 	}
@@ -134,10 +202,9 @@ func getServInfo() (*model.DataInfo, *errco.MshLog) {
 
 	// read response from server
 	for {
-		// timeout can be low since its a connection to 127.0.0.1
 		// the first time the ms info are requested it timeout is <100 mills
 		// (probably the ms function that handles ms info needs time to load the first time it's called)
-		serverSocket.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		serverSocket.SetReadDeadline(time.Now().Add(readTimeout))
 
 		dataLen, err := serverSocket.Read(buf)
 		if err != nil {
@@ -153,6 +220,11 @@ func getServInfo() (*model.DataInfo, *errco.MshLog) {
 		errco.NewLogln(errco.TYPE_BYT, errco.LVL_4, errco.ERROR_NIL, "%sserver --> msh%s: %v", errco.COLOR_PURPLE, errco.COLOR_RESET, buf[:dataLen])
 
 		recInfoData = append(recInfoData, buf[:dataLen]...)
+
+		// stop reading as soon as the whole response packet is received
+		if packetLen, n := binary.Uvarint(recInfoData); n > 0 && uint64(len(recInfoData)-n) >= packetLen {
+			break
+		}
 	}
 
 	// remove first 5 bytes that are used as header to get only the json data
@@ -168,24 +240,5 @@ func getServInfo() (*model.DataInfo, *errco.MshLog) {
 		return nil, errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_JSON_UNMARSHAL, err.Error())
 	}
 
-	// update server version and protocol in config
-	if recInfo.Version.Name != config.ConfigRuntime.Server.Version || recInfo.Version.Protocol != config.ConfigRuntime.Server.Protocol {
-		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "server version found! serverVersion: %s serverProtocol: %d", recInfo.Version.Name, recInfo.Version.Protocol)
-
-		// update runtime config if version is not specified
-		if config.ConfigRuntime.Server.Version == "" {
-			config.ConfigRuntime.Server.Version = recInfo.Version.Name
-			config.ConfigRuntime.Server.Protocol = recInfo.Version.Protocol
-		}
-
-		// update and save default config
-		config.ConfigDefault.Server.Version = recInfo.Version.Name
-		config.ConfigDefault.Server.Protocol = recInfo.Version.Protocol
-		logMsh := config.ConfigDefault.Save()
-		if logMsh != nil {
-			return nil, logMsh.AddTrace()
-		}
-	}
-
 	return recInfo, nil
 }
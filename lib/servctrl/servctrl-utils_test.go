@@ -46,6 +46,18 @@ func Test_searchListCom(t *testing.T) {
 			false,
 		},
 
+		// positive cases [rcon]
+		{
+			"There are 3 of a max of 20 players online: alice, bob, carl",
+			3,
+			false,
+		},
+		{
+			"Es sind 0 von maximal 15 Spielern online.", // [EssentialsX]
+			0,
+			false,
+		},
+
 		// negative cases [plugins]
 		{
 			"[12:34:56 INFO]: [Essentials] CONSOLE issued server command: /list", // [EssentialsX]
@@ -64,6 +76,13 @@ func Test_searchListCom(t *testing.T) {
 			-1,
 			true,
 		},
+
+		// negative cases [rcon]
+		{
+			"Unknown or incomplete command, see below for error",
+			-1,
+			true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,255 @@
+package servctrl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/hook"
+	"msh/lib/opsys"
+	"msh/lib/servstats"
+)
+
+const (
+	watchdogTick      time.Duration = 1 * time.Second  // time interval between watchdog checks
+	watchdogKillWait  time.Duration = 30 * time.Second // max time to wait for ms to go offline after kill
+	threadDumpTimeout time.Duration = 30 * time.Second // max time for jcmd to print the thread dump
+	threadDumpWait    time.Duration = 3 * time.Second  // time during which ms output is collected after the quit signal
+)
+
+// Watchdog checks that ms does not hang:
+//
+// - while starting, ms must go online in StartupTimeout seconds.
+//
+// - while online (and not suspended), ms must answer liveness probes every PingInterval seconds
+// (FailThreshold consecutive failed probes are needed to consider ms hung).
+//
+// When ms hangs, the watchdog escalates: thread dump, stop, kill and restart (see watchdogEscalate).
+// The watchdog escalates at most once for each ms start (ms might not be killable by the backend).
+//
+// [goroutine]
+func Watchdog() {
+	wd := config.ConfigRuntime.Msh.Watchdog
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "watchdog is starting")
+
+	fails := 0
+	lastProbe := time.Time{}
+	escalated := time.Time{} // start time of ms when the watchdog last escalated
+
+	ticker := time.NewTicker(watchdogTick)
+	for {
+		<-ticker.C
+
+		switch servstats.Stats.Status {
+
+		case errco.SERVER_STATUS_STARTING:
+			fails = 0
+
+			if wd.StartupTimeout <= 0 || TermUpTime() < wd.StartupTimeout || escalated.Equal(ServTerm.startTime) {
+				continue
+			}
+
+			escalated = ServTerm.startTime
+			watchdogEscalate(fmt.Sprintf("not online after %ds", wd.StartupTimeout))
+
+		case errco.SERVER_STATUS_ONLINE:
+			// suspended ms can't answer liveness probes
+			if servstats.Stats.Suspended {
+				fails = 0
+				continue
+			}
+
+			if time.Since(lastProbe) < time.Duration(wd.PingInterval)*time.Second {
+				continue
+			}
+			lastProbe = time.Now()
+
+			logMsh := probeLiveness()
+			if logMsh == nil {
+				if fails > 0 {
+					watchdogStep("minecraft server answered liveness probe")
+				}
+				fails = 0
+				continue
+			}
+
+			fails++
+			logMsh.Log(true)
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_WATCHDOG, "watchdog: liveness probe failed (%d/%d)", fails, wd.FailThreshold)
+			servstats.Stats.Watchdog = fmt.Sprintf("%d/%d liveness probes failed", fails, wd.FailThreshold)
+
+			if fails < wd.FailThreshold {
+				continue
+			}
+			fails = 0
+
+			if escalated.Equal(ServTerm.startTime) {
+				watchdogStep("minecraft server still hung (already escalated)")
+				continue
+			}
+
+			escalated = ServTerm.startTime
+			watchdogEscalate(fmt.Sprintf("%d liveness probes failed", wd.FailThreshold))
+
+		default:
+			fails = 0
+		}
+	}
+}
+
+// probeLiveness checks that ms answers a status ping and, if rcon is enabled, a command over rcon
+// (status pings might be answered by ms network threads while ms main thread is deadlocked).
+func probeLiveness() *errco.MshLog {
+	_, logMsh := pingServInfo(pingReadTimeout())
+	if logMsh != nil {
+		return logMsh.AddTrace()
+	}
+
+	if addr, password, ok := rconConfig(); ok {
+		_, _, logMsh = rcon.exec(addr, password, "list")
+		if logMsh != nil {
+			return logMsh.AddTrace()
+		}
+	}
+
+	return nil
+}
+
+// watchdogEscalate handles a hung ms:
+// captures a thread dump of ms (if enabled), stops ms, kills ms if it doesn't stop in KillAfter seconds
+// and starts ms again (if enabled).
+func watchdogEscalate(reason string) {
+	wd := config.ConfigRuntime.Msh.Watchdog
+
+	logMsh := errco.NewLogln(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_WATCHDOG, "MINECRAFT SERVER IS HUNG! (%s)", reason)
+	hook.MajorError(logMsh)
+	watchdogStep("minecraft server hung (%s)", reason)
+
+	// capture thread dump before stopping ms
+	if wd.ThreadDump {
+		watchdogStep("capturing thread dump")
+		path, logMsh := threadDump()
+		if logMsh != nil {
+			logMsh.Log(true)
+			watchdogStep("thread dump not captured")
+		} else {
+			watchdogStep("thread dump saved to %s", path)
+		}
+	}
+
+	// stop ms (stop command can be executed only if ms is online)
+	stopped := false
+	if servstats.Stats.Status == errco.SERVER_STATUS_ONLINE {
+		watchdogStep("stopping minecraft server")
+		logMsh := stopMS()
+		if logMsh != nil {
+			logMsh.Log(true)
+		} else {
+			stopped = waitOffline(time.Duration(wd.KillAfter) * time.Second)
+		}
+	}
+
+	// kill ms
+	if !stopped {
+		watchdogStep("killing minecraft server")
+		logMsh := getBackend().kill()
+		if logMsh != nil {
+			logMsh.Log(true)
+		}
+		if !waitOffline(watchdogKillWait) {
+			watchdogStep("minecraft server still running after kill")
+			return
+		}
+	}
+
+	watchdogStep("minecraft server stopped")
+
+	// ms can be warmed again
+	if servstats.Stats.MajorError != nil && servstats.Stats.MajorError.Cod == errco.ERROR_SERVER_UNRESPONDING {
+		servstats.Stats.MajorError = nil
+	}
+
+	if !wd.Restart {
+		return
+	}
+
+	watchdogStep("restarting minecraft server")
+	logMsh = WarmMS()
+	if logMsh != nil {
+		logMsh.Log(true)
+		watchdogStep("minecraft server restart failed")
+	}
+}
+
+// watchdogStep logs a watchdog step and shows it in msh status
+func watchdogStep(format string, a ...interface{}) {
+	step := fmt.Sprintf(format, a...)
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "watchdog: %s", step)
+	servstats.Stats.Watchdog = fmt.Sprintf("%s (%s)", step, time.Now().Format("15:04:05"))
+}
+
+// threadDump captures a jvm thread dump of ms and saves it to a file in ms folder.
+//
+// jcmd is used if available, otherwise a quit signal is sent to ms jvm
+// (the thread dump is printed by ms jvm and collected from ms terminal).
+//
+// Only ms started by msh (terminal backend) is supported.
+func threadDump() (string, *errco.MshLog) {
+	if _, ok := getBackend().(*servTerminal); !ok || ServTerm.cmd == nil || ServTerm.cmd.Process == nil {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_THREAD_DUMP, "thread dump is supported only for minecraft server started by msh")
+	}
+
+	pid, logMsh := opsys.ProcTreeJavaPid(uint32(ServTerm.cmd.Process.Pid))
+	if logMsh != nil {
+		return "", logMsh.AddTrace()
+	}
+
+	dump := ""
+
+	if jcmd, err := exec.LookPath("jcmd"); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), threadDumpTimeout)
+		defer cancel()
+
+		out, err := exec.CommandContext(ctx, jcmd, strconv.Itoa(int(pid)), "Thread.print").CombinedOutput()
+		if err != nil {
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_THREAD_DUMP, "jcmd: %s (sending quit signal)", err.Error())
+		} else {
+			dump = string(out)
+		}
+	}
+
+	if dump == "" {
+		seq := termOut.seq()
+
+		logMsh = opsys.ProcQuit(pid)
+		if logMsh != nil {
+			return "", logMsh.AddTrace()
+		}
+
+		time.Sleep(threadDumpWait)
+
+		lines, _, _ := termOut.since(seq)
+		if len(lines) == 0 {
+			return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_THREAD_DUMP, "no thread dump printed by minecraft server")
+		}
+		dump = strings.Join(lines, "\n") + "\n"
+	}
+
+	path := filepath.Join(config.ConfigRuntime.Server.Folder, "msh-threaddump-"+time.Now().Format("2006-01-02_15.04.05")+".txt")
+
+	err := os.WriteFile(path, []byte(dump), 0o644)
+	if err != nil {
+		return "", errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_THREAD_DUMP, err.Error())
+	}
+
+	return path, nil
+}
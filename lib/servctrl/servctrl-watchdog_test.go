@@ -0,0 +1,141 @@
+package servctrl
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/servstats"
+)
+
+func Test_threadDump(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("quit signal not available")
+	}
+	if _, err := exec.LookPath("jcmd"); err == nil {
+		t.Skip("jcmd available: quit signal fallback not used")
+	}
+
+	dir := t.TempDir()
+	config.ConfigRuntime.Server.Folder = dir
+	defer func() { config.ConfigRuntime.Server.Folder = "" }()
+
+	// fake jvm that prints a thread dump when it receives the quit signal
+	script := "#!/bin/sh\ntrap 'echo \"Full thread dump OpenJDK 64-Bit Server VM\"; echo \"\\\"Server thread\\\" #30 prio=5 BLOCKED\"' QUIT\nwhile true; do sleep 0.1; done\n"
+	err := os.WriteFile(filepath.Join(dir, "java"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(filepath.Join(dir, "java"))
+	outPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		ServTerm.cmd = nil
+	}()
+	ServTerm.cmd = cmd
+
+	// ms terminal output is added to output ring buffer
+	go func(r io.Reader) {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			termOut.add(scanner.Text())
+		}
+	}(outPipe)
+
+	path, logMsh := threadDump()
+	if logMsh != nil {
+		t.Fatalf("unexpected error %q", logMsh.Mex)
+	}
+	if filepath.Dir(path) != dir || !strings.HasPrefix(filepath.Base(path), "msh-threaddump-") {
+		t.Errorf("unexpected thread dump file %s", path)
+	}
+
+	dump, _ := os.ReadFile(path)
+	if !strings.Contains(string(dump), "Full thread dump") || !strings.Contains(string(dump), "\"Server thread\" #30 prio=5 BLOCKED") {
+		t.Errorf("unexpected thread dump %q", dump)
+	}
+}
+
+func Test_watchdogEscalate(t *testing.T) {
+	d, calls := newDockerStandIn(t)
+
+	// docker backend client is connected to the stand-in socket of this test
+	dkBackend.m.Lock()
+	dkBackend.client = nil
+	dkBackend.m.Unlock()
+
+	config.ConfigRuntime.Msh.Backend.Type = config.BACKEND_DOCKER
+	config.ConfigRuntime.Msh.Watchdog.KillAfter = 1
+	config.ConfigRuntime.Msh.Watchdog.Restart = true
+	config.ConfigRuntime.Msh.TimeBeforeStoppingEmptyServer = 3600
+	defer func() {
+		servstats.Stats.FreezeTimer.Stop()
+		servstats.Stats.Status, servstats.Stats.MajorError, servstats.Stats.Watchdog = errco.SERVER_STATUS_OFFLINE, nil, ""
+		ServTerm.IsActive = false
+		dkBackend.m.Lock()
+		dkBackend.startedMsh, dkBackend.client = false, nil
+		dkBackend.m.Unlock()
+		config.ConfigRuntime.Msh.Backend.Type = ""
+		config.ConfigRuntime.Msh.Watchdog.KillAfter, config.ConfigRuntime.Msh.Watchdog.Restart = 0, false
+		config.ConfigRuntime.Msh.TimeBeforeStoppingEmptyServer = 0
+	}()
+
+	// hung ms doesn't stop: it goes offline only when its container is killed
+	ServTerm.IsActive, ServTerm.startTime = true, time.Now()
+	servstats.Stats.Status = errco.SERVER_STATUS_ONLINE
+
+	killed := make(chan struct{})
+	go func() {
+		defer close(killed)
+		for i := 0; i < 1000; i++ {
+			if state, err := d.inspect(); err == nil && !state.State.Running {
+				servstats.Stats.M.Lock()
+				setOffline()
+				servstats.Stats.M.Unlock()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// stop -> kill -> restart
+	watchdogEscalate("test")
+	<-killed
+
+	// wait for the log stream of the restarted container to end
+	for following := true; following; time.Sleep(10 * time.Millisecond) {
+		dkBackend.m.Lock()
+		following = dkBackend.following
+		dkBackend.m.Unlock()
+	}
+
+	steps := []string{}
+	for _, call := range *calls {
+		switch call {
+		case "POST /containers/mc/stop", "POST /containers/mc/kill", "POST /containers/mc/start":
+			steps = append(steps, call)
+		}
+	}
+	if strings.Join(steps, ", ") != "POST /containers/mc/stop, POST /containers/mc/kill, POST /containers/mc/start" {
+		t.Errorf("unexpected escalation steps %v", steps)
+	}
+	if !ServTerm.IsActive || servstats.Stats.MajorError != nil {
+		t.Errorf("minecraft server not restarted (status %d, major error %v)", servstats.Stats.Status, servstats.Stats.MajorError)
+	}
+}
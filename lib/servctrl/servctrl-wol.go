@@ -0,0 +1,180 @@
+package servctrl
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"msh/lib/config"
+	"msh/lib/errco"
+	"msh/lib/opsys"
+	"msh/lib/servstats"
+)
+
+const (
+	wolResend time.Duration = 10 * time.Second // time interval between magic packets while waiting for the machine to wake
+	wolPoll   time.Duration = 1 * time.Second  // time interval between checks of the machine wait port
+)
+
+// wakeStartMS wakes the machine hosting ms (wake-on-lan) and then starts ms.
+//
+// While the machine is waking Stats.Waking is true (ms status is offline).
+//
+// [non-blocking]
+func wakeStartMS() {
+	servstats.Stats.M.Lock()
+	if servstats.Stats.Waking {
+		// machine is already waking
+		servstats.Stats.M.Unlock()
+		return
+	}
+	servstats.Stats.Waking = true
+	servstats.Stats.M.Unlock()
+
+	// [goroutine]
+	go func() {
+		// waking phase ends when ms is starting
+		defer func() {
+			servstats.Stats.M.Lock()
+			servstats.Stats.Waking = false
+			servstats.Stats.M.Unlock()
+		}()
+
+		logMsh := wakeMachine()
+		if logMsh != nil {
+			logMsh.Log(true)
+			return
+		}
+
+		logMsh = startMS()
+		if logMsh != nil {
+			if logMsh.Cod != errco.ERROR_HOOK_ABORT && logMsh.Cod != errco.ERROR_SERVER_STARTING {
+				servstats.Stats.SetMajorError(errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_MINECRAFT_SERVER, "error starting minecraft server (check logs)"))
+			}
+			logMsh.Log(true)
+		}
+	}()
+}
+
+// wakeMachine sends wake-on-lan magic packets to the machine hosting ms
+// and waits for it to answer on the wait port (at most WakeOnLan.Timeout seconds)
+func wakeMachine() *errco.MshLog {
+	waitAddr := wolWaitAddr()
+
+	// machine is already awake
+	if machineAwake(waitAddr) {
+		return nil
+	}
+
+	packet, err := magicPacket(config.ConfigRuntime.Msh.WakeOnLan.MAC, config.ConfigRuntime.Msh.WakeOnLan.Password)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_WAKE_ON_LAN, "magic packet: %s", err.Error())
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "WAKING MACHINE %s...", config.ConfigRuntime.Msh.WakeOnLan.MAC)
+
+	timeout := time.Duration(config.ConfigRuntime.Msh.WakeOnLan.Timeout) * time.Second
+	start := time.Now()
+	lastSent := time.Time{}
+
+	for time.Since(start) < timeout {
+		// magic packets are sent over udp: resend them in case they are lost
+		if time.Since(lastSent) >= wolResend {
+			logMsh := sendMagicPacket(packet)
+			if logMsh != nil {
+				return logMsh.AddTrace()
+			}
+			lastSent = time.Now()
+		}
+
+		if machineAwake(waitAddr) {
+			errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "MACHINE IS AWAKE! (wake time: %s)", time.Since(start).Round(time.Second))
+			return nil
+		}
+
+		time.Sleep(wolPoll)
+	}
+
+	return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_WAKE_ON_LAN, "machine did not answer on %s in %s", waitAddr, timeout)
+}
+
+// wolWaitAddr returns the address on which the machine answers when awake.
+//
+// If WakeOnLan.WaitPort is not set, the agent address is used for the agent backend
+// (ms is started by msh agent), ms address otherwise.
+func wolWaitAddr() string {
+	host, port := config.ServHost, strconv.Itoa(config.ServPort)
+
+	if config.ConfigRuntime.Msh.Backend.Type == config.BACKEND_AGENT {
+		if h, p, err := net.SplitHostPort(config.ConfigRuntime.Msh.Backend.AgentAddress); err == nil {
+			host, port = h, p
+		}
+	}
+
+	if config.ConfigRuntime.Msh.WakeOnLan.WaitPort != 0 {
+		port = strconv.Itoa(config.ConfigRuntime.Msh.WakeOnLan.WaitPort)
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// machineAwake returns true if the machine answers tcp connections on addr.
+// A refused connection means that the machine is awake (the port is closed).
+func machineAwake(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, wolPoll)
+	if err != nil {
+		return opsys.ConnRefused(err)
+	}
+	conn.Close()
+
+	return true
+}
+
+// sendMagicPacket sends a magic packet to the wake-on-lan broadcast address
+func sendMagicPacket(packet []byte) *errco.MshLog {
+	addr := net.JoinHostPort(config.ConfigRuntime.Msh.WakeOnLan.Broadcast, strconv.Itoa(config.ConfigRuntime.Msh.WakeOnLan.Port))
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_WAKE_ON_LAN, "magic packet dial %s: %s", addr, err.Error())
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(packet)
+	if err != nil {
+		return errco.NewLog(errco.TYPE_ERR, errco.LVL_1, errco.ERROR_WAKE_ON_LAN, "magic packet send %s: %s", addr, err.Error())
+	}
+
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "magic packet sent to %s", addr)
+
+	return nil
+}
+
+// magicPacket returns the wake-on-lan magic packet for the specified mac address:
+// 6 bytes 0xff followed by 16 repetitions of the mac address (and the SecureOn password, if not "").
+//
+// The SecureOn password is 6 bytes written as a mac address (example: "01:23:45:67:89:ab").
+func magicPacket(mac, password string) ([]byte, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if len(hw) != 6 {
+		return nil, fmt.Errorf("invalid mac address length: %s", mac)
+	}
+
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	packet = append(packet, bytes.Repeat(hw, 16)...)
+
+	if password != "" {
+		pw, err := net.ParseMAC(password)
+		if err != nil || len(pw) != 6 {
+			return nil, fmt.Errorf("invalid SecureOn password (expected 6 bytes, example: 01:23:45:67:89:ab)")
+		}
+		packet = append(packet, pw...)
+	}
+
+	return packet, nil
+}
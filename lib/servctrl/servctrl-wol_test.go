@@ -0,0 +1,158 @@
+package servctrl
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"msh/lib/config"
+)
+
+func Test_magicPacket(t *testing.T) {
+	packet, err := magicPacket("00:1a:2b:3c:4d:5e", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) != 102 {
+		t.Fatalf("magic packet length %d, expected 102", len(packet))
+	}
+	if !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+		t.Errorf("magic packet header %x", packet[:6])
+	}
+	for i := 0; i < 16; i++ {
+		if mac := packet[6+i*6 : 12+i*6]; !bytes.Equal(mac, []byte{0x00, 0x1a, 0x2b, 0x3c, 0x4d, 0x5e}) {
+			t.Errorf("magic packet repetition %d: %x", i, mac)
+		}
+	}
+
+	// SecureOn password is appended
+	packet, err = magicPacket("00-1a-2b-3c-4d-5e", "01:23:45:67:89:ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) != 108 || !bytes.Equal(packet[102:], []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab}) {
+		t.Errorf("magic packet with password: %x", packet)
+	}
+
+	for _, c := range []struct{ mac, password string }{
+		{"not a mac", ""},
+		{"00:1a:2b:3c:4d:5e", "secret"},
+		{"00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01", ""},
+	} {
+		if _, err := magicPacket(c.mac, c.password); err == nil {
+			t.Errorf("magicPacket(%q, %q): expected error", c.mac, c.password)
+		}
+	}
+}
+
+func Test_wakeMachine(t *testing.T) {
+	// stand-in network interface of the sleeping machine
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	// magic packets received by the machine
+	received := make(chan int, 16)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- n
+		}
+	}()
+
+	config.ConfigRuntime.Msh.WakeOnLan.MAC = "00:1a:2b:3c:4d:5e"
+	config.ConfigRuntime.Msh.WakeOnLan.Password = ""
+	config.ConfigRuntime.Msh.WakeOnLan.Broadcast = "127.0.0.1"
+	config.ConfigRuntime.Msh.WakeOnLan.Port = udp.LocalAddr().(*net.UDPAddr).Port
+	config.ConfigRuntime.Msh.WakeOnLan.WaitPort = 25565
+	config.ConfigRuntime.Msh.WakeOnLan.Timeout = 1
+	host := config.ServHost
+	defer func() { config.ServHost = host }()
+
+	// machine awake (wait port closed): no magic packet is sent
+	config.ServHost = "127.0.0.1"
+	if logMsh := wakeMachine(); logMsh != nil {
+		t.Errorf("machine awake: %v", logMsh)
+	}
+	select {
+	case n := <-received:
+		t.Errorf("machine awake: magic packet sent (%d bytes)", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// machine does not answer (discard-only address): magic packet is sent, machine does not wake
+	config.ServHost = "100::1"
+	if logMsh := wakeMachine(); logMsh == nil {
+		t.Error("machine sleeping: expected error for machine not answering")
+	}
+	select {
+	case n := <-received:
+		if n != 102 {
+			t.Errorf("machine sleeping: magic packet length %d, expected 102", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("machine sleeping: magic packet not sent")
+	}
+}
+
+func Test_machineAwake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	// open port
+	if !machineAwake(addr) {
+		t.Errorf("open port %s: machine not awake", addr)
+	}
+
+	// closed port: the machine refuses the connection
+	l.Close()
+	if !machineAwake(addr) {
+		t.Errorf("closed port %s: machine not awake", addr)
+	}
+
+	// no answer (discard-only address)
+	if machineAwake("[100::1]:22") {
+		t.Error("address not answering: machine awake")
+	}
+}
+
+func Test_wolWaitAddr(t *testing.T) {
+	defer func() {
+		config.ConfigRuntime.Msh.Backend.Type = ""
+		config.ConfigRuntime.Msh.Backend.AgentAddress = ""
+		config.ConfigRuntime.Msh.WakeOnLan.WaitPort = 0
+	}()
+
+	host, port := config.ServHost, config.ServPort
+	defer func() { config.ServHost, config.ServPort = host, port }()
+
+	config.ServHost, config.ServPort = "192.168.1.10", 25565
+	config.ConfigRuntime.Msh.Backend.AgentAddress = "192.168.1.20:25580"
+
+	for _, test := range []struct {
+		backend  string
+		waitPort int
+		exp      string
+	}{
+		{config.BACKEND_EXTERNAL, 0, "192.168.1.10:25565"},
+		{config.BACKEND_EXTERNAL, 22, "192.168.1.10:22"},
+		{config.BACKEND_AGENT, 0, "192.168.1.20:25580"},
+		{config.BACKEND_AGENT, 22, "192.168.1.20:22"},
+	} {
+		config.ConfigRuntime.Msh.Backend.Type = test.backend
+		config.ConfigRuntime.Msh.WakeOnLan.WaitPort = test.waitPort
+		if addr := wolWaitAddr(); addr != test.exp {
+			t.Errorf("%s backend, wait port %d: received %s, expected %s", test.backend, test.waitPort, addr, test.exp)
+		}
+	}
+}
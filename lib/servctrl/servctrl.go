@@ -5,12 +5,14 @@ import (
 
 	"msh/lib/config"
 	"msh/lib/errco"
-	"msh/lib/opsys"
 	"msh/lib/servstats"
 )
 
-// WarmMS warms the minecraft server
-// [non-blocking]
+// WarmMS warms the minecraft server.
+//
+// It blocks while the pre-start hook runs (ms is started after it),
+// unless the machine hosting ms must be woken first (wake-on-lan).
+// If a start is already in progress, it returns ERROR_SERVER_STARTING.
 func WarmMS() *errco.MshLog {
 	var logMsh *errco.MshLog
 
@@ -31,15 +33,25 @@ func WarmMS() *errco.MshLog {
 			servstats.Stats.Suspended = false // if ms is offline it's process can't be suspended
 		}
 
-		logMsh = termStart()
+		// wake the machine hosting ms before starting ms
+		if config.ConfigRuntime.Msh.WakeOnLan.Enabled {
+			wakeStartMS()
+			break
+		}
+
+		logMsh = startMS()
 		if logMsh != nil {
-			servstats.Stats.SetMajorError(errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_MINECRAFT_SERVER, "error starting minecraft server (check logs)"))
+			// ms start aborted by pre-start hook is not a major error (ms can be warmed again),
+			// neither is a start already in progress
+			if logMsh.Cod != errco.ERROR_HOOK_ABORT && logMsh.Cod != errco.ERROR_SERVER_STARTING {
+				servstats.Stats.SetMajorError(errco.NewLog(errco.TYPE_ERR, errco.LVL_3, errco.ERROR_MINECRAFT_SERVER, "error starting minecraft server (check logs)"))
+			}
 			return logMsh.AddTrace()
 		}
 
 	default:
-		if config.ConfigRuntime.Msh.SuspendAllow {
-			servstats.Stats.Suspended, logMsh = opsys.ProcTreeResume(uint32(ServTerm.cmd.Process.Pid))
+		if suspendAllowed() {
+			logMsh = resumeMS()
 			if logMsh != nil {
 				return logMsh.AddTrace()
 			}
@@ -75,8 +87,8 @@ func FreezeMS(force bool) *errco.MshLog {
 
 		// resume ms process (un/suspended)
 		// to be sure that ms process is running to allow ms start
-		if config.ConfigRuntime.Msh.SuspendAllow {
-			servstats.Stats.Suspended, logMsh = opsys.ProcTreeResume(uint32(ServTerm.cmd.Process.Pid))
+		if suspendAllowed() {
+			logMsh = resumeMS()
 			if logMsh != nil {
 				return logMsh.AddTrace()
 			}
@@ -127,8 +139,8 @@ func FreezeMS(force bool) *errco.MshLog {
 		}
 
 		// suspend/stop ms
-		if config.ConfigRuntime.Msh.SuspendAllow {
-			servstats.Stats.Suspended, logMsh = opsys.ProcTreeSuspend(uint32(ServTerm.cmd.Process.Pid))
+		if suspendAllowed() {
+			logMsh = suspendMS()
 			if logMsh != nil {
 				return logMsh.AddTrace()
 			}
@@ -146,8 +158,8 @@ func FreezeMS(force bool) *errco.MshLog {
 		// is ms is stopping, resume the process and let it stop
 
 		// resume ms process (un/suspended)
-		if config.ConfigRuntime.Msh.SuspendAllow {
-			servstats.Stats.Suspended, logMsh = opsys.ProcTreeResume(uint32(ServTerm.cmd.Process.Pid))
+		if suspendAllowed() {
+			logMsh = resumeMS()
 			if logMsh != nil {
 				return logMsh.AddTrace()
 			}
@@ -182,6 +194,11 @@ func FreezeMS(force bool) *errco.MshLog {
 
 // FreezeMSSchedule stops freeze timer and schedules a soft freeze of ms
 func FreezeMSSchedule() {
+	// agent mode: ms hibernation is managed by msh front
+	if config.ConfigRuntime.Msh.Agent.Enabled {
+		return
+	}
+
 	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "scheduling ms soft freeze in %d seconds", config.ConfigRuntime.Msh.TimeBeforeStoppingEmptyServer)
 
 	// stop freeze timer so that it can be reset
@@ -205,22 +222,22 @@ func FreezeMSSchedule() {
 	)
 }
 
-// resumeStopMS resumes ms process and executes a stop command in ms terminal.
+// resumeStopMS resumes ms process and stops ms (stop command in ms terminal or backend stop command).
 //
 // Should be called only when servstats.Stats.Status == ONLINE
 func resumeStopMS() *errco.MshLog {
 	var logMsh *errco.MshLog
 
 	// resume ms process (un/suspended)
-	if config.ConfigRuntime.Msh.SuspendAllow {
-		servstats.Stats.Suspended, logMsh = opsys.ProcTreeResume(uint32(ServTerm.cmd.Process.Pid))
+	if suspendAllowed() {
+		logMsh = resumeMS()
 		if logMsh != nil {
 			return logMsh.AddTrace()
 		}
 	}
 
 	// execute stop command
-	_, logMsh = Execute(config.ConfigRuntime.Commands.StopServer)
+	logMsh = stopMS()
 	if logMsh != nil {
 		return logMsh.AddTrace()
 	}
@@ -247,8 +264,8 @@ func killMSifOnlineAfterTimeout() {
 
 	// resume ms process (un/suspended)
 	// to be sure that ms is running to stop itself
-	if config.ConfigRuntime.Msh.SuspendAllow {
-		servstats.Stats.Suspended, logMsh = opsys.ProcTreeResume(uint32(ServTerm.cmd.Process.Pid))
+	if suspendAllowed() {
+		logMsh = resumeMS()
 		if logMsh != nil {
 			logMsh.Log(true)
 		}
@@ -273,7 +290,7 @@ func killMSifOnlineAfterTimeout() {
 
 	// send kill signal to server
 	errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_SERVER_KILL, "minecraft server process won't stop normally: sending kill signal")
-	LogMsh := opsys.ProcTreeKill(uint32(ServTerm.cmd.Process.Pid))
+	LogMsh := getBackend().kill()
 	if LogMsh != nil {
 		LogMsh.Log(true)
 	}
@@ -0,0 +1,240 @@
+package servstats
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"msh/lib/errco"
+	"msh/lib/model"
+)
+
+// player registry sources (in order of precedence)
+const (
+	PLAYER_SRC_LOG    string = "log"    // join/leave line in ms log: the player is in game
+	PLAYER_SRC_PROXY  string = "proxy"  // login start packet of a connection proxied by msh: the player is logging in
+	PLAYER_SRC_STATUS string = "status" // status ping sample: the player was online when ms was sampled
+)
+
+// sampleGrace is the time during which a player that joined is not removed
+// if it's missing from a status ping sample (sample might be older than the join)
+const sampleGrace time.Duration = 10 * time.Second
+
+// Players is the registry of players online on ms
+var Players *playerRegistry = &playerRegistry{
+	m:       &sync.Mutex{},
+	players: map[string]*Player{},
+}
+
+type playerRegistry struct {
+	m          *sync.Mutex
+	players    map[string]*Player // online players (key: lowercase player name)
+	hidden     int                // online players hidden in the last status ping (not registered)
+	sampleTime time.Time          // time of the last status ping
+}
+
+// OnPlayerConfirmed, if not nil, is called when ms log confirms that a player
+// logging in through the msh proxy is in game (address is the player client address)
+var OnPlayerConfirmed func(address string)
+
+// Player is a player online on ms
+type Player struct {
+	Name     string    // player name
+	UUID     string    // player uuid ("" if unknown)
+	JoinTime time.Time // time at which the player joined
+	Address  string    // address of the player client ("" if not proxied by msh)
+	Source   string    // most reliable source that reported the player
+	conn     string    // msh proxy connection that registered the player ("" if none)
+}
+
+// Join registers a player that joined ms.
+// uuid and address can be "".
+func (r *playerRegistry) Join(name, uuid, address, source string) {
+	r.m.Lock()
+
+	// a player logging in through the msh proxy is confirmed by ms log
+	confirmed := ""
+	if p, ok := r.players[strings.ToLower(name)]; ok && p.Source == PLAYER_SRC_PROXY && source == PLAYER_SRC_LOG {
+		confirmed = p.Address
+	}
+
+	r.join(name, uuid, address, source)
+
+	r.m.Unlock()
+
+	if confirmed != "" && OnPlayerConfirmed != nil {
+		OnPlayerConfirmed(confirmed)
+	}
+}
+
+// JoinConn registers a player that is logging in through the msh proxy connection conn.
+// uuid and address can be "".
+func (r *playerRegistry) JoinConn(name, uuid, address, conn string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if p := r.join(name, uuid, address, PLAYER_SRC_PROXY); p != nil {
+		p.conn = conn
+	}
+}
+
+// join registers a player and returns it (nil if name is "")
+func (r *playerRegistry) join(name, uuid, address, source string) *Player {
+	if name == "" {
+		return nil
+	}
+
+	p, ok := r.players[strings.ToLower(name)]
+	if !ok {
+		p = &Player{Name: name, JoinTime: time.Now(), Source: source}
+		r.players[strings.ToLower(name)] = p
+		errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "player registry: %s joined (source: %s)", name, source)
+	}
+
+	// ms log confirms that the player is in game
+	if precedence(source) < precedence(p.Source) {
+		p.Source = source
+	}
+	if address != "" {
+		p.Address = address
+	}
+	// uuid reported by ms (status) overrides the one sent by the client (proxy)
+	if uuid != "" && (p.UUID == "" || source == PLAYER_SRC_STATUS) {
+		p.UUID = uuid
+	}
+
+	return p
+}
+
+// Leave unregisters a player that left ms
+func (r *playerRegistry) Leave(name, source string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if _, ok := r.players[strings.ToLower(name)]; !ok {
+		return
+	}
+
+	delete(r.players, strings.ToLower(name))
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "player registry: %s left (source: %s)", name, source)
+}
+
+// LeaveConn unregisters a player whose msh proxy connection conn was closed.
+//
+// The player is kept if ms log confirmed it (ms log reports the leave)
+// or if it was registered again by a newer connection (player reconnected).
+func (r *playerRegistry) LeaveConn(name, conn string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	p, ok := r.players[strings.ToLower(name)]
+	if !ok || p.Source != PLAYER_SRC_PROXY || p.conn != conn {
+		return
+	}
+
+	delete(r.players, strings.ToLower(name))
+	errco.NewLogln(errco.TYPE_INF, errco.LVL_3, errco.ERROR_NIL, "player registry: %s left (source: %s)", name, PLAYER_SRC_PROXY)
+}
+
+// Sample reconciles the registry with a status ping of ms.
+//
+// online is the number of online players reported by ms,
+// sample contains the players reported by ms (it can be partial, nil if not available).
+//
+// If the sample is complete (or no player is online), registered players missing from it are removed.
+// Players in the sample are registered.
+func (r *playerRegistry) Sample(online int, sample []model.PlayerSample) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.sampleTime = time.Now()
+
+	// players hidden by ms have empty names or the null uuid
+	known := map[string]model.PlayerSample{}
+	for _, s := range sample {
+		if s.Name == "" || s.ID == "00000000-0000-0000-0000-000000000000" {
+			continue
+		}
+		known[strings.ToLower(s.Name)] = s
+	}
+
+	// remove players not online (only if ms reported all online players)
+	if len(known) == online {
+		for key, p := range r.players {
+			if _, ok := known[key]; ok || time.Since(p.JoinTime) < sampleGrace {
+				continue
+			}
+			delete(r.players, key)
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_WRONG_CONNECTION_COUNT, "player registry: %s (source: %s) not online according to status ping: removed", p.Name, p.Source)
+		}
+	}
+
+	for key, s := range known {
+		p, ok := r.players[key]
+		if !ok {
+			// player joined without msh proxy and without ms log (or before msh started)
+			r.players[key] = &Player{Name: s.Name, UUID: s.ID, JoinTime: time.Now(), Source: PLAYER_SRC_STATUS}
+			errco.NewLogln(errco.TYPE_WAR, errco.LVL_1, errco.ERROR_WRONG_CONNECTION_COUNT, "player registry: %s online according to status ping: added", s.Name)
+			continue
+		}
+		p.UUID = s.ID
+	}
+
+	r.hidden = 0
+	if len(r.players) != online {
+		errco.NewLogln(errco.TYPE_WAR, errco.LVL_3, errco.ERROR_WRONG_CONNECTION_COUNT, "player registry count (%d) different from status ping player count (%d)", len(r.players), online)
+		if online > len(r.players) {
+			r.hidden = online - len(r.players)
+		}
+	}
+}
+
+// Count returns the number of players online on ms.
+//
+// Players hidden in the last status ping sample are counted if the sample is recent.
+func (r *playerRegistry) Count() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if time.Since(r.sampleTime) < time.Minute {
+		return len(r.players) + r.hidden
+	}
+
+	return len(r.players)
+}
+
+// List returns the players online on ms (sorted by join time)
+func (r *playerRegistry) List() []Player {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	list := []Player{}
+	for _, p := range r.players {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].JoinTime.Before(list[j].JoinTime) })
+
+	return list
+}
+
+// Reset unregisters all players (ms is offline)
+func (r *playerRegistry) Reset() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.players = map[string]*Player{}
+	r.hidden = 0
+}
+
+// precedence returns the precedence of a player registry source (lower is more reliable)
+func precedence(source string) int {
+	switch source {
+	case PLAYER_SRC_LOG:
+		return 0
+	case PLAYER_SRC_PROXY:
+		return 1
+	default:
+		return 2
+	}
+}
@@ -0,0 +1,110 @@
+package servstats
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"msh/lib/model"
+)
+
+func Test_playerRegistry(t *testing.T) {
+	r := &playerRegistry{m: &sync.Mutex{}, players: map[string]*Player{}}
+
+	// proxy registers the player, ms log confirms it
+	r.Join("Steve", "11111111-1111-1111-1111-111111111111", "10.0.0.2", PLAYER_SRC_PROXY)
+	r.Join("steve", "", "", PLAYER_SRC_LOG)
+	r.Join("Alex", "", "", PLAYER_SRC_LOG)
+
+	list := r.List()
+	if len(list) != 2 || r.Count() != 2 {
+		t.Fatalf("after join: unexpected players %+v", list)
+	}
+	if p := list[0]; p.Name != "Steve" || p.Address != "10.0.0.2" || p.Source != PLAYER_SRC_LOG || p.UUID != "11111111-1111-1111-1111-111111111111" {
+		t.Errorf("after join: unexpected player %+v", p)
+	}
+
+	// status ping uuid overrides the client uuid (offline mode servers)
+	r.Sample(2, []model.PlayerSample{{Name: "Steve", ID: "22222222-2222-2222-2222-222222222222"}, {Name: "Alex", ID: "33333333-3333-3333-3333-333333333333"}})
+	if p := r.List()[0]; p.UUID != "22222222-2222-2222-2222-222222222222" {
+		t.Errorf("after sample: unexpected uuid %s", p.UUID)
+	}
+
+	// ms log reports the leave
+	r.Leave("ALEX", PLAYER_SRC_LOG)
+	if r.Count() != 1 {
+		t.Errorf("after leave: unexpected count %d", r.Count())
+	}
+
+	// partial sample (players hidden by ms): registered players are kept, hidden players are counted
+	r.Sample(3, []model.PlayerSample{{Name: "Anonymous Player", ID: "00000000-0000-0000-0000-000000000000"}})
+	if len(r.List()) != 1 || r.Count() != 3 {
+		t.Errorf("after partial sample: unexpected players %+v (count %d)", r.List(), r.Count())
+	}
+
+	// complete sample: stale players are removed (except recent joins), unknown players are added
+	r.players["steve"].JoinTime = time.Now().Add(-time.Minute)
+	r.Join("Herobrine", "", "10.0.0.3", PLAYER_SRC_PROXY)
+	r.Sample(1, []model.PlayerSample{{Name: "Notch", ID: "44444444-4444-4444-4444-444444444444"}})
+
+	names := map[string]string{}
+	for _, p := range r.List() {
+		names[p.Name] = p.Source
+	}
+	if len(names) != 2 || names["Notch"] != PLAYER_SRC_STATUS || names["Herobrine"] != PLAYER_SRC_PROXY {
+		t.Errorf("after complete sample: unexpected players %v", names)
+	}
+
+	// no players online
+	r.players["herobrine"].JoinTime = time.Now().Add(-time.Minute)
+	r.players["notch"].JoinTime = time.Now().Add(-time.Minute)
+	r.Sample(0, nil)
+	if r.Count() != 0 {
+		t.Errorf("after empty sample: unexpected players %+v", r.List())
+	}
+
+	r.Join("Steve", "", "", PLAYER_SRC_LOG)
+	r.Reset()
+	if r.Count() != 0 {
+		t.Errorf("after reset: unexpected players %+v", r.List())
+	}
+}
+
+func Test_playerRegistryConn(t *testing.T) {
+	r := &playerRegistry{m: &sync.Mutex{}, players: map[string]*Player{}}
+
+	// closed proxy connection removes the player it registered
+	r.JoinConn("Steve", "", "10.0.0.2", "10.0.0.2:50001")
+	r.LeaveConn("Steve", "10.0.0.2:50001")
+	if r.Count() != 0 {
+		t.Errorf("after proxy leave: unexpected players %+v", r.List())
+	}
+
+	// player reconnected: the old connection doesn't remove it
+	r.JoinConn("Steve", "", "10.0.0.2", "10.0.0.2:50001")
+	r.JoinConn("Steve", "", "10.0.0.2", "10.0.0.2:50002")
+	r.LeaveConn("Steve", "10.0.0.2:50001")
+	if r.Count() != 1 {
+		t.Errorf("after old connection leave: unexpected players %+v", r.List())
+	}
+
+	// player confirmed by ms log: confirmation is notified once, removed by ms log only
+	confirmed := []string{}
+	OnPlayerConfirmed = func(address string) { confirmed = append(confirmed, address) }
+	defer func() { OnPlayerConfirmed = nil }()
+
+	r.JoinConn("Alex", "", "10.0.0.3", "10.0.0.3:50003")
+	r.Join("Alex", "", "", PLAYER_SRC_LOG)
+	r.Join("Alex", "", "", PLAYER_SRC_LOG)
+	if len(confirmed) != 1 || confirmed[0] != "10.0.0.3" {
+		t.Errorf("after log join: unexpected confirmations %v", confirmed)
+	}
+	r.LeaveConn("Alex", "10.0.0.3:50003")
+	if r.Count() != 2 {
+		t.Errorf("after proxy leave of confirmed player: unexpected players %+v", r.List())
+	}
+	r.Leave("Alex", PLAYER_SRC_LOG)
+	if r.Count() != 1 {
+		t.Errorf("after log leave: unexpected players %+v", r.List())
+	}
+}
@@ -12,24 +12,34 @@ var Stats *serverStats = &serverStats{
 	M:              &sync.Mutex{},
 	Status:         errco.SERVER_STATUS_OFFLINE,
 	Suspended:      false,
+	Waking:         false,
+	Starting:       false,
 	MajorError:     nil,
 	ConnCount:      0,
 	FreezeTimer:    time.NewTimer(5 * time.Minute),
 	WarmUpTime:     time.Unix(0, 0), // use 1970-01-01 00:00:00 as init value
+	StartupTime:    0,
 	LoadProgress:   "0%",
 	BytesToClients: 0,
 	BytesToServer:  0,
 }
 
+// OnMajorError, if not nil, is called when the major error of ms is set
+var OnMajorError func(e *errco.MshLog)
+
 type serverStats struct {
 	M              *sync.Mutex
 	Status         int           // represent the status of the minecraft server
 	Suspended      bool          // status of minecraft server process (if ms is offline, should be set to false)
+	Waking         bool          // the machine hosting minecraft server is waking (wake-on-lan), ms is offline
+	Starting       bool          // ms start was issued (pre-start hook is running), ms is offline
 	MajorError     *errco.MshLog // if !nil the server is having some major problems
 	ConnCount      int           // tracks active client connections to ms (only clients that are playing on ms)
 	FreezeTimer    *time.Timer   // timer to freeze minecraft server
 	WarmUpTime     time.Time     // time at which minecraft server was warmed up
+	StartupTime    time.Duration // duration of the last minecraft server startup (0 if unknown)
 	LoadProgress   string        // tracks loading percentage of starting server
+	Watchdog       string        // last step taken by the watchdog ("" if none)
 	BytesToClients float64       // tracks bytes/s server->clients
 	BytesToServer  float64       // tracks bytes/s clients->server
 }
@@ -38,5 +48,9 @@ type serverStats struct {
 func (s *serverStats) SetMajorError(e *errco.MshLog) {
 	if s.MajorError == nil {
 		s.MajorError = e
+
+		if OnMajorError != nil {
+			OnMajorError(e)
+		}
 	}
 }
@@ -7,9 +7,11 @@ import (
 	"msh/lib/config"
 	"msh/lib/conn"
 	"msh/lib/errco"
+	"msh/lib/hook"
 	"msh/lib/input"
 	"msh/lib/progmgr"
 	"msh/lib/servctrl"
+	"msh/lib/servstats"
 	"msh/lib/utility"
 )
 
@@ -36,13 +38,24 @@ func main() {
 		progmgr.AutoTerminate()
 	}
 
+	// run major-error hook when ms encounters a major error
+	// (config errors are not notified: hooks config might not be valid)
+	servstats.OnMajorError = hook.MajorError
+
+	// register in join history the players accepted by ms (pre-warm)
+	servstats.OnPlayerConfirmed = conn.JoinConfirmed
+
+	// save connection data kept in memory when msh exits
+	progmgr.OnExit = conn.Flush
+
 	// launch msh manager
 	go progmgr.MshMgr()
 	// wait for the initial update check
 	<-progmgr.ReqSent
 
 	// if ms suspension is allowed, pre-warm the server
-	if config.ConfigRuntime.Msh.SuspendAllow {
+	// (in agent mode ms is warmed by msh front)
+	if config.ConfigRuntime.Msh.SuspendAllow && !config.ConfigRuntime.Msh.Agent.Enabled {
 		errco.NewLogln(errco.TYPE_INF, errco.LVL_1, errco.ERROR_NIL, "minecraft server will now pre-warm (SuspendAllow is enabled)...")
 		logMsh = servctrl.WarmMS()
 		if logMsh != nil {
@@ -53,13 +66,62 @@ func main() {
 	// launch GetInput()
 	go input.GetInput()
 
+	// launch external backend monitor
+	if config.ConfigRuntime.Msh.Backend.Type == config.BACKEND_EXTERNAL {
+		go servctrl.ExternalMonitor()
+	}
+
+	// launch docker backend monitor
+	if config.ConfigRuntime.Msh.Backend.Type == config.BACKEND_DOCKER {
+		go servctrl.DockerMonitor()
+	}
+
+	// launch http backend monitor
+	if config.ConfigRuntime.Msh.Backend.Type == config.BACKEND_HTTP {
+		go servctrl.HttpMonitor()
+	}
+
+	// launch agent backend monitor
+	if config.ConfigRuntime.Msh.Backend.Type == config.BACKEND_AGENT {
+		go servctrl.AgentMonitor()
+	}
+
+	// launch minecraft server watchdog
+	if config.ConfigRuntime.Msh.Watchdog.Enabled {
+		go servctrl.Watchdog()
+	}
+
+	// agent mode: msh controls ms on behalf of msh front (clients are not proxied)
+	if config.ConfigRuntime.Msh.Agent.Enabled {
+		logMsh = servctrl.Agent()
+		if logMsh != nil {
+			logMsh.Log(true)
+		}
+		progmgr.AutoTerminate()
+		// wait for msh manager to terminate msh
+		select {}
+	}
+
 	// ---------------- connections ---------------- //
 
+	// launch player registry sampler
+	go servctrl.PlayerSampler()
+
 	// launch query handler
 	if config.ConfigRuntime.Msh.EnableQuery {
 		go conn.HandlerQuery()
 	}
 
+	// launch lan announcer
+	if config.ConfigRuntime.Msh.LanAnnounce.Enabled {
+		go conn.LanAnnouncer()
+	}
+
+	// launch rcon endpoint
+	if config.ConfigRuntime.Msh.RconEndpoint.Enabled {
+		go conn.HandlerRcon()
+	}
+
 	// open a tcp listener
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.MshHost, config.MshPort))
 	if err != nil {